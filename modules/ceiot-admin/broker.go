@@ -0,0 +1,30 @@
+package main
+
+import (
+	"ceiot-tf-background/modules/utils/mqtt/broker"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// runBrokerCommand serves the embedded MQTT broker for local development,
+// point MQTT_PROTOCOL=mqtt, MQTT_HOST and MQTT_PORT at it.
+func runBrokerCommand(args []string) error {
+	flags := flag.NewFlagSet("mqtt-broker", flag.ExitOnError)
+	addr := flags.String("addr", ":1883", "address to listen on")
+	flags.Parse(args)
+
+	mqttBroker := broker.New(broker.Options{Logf: broker.Logger})
+	if err := mqttBroker.Listen(*addr); err != nil {
+		return err
+	}
+	log.Printf("MQTT broker listening on %s\n", mqttBroker.Addr())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+
+	return mqttBroker.Close()
+}
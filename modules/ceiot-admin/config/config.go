@@ -0,0 +1,75 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+
+	"ceiot-tf-background/modules/ceiot-admin/models"
+	"ceiot-tf-background/modules/utils/deadletter"
+	"ceiot-tf-background/modules/utils/env"
+	"ceiot-tf-background/modules/utils/kafka"
+	"ceiot-tf-background/modules/utils/mqtt"
+)
+
+func LoadEnvVars() (*models.Config, error) {
+	kafkaClientID := "background-ceiot-admin-kafka-client"
+	kafkaBroker := os.Getenv("KAFKA_BROKER")
+	kafkaBrokers := []string{kafkaBroker}
+	kafkaSecurity, err := kafka.SecurityFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	kafkaDataTopic := env.GetString("KAFKA_TOPIC_DEVICE_DATA_EVENTS", "device-data-events")
+	kafkaUpdateTopic := env.GetString("KAFKA_TOPIC_DEVICE_UPDATE_EVENTS", "device-update-events")
+	kafkaTopics := []string{
+		kafkaDataTopic,
+		kafkaUpdateTopic,
+		deadletter.TopicFor(kafkaDataTopic),
+		deadletter.TopicFor(kafkaUpdateTopic),
+	}
+	// Services that do not consume from Kafka dead-letter to a topic of their own.
+	for _, serviceName := range []string{"data-reception"} {
+		kafkaTopics = append(kafkaTopics, deadletter.TopicFor(serviceName))
+	}
+	kafkaTopicSpecs, err := kafka.TopicSpecsFromEnv(kafkaTopics...)
+	if err != nil {
+		return nil, err
+	}
+
+	mqttClientID := "background-ceiot-admin-mqtt-client"
+	mqttProtocol := os.Getenv("MQTT_PROTOCOL")
+	mqttHost := os.Getenv("MQTT_HOST")
+	mqttPort := os.Getenv("MQTT_PORT")
+	mqttBroker := mqtt.BrokerURL(mqttProtocol, mqttHost, mqttPort)
+	mqttTLS, err := mqtt.TLSFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	mqttProtocolVersion, err := mqtt.ParseProtocolVersion(os.Getenv("MQTT_PROTOCOL_VERSION"))
+	if err != nil {
+		return nil, err
+	}
+
+	postgresUser := os.Getenv("POSTGRES_USER")
+	postgresPassword := os.Getenv("POSTGRES_PASSWORD")
+	postgresHost := os.Getenv("POSTGRES_HOST")
+	postgresPort := os.Getenv("POSTGRES_PORT")
+	postgresDB := os.Getenv("POSTGRES_DB")
+	encodedPostgresPassword := url.QueryEscape(postgresPassword)
+	postgresURL := fmt.Sprintf("postgres://%s:%s@%s:%s/%s", postgresUser, encodedPostgresPassword, postgresHost, postgresPort, postgresDB)
+
+	config := &models.Config{
+		KafkaClientID:       kafkaClientID,
+		KafkaBrokers:        kafkaBrokers,
+		KafkaSecurity:       kafkaSecurity,
+		KafkaTopicSpecs:     kafkaTopicSpecs,
+		MQTTClientID:        mqttClientID,
+		MQTTTLS:             mqttTLS,
+		MQTTProtocolVersion: mqttProtocolVersion,
+		MQTTBroker:          mqttBroker,
+		PostgresURL:         postgresURL,
+	}
+
+	return config, nil
+}
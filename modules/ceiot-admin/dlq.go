@@ -0,0 +1,319 @@
+package main
+
+import (
+	"ceiot-tf-background/modules/ceiot-admin/models"
+	"ceiot-tf-background/modules/ceiot-admin/postgres"
+	"ceiot-tf-background/modules/utils/deadletter"
+	"ceiot-tf-background/modules/utils/kafka"
+	"ceiot-tf-background/modules/utils/mqtt"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var (
+	kafkaClient   *kafka.Client
+	kafkaProducer *kafka.Producer
+	mqttClient    *mqtt.Client
+)
+
+func runDeadLetterCommand(args []string) error {
+	if len(args) == 0 {
+		printUsage()
+		return errors.New("missing dlq subcommand")
+	}
+
+	flags := flag.NewFlagSet("dlq "+args[0], flag.ExitOnError)
+	topic := flags.String("topic", "", "dead-letter topic, e.g. device-data-events.dlq")
+	partition := flags.Int("partition", 0, "partition of the dead-letter topic")
+	from := flags.Int64("from", 0, "first offset to list")
+	offsets := flags.String("offsets", "", "comma separated offsets to replay")
+	table := flags.Bool("table", false, "use the DEAD_LETTERS table instead of a topic")
+	ids := flags.String("ids", "", "comma separated DEAD_LETTERS ids to replay")
+	limit := flags.Int("limit", 50, "maximum number of entries")
+	flags.Parse(args[1:])
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	defer closeClients()
+
+	switch args[0] {
+	case "list":
+		if *table {
+			return listTableDeadLetters(*limit)
+		}
+		if *topic == "" {
+			return errors.New("-topic or -table is required")
+		}
+		return listTopicDeadLetters(ctx, *topic, *partition, *from, *limit)
+	case "replay":
+		if *table {
+			tableIDs, err := parseList(*ids, strconv.Atoi)
+			if err != nil {
+				return fmt.Errorf("invalid -ids: %w", err)
+			}
+			if len(tableIDs) == 0 {
+				return errors.New("-ids is required with -table")
+			}
+			return replayTableDeadLetters(ctx, tableIDs)
+		}
+		if *topic == "" {
+			return errors.New("-topic or -table is required")
+		}
+		topicOffsets, err := parseList(*offsets, func(s string) (int64, error) { return strconv.ParseInt(s, 10, 64) })
+		if err != nil {
+			return fmt.Errorf("invalid -offsets: %w", err)
+		}
+		if len(topicOffsets) == 0 {
+			return errors.New("-offsets is required with -topic")
+		}
+		return replayTopicDeadLetters(ctx, *topic, *partition, topicOffsets)
+	default:
+		printUsage()
+		return fmt.Errorf("unknown dlq subcommand %q", args[0])
+	}
+}
+
+func listTopicDeadLetters(ctx context.Context, topic string, partition int, from int64, limit int) error {
+	client, err := getKafkaClient()
+	if err != nil {
+		return err
+	}
+
+	messages, err := client.ReadPartition(ctx, topic, partition, from, limit)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "OFFSET\tSERVICE\tSOURCE\tFAILED AT\tERROR")
+	for _, msg := range messages {
+		entry, err := deadletter.FromMessage(msg)
+		if err != nil {
+			fmt.Fprintf(w, "%d\t-\t-\t-\t%v\n", msg.Offset, err)
+			continue
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s:%s\t%s\t%s\n", msg.Offset, entry.Service, entry.SourceTransport, entry.SourceTopic,
+			entry.FailedAtUtc.Format(time.RFC3339), entry.Error)
+	}
+	return w.Flush()
+}
+
+func listTableDeadLetters(limit int) error {
+	if err := connectDatabase(); err != nil {
+		return err
+	}
+
+	deadLetters, err := postgres.GetPendingDeadLetters([]int{}, limit)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSERVICE\tSOURCE\tFAILED AT\tERROR")
+	for _, deadLetter := range deadLetters {
+		fmt.Fprintf(w, "%d\t%s\t%s:%s\t%s\t%s\n", deadLetter.ID, deadLetter.Service, deadLetter.SourceTransport,
+			deadLetter.SourceTopic, deadLetter.FailedAtUtc.Format(time.RFC3339), deadLetter.Error)
+	}
+	return w.Flush()
+}
+
+func replayTopicDeadLetters(ctx context.Context, topic string, partition int, offsets []int64) error {
+	client, err := getKafkaClient()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, offset := range offsets {
+		messages, err := client.ReadPartition(ctx, topic, partition, offset, 1)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if len(messages) == 0 || messages[0].Offset != offset {
+			errs = append(errs, fmt.Errorf("offset %d not found in %s/%d", offset, topic, partition))
+			continue
+		}
+
+		entry, err := deadletter.FromMessage(messages[0])
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		if err := replayEntry(ctx, entry); err != nil {
+			errs = append(errs, fmt.Errorf("offset %d: %w", offset, err))
+			continue
+		}
+		fmt.Printf("Replayed offset %d to %s:%s\n", offset, entry.SourceTransport, entry.SourceTopic)
+	}
+
+	return errors.Join(errs...)
+}
+
+func replayTableDeadLetters(ctx context.Context, ids []int) error {
+	if err := connectDatabase(); err != nil {
+		return err
+	}
+
+	deadLetters, err := postgres.GetPendingDeadLetters(ids, len(ids))
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	found := map[int]bool{}
+	for _, deadLetter := range deadLetters {
+		found[deadLetter.ID] = true
+		if err := replayEntry(ctx, toEntry(deadLetter)); err != nil {
+			errs = append(errs, fmt.Errorf("id %d: %w", deadLetter.ID, err))
+			continue
+		}
+		if err := postgres.MarkDeadLetterReplayed(deadLetter.ID); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		fmt.Printf("Replayed id %d to %s:%s\n", deadLetter.ID, deadLetter.SourceTransport, deadLetter.SourceTopic)
+	}
+
+	for _, id := range ids {
+		if !found[id] {
+			errs = append(errs, fmt.Errorf("id %d not found or already replayed", id))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func replayEntry(ctx context.Context, entry deadletter.Entry) error {
+	switch entry.SourceTransport {
+	case deadletter.TransportKafka:
+		producer, err := getKafkaProducer()
+		if err != nil {
+			return err
+		}
+		return producer.Publish(ctx, kafka.Message{
+			Topic:   entry.SourceTopic,
+			Key:     entry.Key,
+			Value:   entry.Payload,
+			Headers: entry.Headers,
+		})
+	case deadletter.TransportMQTT:
+		client, err := connectMQTT(ctx)
+		if err != nil {
+			return err
+		}
+		return client.Publish(entry.SourceTopic, mqtt.AtLeastOnce, false, entry.Payload)
+	default:
+		return fmt.Errorf("unknown source transport %q", entry.SourceTransport)
+	}
+}
+
+func toEntry(deadLetter models.DeadLetter) deadletter.Entry {
+	return deadletter.Entry{
+		Service:         deadLetter.Service,
+		SourceTransport: deadLetter.SourceTransport,
+		SourceTopic:     deadLetter.SourceTopic,
+		Key:             deadLetter.MessageKey,
+		Payload:         deadLetter.Payload,
+		Headers:         deadLetter.Headers,
+		Error:           deadLetter.Error,
+		FailedAtUtc:     deadLetter.FailedAtUtc,
+	}
+}
+
+func getKafkaClient() (*kafka.Client, error) {
+	if kafkaClient != nil {
+		return kafkaClient, nil
+	}
+
+	client, err := kafka.NewClient(kafka.ClientOptions{
+		Brokers:  cfg.KafkaBrokers,
+		ClientID: cfg.KafkaClientID,
+		Security: cfg.KafkaSecurity,
+	})
+	if err != nil {
+		return nil, err
+	}
+	kafkaClient = client
+	return kafkaClient, nil
+}
+
+func getKafkaProducer() (*kafka.Producer, error) {
+	if kafkaProducer != nil {
+		return kafkaProducer, nil
+	}
+
+	client, err := getKafkaClient()
+	if err != nil {
+		return nil, err
+	}
+	kafkaProducer = client.NewProducer(kafka.ProducerOptions{})
+	return kafkaProducer, nil
+}
+
+func connectMQTT(ctx context.Context) (*mqtt.Client, error) {
+	if mqttClient == nil {
+		client, err := mqtt.NewClient(mqtt.ClientOptions{
+			Broker:          cfg.MQTTBroker,
+			ProtocolVersion: cfg.MQTTProtocolVersion,
+			ClientID:        cfg.MQTTClientID,
+			TLS:             cfg.MQTTTLS,
+		})
+		if err != nil {
+			return nil, err
+		}
+		mqttClient = client
+		mqttClient.Connect()
+	}
+
+	if err := mqttClient.WaitConnected(ctx); err != nil {
+		return nil, err
+	}
+	return mqttClient, nil
+}
+
+func connectDatabase() error {
+	if err := postgres.ConnectDB(cfg.PostgresURL); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return postgres.EnsureDeadLetterTable(ctx)
+}
+
+func closeClients() {
+	if mqttClient != nil {
+		mqttClient.Disconnect(250 * time.Millisecond)
+	}
+	if kafkaProducer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		kafkaProducer.Close(ctx)
+	}
+	postgres.CloseDB()
+}
+
+func parseList[T any](value string, parse func(string) (T, error)) ([]T, error) {
+	items := []T{}
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		item, err := parse(part)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
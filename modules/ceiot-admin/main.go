@@ -0,0 +1,62 @@
+package main
+
+import (
+	"ceiot-tf-background/modules/ceiot-admin/config"
+	"ceiot-tf-background/modules/ceiot-admin/models"
+	"fmt"
+	"log"
+	"os"
+)
+
+var (
+	err error
+	cfg *models.Config
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		printUsage()
+		os.Exit(2)
+	}
+
+	loadConfiguration()
+
+	switch os.Args[1] {
+	case "dlq":
+		err = runDeadLetterCommand(os.Args[2:])
+	case "topics":
+		err = runTopicsCommand(os.Args[2:])
+	case "readings":
+		err = runReadingsCommand(os.Args[2:])
+	case "mqtt-broker":
+		err = runBrokerCommand(os.Args[2:])
+	default:
+		printUsage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		log.Fatalf("%s: %v", os.Args[1], err)
+	}
+}
+
+func loadConfiguration() {
+	cfg, err = config.LoadEnvVars()
+	if err != nil {
+		log.Fatalf("Failed to load environment variables: %v", err)
+	}
+}
+
+func printUsage() {
+	fmt.Fprintln(os.Stderr, `Usage: ceiot-admin <command> [arguments]
+
+Commands:
+  dlq list    -topic <name> [-partition N] [-from OFFSET] [-limit N]
+  dlq list    -table [-limit N]
+  dlq replay  -topic <name> [-partition N] -offsets 12,15
+  dlq replay  -table -ids 4,7
+  topics list
+  topics ensure
+  readings dedupe
+  mqtt-broker [-addr :1883]`)
+}
@@ -0,0 +1,32 @@
+package models
+
+import (
+	"time"
+
+	"ceiot-tf-background/modules/utils/kafka"
+	"ceiot-tf-background/modules/utils/mqtt"
+)
+
+type Config struct {
+	KafkaClientID       string
+	KafkaBrokers        []string
+	KafkaSecurity       kafka.SecurityOptions
+	KafkaTopicSpecs     []kafka.TopicSpec
+	MQTTTLS             mqtt.TLSOptions
+	MQTTProtocolVersion byte
+	MQTTBroker          string
+	MQTTClientID        string
+	PostgresURL         string
+}
+
+type DeadLetter struct {
+	ID              int
+	Service         string
+	SourceTransport string
+	SourceTopic     string
+	MessageKey      []byte
+	Payload         []byte
+	Headers         map[string]string
+	Error           string
+	FailedAtUtc     time.Time
+}
@@ -0,0 +1,131 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"ceiot-tf-background/modules/ceiot-admin/models"
+	"ceiot-tf-background/modules/utils/deadletter"
+	"ceiot-tf-background/modules/utils/parameters"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var (
+	db *pgxpool.Pool
+)
+
+func ConnectDB(connString string) error {
+	ctx := context.Background()
+	pool, err := pgxpool.New(ctx, connString)
+	if err != nil {
+		return err
+	}
+
+	db = pool
+	log.Println("Connected to PostgreSQL")
+	return nil
+}
+
+func CloseDB() {
+	if db != nil {
+		db.Close()
+		log.Println("PostgreSQL connection closed")
+	}
+}
+
+func EnsureDeadLetterTable(ctx context.Context) error {
+	return deadletter.EnsureTable(ctx, db)
+}
+
+func GetPendingDeadLetters(ids []int, limit int) ([]models.DeadLetter, error) {
+	query := `
+		SELECT ID, SERVICE, SOURCE_TRANSPORT, SOURCE_TOPIC, MESSAGE_KEY, PAYLOAD, HEADERS, ERROR, FAILED_AT_UTC
+		FROM DEAD_LETTERS
+		WHERE REPLAYED_AT_UTC IS NULL
+			AND (CARDINALITY($1::INTEGER[]) = 0 OR ID = ANY($1::INTEGER[]))
+		ORDER BY ID
+		LIMIT $2
+	`
+
+	rows, err := db.Query(context.Background(), query, ids, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error getting dead letters: %w", err)
+	}
+	defer rows.Close()
+
+	deadLetters := []models.DeadLetter{}
+	for rows.Next() {
+		var deadLetter models.DeadLetter
+		if err := rows.Scan(&deadLetter.ID, &deadLetter.Service, &deadLetter.SourceTransport, &deadLetter.SourceTopic,
+			&deadLetter.MessageKey, &deadLetter.Payload, &deadLetter.Headers, &deadLetter.Error, &deadLetter.FailedAtUtc); err != nil {
+			return nil, fmt.Errorf("error scanning dead letter: %w", err)
+		}
+		deadLetters = append(deadLetters, deadLetter)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over dead letters: %w", err)
+	}
+
+	return deadLetters, nil
+}
+
+func MarkDeadLetterReplayed(id int) error {
+	query := `
+		UPDATE DEAD_LETTERS
+		SET REPLAYED_AT_UTC = NOW() AT TIME ZONE 'UTC'
+		WHERE ID = $1
+	`
+
+	_, err := db.Exec(context.Background(), query, id)
+	if err != nil {
+		return fmt.Errorf("error marking dead letter %d as replayed: %w", id, err)
+	}
+	return nil
+}
+
+// DeleteDuplicateReadings keeps the first row of every natural key of the raw
+// table of parameter, pointing threshold alerts at it, and then creates the
+// unique index that keeps the table free of duplicates.
+func DeleteDuplicateReadings(ctx context.Context, parameter *parameters.Parameter) (int64, error) {
+	naturalKey := strings.Join(parameter.NaturalKey(), ", ")
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	query := fmt.Sprintf(`
+		WITH DUPLICATES AS (
+			SELECT ID, MIN(ID) OVER (PARTITION BY %s) AS KEEP_ID
+			FROM %s
+		), REMAPPED AS (
+			UPDATE THRESHOLD_ALERTS A
+			SET ID_REFERENCE = D.KEEP_ID
+			FROM DUPLICATES D
+			WHERE UPPER(A.TABLE_POINTER) = $1 AND A.ID_REFERENCE = D.ID AND D.ID <> D.KEEP_ID
+		)
+		DELETE FROM %s T
+		USING DUPLICATES D
+		WHERE T.ID = D.ID AND D.ID <> D.KEEP_ID
+	`, naturalKey, parameter.Table, parameter.Table)
+
+	tag, err := tx.Exec(ctx, query, strings.ToUpper(parameter.Table))
+	if err != nil {
+		return 0, fmt.Errorf("error deleting duplicates from %s: %w", parameter.Table, err)
+	}
+
+	query = fmt.Sprintf("CREATE UNIQUE INDEX IF NOT EXISTS %s_NATURAL_KEY ON %s (%s)", parameter.Table, parameter.Table, naturalKey)
+	if _, err := tx.Exec(ctx, query); err != nil {
+		return 0, fmt.Errorf("error creating natural key on %s: %w", parameter.Table, err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("error committing transaction: %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
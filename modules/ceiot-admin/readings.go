@@ -0,0 +1,51 @@
+package main
+
+import (
+	"ceiot-tf-background/modules/ceiot-admin/postgres"
+	"ceiot-tf-background/modules/utils/parameters"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+func runReadingsCommand(args []string) error {
+	if len(args) == 0 {
+		printUsage()
+		return errors.New("missing readings subcommand")
+	}
+
+	switch args[0] {
+	case "dedupe":
+		return dedupeReadings()
+	default:
+		printUsage()
+		return fmt.Errorf("unknown readings subcommand %q", args[0])
+	}
+}
+
+// dedupeReadings removes readings stored more than once, which blocks the
+// natural keys data-reception relies on to skip retransmissions.
+func dedupeReadings() error {
+	if err := connectDatabase(); err != nil {
+		return err
+	}
+	defer postgres.CloseDB()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TABLE\tNATURAL KEY\tDUPLICATES REMOVED")
+	for _, parameter := range parameters.All() {
+		removed, err := postgres.DeleteDuplicateReadings(ctx, parameter)
+		if err != nil {
+			w.Flush()
+			return err
+		}
+		fmt.Fprintf(w, "%s\t%v\t%d\n", parameter.Table, parameter.NaturalKey(), removed)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"ceiot-tf-background/modules/utils/kafka"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+func runTopicsCommand(args []string) error {
+	if len(args) == 0 {
+		printUsage()
+		return errors.New("missing topics subcommand")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	client, err := getKafkaClient()
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "list":
+		return listTopics(ctx, client)
+	case "ensure":
+		if err := client.EnsureTopics(ctx, cfg.KafkaTopicSpecs...); err != nil {
+			return err
+		}
+		return listTopics(ctx, client)
+	default:
+		printUsage()
+		return fmt.Errorf("unknown topics subcommand %q", args[0])
+	}
+}
+
+func listTopics(ctx context.Context, client *kafka.Client) error {
+	names := make([]string, len(cfg.KafkaTopicSpecs))
+	for i, spec := range cfg.KafkaTopicSpecs {
+		names[i] = spec.Name
+	}
+
+	statuses, err := client.DescribeTopics(ctx, names...)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TOPIC\tPARTITIONS\tREPLICATION\tRETENTION MS\tCLEANUP POLICY\tSTATUS")
+	for i, status := range statuses {
+		if !status.Exists {
+			fmt.Fprintf(w, "%s\t-\t-\t-\t-\tmissing\n", status.Name)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\t%s\n", status.Name, status.Partitions, status.ReplicationFactor,
+			status.Configs["retention.ms"], status.Configs["cleanup.policy"], topicDrift(cfg.KafkaTopicSpecs[i], status))
+	}
+	return w.Flush()
+}
+
+func topicDrift(spec kafka.TopicSpec, status kafka.TopicStatus) string {
+	drift := []string{}
+	if status.Partitions < spec.Partitions {
+		drift = append(drift, fmt.Sprintf("needs %d partitions", spec.Partitions))
+	}
+	if status.ReplicationFactor < spec.ReplicationFactor {
+		drift = append(drift, fmt.Sprintf("needs replication %d", spec.ReplicationFactor))
+	}
+	if status.Configs["cleanup.policy"] != spec.CleanupPolicy {
+		drift = append(drift, "cleanup policy differs")
+	}
+	if len(drift) == 0 {
+		return "ok"
+	}
+	return strings.Join(drift, ", ")
+}
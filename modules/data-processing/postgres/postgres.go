@@ -1,9 +1,11 @@
 package postgres
 
 import (
+	"ceiot-tf-background/modules/utils/parameters"
 	"context"
 	"fmt"
 	"log"
+	"strings"
 	"time"
 
 	"github.com/jackc/pgx/v5"
@@ -72,12 +74,17 @@ func GetActiveParameters() ([]string, error) {
 }
 
 func ProcessParameterData(deviceID string, param string) (int, error) {
+	parameter, err := hourlyParameter(param)
+	if err != nil {
+		return -1, err
+	}
+
 	lastProcessed, err := getLastProcessedTime(deviceID, param)
 	if err != nil {
 		return -1, fmt.Errorf("could not fetch last processed time: %w", err)
 	}
 
-	firstDataTime, err := getFirstDataTimestamp(param, deviceID, lastProcessed)
+	firstDataTime, err := getFirstDataTimestamp(parameter, deviceID, lastProcessed)
 	if err != nil {
 		return -1, fmt.Errorf("could not fetch first data timestamp: %w", err)
 	}
@@ -96,12 +103,16 @@ func ProcessParameterData(deviceID string, param string) (int, error) {
 		return 0, nil
 	}
 
-	functions := getProcessFunctions()
-	if function, exists := functions[param]; exists {
-		return function(deviceID, startTime)
-	} else {
-		return -1, fmt.Errorf("unsupported parameter: %s", param)
+	return processHourlyData(deviceID, parameter, startTime)
+}
+
+// hourlyParameter returns the descriptor of param when it has an hourly aggregate.
+func hourlyParameter(param string) (*parameters.Parameter, error) {
+	parameter, exists := parameters.Lookup(param)
+	if !exists || parameter.HourlyTable == "" {
+		return nil, fmt.Errorf("unsupported parameter: %s", param)
 	}
+	return parameter, nil
 }
 
 func getStartTime(lastProcessed time.Time) time.Time {
@@ -124,38 +135,12 @@ func getLastProcessedTime(deviceID, param string) (time.Time, error) {
 	return lastProcessed, err
 }
 
-func getFirstDataTimestamp(param string, deviceID string, lastProcessed time.Time) (time.Time, error) {
+func getFirstDataTimestamp(parameter *parameters.Parameter, deviceID string, lastProcessed time.Time) (time.Time, error) {
 	var firstTimestamp *time.Time
-	var query string
-	switch param {
-	case "cpu_temp":
-		query = `
-		SELECT MIN(COLLECTED_AT_UTC) 
-			FROM CPU_TEMPERATURE 
-		WHERE ID_DEVICE = $1 AND COLLECTED_AT_UTC >= $2`
-	case "load_average":
-		query = `
-		SELECT MIN(COLLECTED_AT_UTC) 
-			FROM LOAD_AVERAGE 
-		WHERE ID_DEVICE = $1 AND COLLECTED_AT_UTC >= $2`
-	case "disk":
-		query = `
-		SELECT MIN(COLLECTED_AT_UTC) 
-			FROM DISK_USAGE 
-		WHERE ID_DEVICE = $1 AND COLLECTED_AT_UTC >= $2`
-	case "ram":
-		query = `
-		SELECT MIN(COLLECTED_AT_UTC) 
-			FROM RAM_USAGE 
-		WHERE ID_DEVICE = $1 AND COLLECTED_AT_UTC >= $2`
-	case "cpu_usage":
-		query = `
+	query := fmt.Sprintf(`
 		SELECT MIN(COLLECTED_AT_UTC) 
-			FROM CPU_USAGE
-		WHERE ID_DEVICE = $1 AND COLLECTED_AT_UTC >= $2`
-	default:
-		return time.Time{}, fmt.Errorf("unsupported parameter: %s", param)
-	}
+			FROM %s 
+		WHERE ID_DEVICE = $1 AND COLLECTED_AT_UTC >= $2`, parameter.Table)
 
 	err := db.QueryRow(context.Background(), query, deviceID, lastProcessed).Scan(&firstTimestamp)
 
@@ -167,270 +152,70 @@ func getFirstDataTimestamp(param string, deviceID string, lastProcessed time.Tim
 	}
 
 	if firstTimestamp == nil {
-		return time.Time{}, fmt.Errorf("No recent data for device %s and parameter %s", deviceID, param)
+		return time.Time{}, fmt.Errorf("No recent data for device %s and parameter %s", deviceID, parameter.ID)
 	}
 
 	return *firstTimestamp, err
 }
 
-func processCPUTempData(deviceID string, startTime time.Time) (int, error) {
-	nextHour := startTime.Add(time.Hour)
-	endTime := nextHour.Add(-1 * time.Second)
-
-	query := `
-			INSERT INTO CPU_TEMPERATURE_HOURLY (
-					ID_DEVICE, 
-					SENSOR_KEY, 
-					START_TIME, 
-					AVG_TEMPERATURE, 
-					MIN_TEMPERATURE, 
-					MAX_TEMPERATURE, 
-					ROW_COUNT, 
-					INSERTED_AT_UTC
-			)
-			SELECT 
-					ID_DEVICE, 
-					SENSOR_KEY, 
-					$2 AS START_TIME,
-					AVG(TEMPERATURE) AS AVG_TEMPERATURE,
-					MIN(TEMPERATURE) AS MIN_TEMPERATURE,
-					MAX(TEMPERATURE) AS MAX_TEMPERATURE,
-					COUNT(*) AS ROW_COUNT, 
-					CURRENT_TIMESTAMP AS INSERTED_AT_UTC
-			FROM CPU_TEMPERATURE
-			WHERE ID_DEVICE = $1 AND COLLECTED_AT_UTC BETWEEN $2 AND $3
-			GROUP BY ID_DEVICE, SENSOR_KEY
-			ON CONFLICT (ID_DEVICE, SENSOR_KEY, START_TIME)
-			DO UPDATE SET 
-					AVG_TEMPERATURE = EXCLUDED.AVG_TEMPERATURE,
-					MIN_TEMPERATURE = EXCLUDED.MIN_TEMPERATURE,
-					MAX_TEMPERATURE = EXCLUDED.MAX_TEMPERATURE,
-					ROW_COUNT = EXCLUDED.ROW_COUNT, 
-					INSERTED_AT_UTC = EXCLUDED.INSERTED_AT_UTC
-	`
-
-	_, err := db.Exec(context.Background(), query, deviceID, startTime, endTime)
-	if err != nil {
-		return -1, fmt.Errorf("could not process CPU temperature data for device %s: %w", deviceID, err)
-	}
-
-	err = updateProcessingPointer(deviceID, "cpu_temp", nextHour)
-	if err != nil {
-		return -1, fmt.Errorf("could not update processing pointer for device %s and parameter cpu_temp: %w", deviceID, err)
-	}
-
-	return 1, nil
-}
-
-func processLoadAverageData(deviceID string, startTime time.Time) (int, error) {
+// processHourlyData aggregates one hour of raw readings into the hourly
+// table of parameter, grouped by its dimension if it has one.
+func processHourlyData(deviceID string, parameter *parameters.Parameter, startTime time.Time) (int, error) {
 	nextHour := startTime.Add(time.Hour)
 	endTime := nextHour.Add(-1 * time.Second)
 
-	query := `
-			INSERT INTO LOAD_AVERAGE_HOURLY (
-					ID_DEVICE,
-					START_TIME,
-					AVG_LOAD_AVERAGE_1M,
-					MIN_LOAD_AVERAGE_1M,
-					MAX_LOAD_AVERAGE_1M,
-					AVG_LOAD_AVERAGE_5M,
-					MIN_LOAD_AVERAGE_5M,
-					MAX_LOAD_AVERAGE_5M,
-					AVG_LOAD_AVERAGE_15M,
-					MIN_LOAD_AVERAGE_15M,
-					MAX_LOAD_AVERAGE_15M,
-					ROW_COUNT,
-					INSERTED_AT_UTC
-			)
-			SELECT 
-					ID_DEVICE,
-					$2 AS START_TIME,
-					AVG(LOAD_AVERAGE_1M) AS AVG_LOAD_AVERAGE_1M,
-					MIN(LOAD_AVERAGE_1M) AS MIN_LOAD_AVERAGE_1M,
-					MAX(LOAD_AVERAGE_1M) AS MAX_LOAD_AVERAGE_1M,
-					AVG(LOAD_AVERAGE_5M) AS AVG_LOAD_AVERAGE_5M,
-					MIN(LOAD_AVERAGE_5M) AS MIN_LOAD_AVERAGE_5M,
-					MAX(LOAD_AVERAGE_5M) AS MAX_LOAD_AVERAGE_5M,
-					AVG(LOAD_AVERAGE_15M) AS AVG_LOAD_AVERAGE_15M,
-					MIN(LOAD_AVERAGE_15M) AS MIN_LOAD_AVERAGE_15M,
-					MAX(LOAD_AVERAGE_15M) AS MAX_LOAD_AVERAGE_15M,
-					COUNT(*) AS ROW_COUNT,
-					CURRENT_TIMESTAMP AS INSERTED_AT_UTC
-			FROM LOAD_AVERAGE
-			WHERE ID_DEVICE = $1 AND COLLECTED_AT_UTC BETWEEN $2 AND $3
-			GROUP BY ID_DEVICE
-			ON CONFLICT (ID_DEVICE, START_TIME)
-			DO UPDATE SET 
-					AVG_LOAD_AVERAGE_1M = EXCLUDED.AVG_LOAD_AVERAGE_1M,
-					MIN_LOAD_AVERAGE_1M = EXCLUDED.MIN_LOAD_AVERAGE_1M,
-					MAX_LOAD_AVERAGE_1M = EXCLUDED.MAX_LOAD_AVERAGE_1M,
-					AVG_LOAD_AVERAGE_5M = EXCLUDED.AVG_LOAD_AVERAGE_5M,
-					MIN_LOAD_AVERAGE_5M = EXCLUDED.MIN_LOAD_AVERAGE_5M,
-					MAX_LOAD_AVERAGE_5M = EXCLUDED.MAX_LOAD_AVERAGE_5M,
-					AVG_LOAD_AVERAGE_15M = EXCLUDED.AVG_LOAD_AVERAGE_15M,
-					MIN_LOAD_AVERAGE_15M = EXCLUDED.MIN_LOAD_AVERAGE_15M,
-					MAX_LOAD_AVERAGE_15M = EXCLUDED.MAX_LOAD_AVERAGE_15M,
-					ROW_COUNT = EXCLUDED.ROW_COUNT,
-					INSERTED_AT_UTC = EXCLUDED.INSERTED_AT_UTC
-	`
-
-	_, err := db.Exec(context.Background(), query, deviceID, startTime, endTime)
-	if err != nil {
-		return -1, fmt.Errorf("could not process load average data for device %s: %w", deviceID, err)
-	}
-
-	err = updateProcessingPointer(deviceID, "load_average", nextHour)
-	if err != nil {
-		return -1, fmt.Errorf("could not update processing pointer for device %s and parameter load_average: %w", deviceID, err)
-	}
-
-	return 1, nil
-}
-
-func processCPUUsageData(deviceID string, startTime time.Time) (int, error) {
-	nextHour := startTime.Add(time.Hour)
-	endTime := nextHour.Add(-1 * time.Second)
-
-	query := `
-			INSERT INTO CPU_USAGE_HOURLY (
-					ID_DEVICE,
-					START_TIME,
-					AVG_CPU_USAGE,
-					MIN_CPU_USAGE,
-					MAX_CPU_USAGE,
-					ROW_COUNT,
-					INSERTED_AT_UTC
-			)
-			SELECT 
-					ID_DEVICE,
-					$2 AS START_TIME,
-					AVG(CPU_USAGE) AS AVG_CPU_USAGE,
-					MIN(CPU_USAGE) AS MIN_CPU_USAGE,
-					MAX(CPU_USAGE) AS MAX_CPU_USAGE,
-					COUNT(*) AS ROW_COUNT,
-					CURRENT_TIMESTAMP AS INSERTED_AT_UTC
-			FROM CPU_USAGE
-			WHERE ID_DEVICE = $1 AND COLLECTED_AT_UTC BETWEEN $2 AND $3
-			GROUP BY ID_DEVICE
-			ON CONFLICT (ID_DEVICE, START_TIME)
-			DO UPDATE SET 
-					AVG_CPU_USAGE = EXCLUDED.AVG_CPU_USAGE,
-					MIN_CPU_USAGE = EXCLUDED.MIN_CPU_USAGE,
-					MAX_CPU_USAGE = EXCLUDED.MAX_CPU_USAGE,
-					ROW_COUNT = EXCLUDED.ROW_COUNT,
-					INSERTED_AT_UTC = EXCLUDED.INSERTED_AT_UTC
-	`
-
-	_, err := db.Exec(context.Background(), query, deviceID, startTime, endTime)
-	if err != nil {
-		return -1, fmt.Errorf("could not process CPU usage data for device %s: %w", deviceID, err)
-	}
-
-	err = updateProcessingPointer(deviceID, "cpu_usage", nextHour)
-	if err != nil {
-		return -1, fmt.Errorf("could not update processing pointer for device %s and parameter cpu_usage: %w", deviceID, err)
-	}
-
-	return 1, nil
-}
-
-func processDiskUsageData(deviceID string, startTime time.Time) (int, error) {
-	nextHour := startTime.Add(time.Hour)
-	endTime := nextHour.Add(-1 * time.Second)
-
-	query := `
-			INSERT INTO DISK_USAGE_HOURLY (
-					ID_DEVICE,
-					DISK_NAME,
-					START_TIME,
-					AVG_USED_PERCENT_DISK,
-					MIN_USED_PERCENT_DISK,
-					MAX_USED_PERCENT_DISK,
-					TOTAL_DISK,
-					ROW_COUNT,
-					INSERTED_AT_UTC
-			)
-			SELECT 
-					ID_DEVICE,
-					DISK_NAME,
-					$2 AS START_TIME,
-					AVG(USED_PERCENT_DISK) AS AVG_USED_PERCENT_DISK,
-					MIN(USED_PERCENT_DISK) AS MIN_USED_PERCENT_DISK,
-					MAX(USED_PERCENT_DISK) AS MAX_USED_PERCENT_DISK,
-					MAX(TOTAL_DISK) AS TOTAL_DISK,
-					COUNT(*) AS ROW_COUNT,
-					CURRENT_TIMESTAMP AS INSERTED_AT_UTC
-			FROM DISK_USAGE
-			WHERE ID_DEVICE = $1 AND COLLECTED_AT_UTC BETWEEN $2 AND $3
-			GROUP BY ID_DEVICE, DISK_NAME
-			ON CONFLICT (ID_DEVICE, DISK_NAME, START_TIME)
-			DO UPDATE SET 
-					AVG_USED_PERCENT_DISK = EXCLUDED.AVG_USED_PERCENT_DISK,
-					MIN_USED_PERCENT_DISK = EXCLUDED.MIN_USED_PERCENT_DISK,
-					MAX_USED_PERCENT_DISK = EXCLUDED.MAX_USED_PERCENT_DISK,
-					TOTAL_DISK = EXCLUDED.TOTAL_DISK,
-					ROW_COUNT = EXCLUDED.ROW_COUNT,
-					INSERTED_AT_UTC = EXCLUDED.INSERTED_AT_UTC
-	`
-
-	_, err := db.Exec(context.Background(), query, deviceID, startTime, endTime)
-	if err != nil {
-		return -1, fmt.Errorf("could not process disk usage data for device %s: %w", deviceID, err)
+	keys := []string{"ID_DEVICE"}
+	if parameter.Dimension != nil {
+		keys = append(keys, parameter.Dimension.Column)
+	}
+
+	columns := []string{}
+	selects := []string{}
+	for _, field := range parameter.Fields {
+		switch field.Aggregate {
+		case parameters.AggregateStats:
+			for _, function := range []string{"AVG", "MIN", "MAX"} {
+				column := function + "_" + field.Column
+				columns = append(columns, column)
+				selects = append(selects, fmt.Sprintf("%s(%s) AS %s", function, field.Column, column))
+			}
+		case parameters.AggregateMax:
+			columns = append(columns, field.Column)
+			selects = append(selects, fmt.Sprintf("MAX(%s) AS %s", field.Column, field.Column))
+		}
 	}
+	columns = append(columns, "ROW_COUNT", "INSERTED_AT_UTC")
+	selects = append(selects, "COUNT(*) AS ROW_COUNT", "CURRENT_TIMESTAMP AS INSERTED_AT_UTC")
 
-	err = updateProcessingPointer(deviceID, "disk", nextHour)
-	if err != nil {
-		return -1, fmt.Errorf("could not update processing pointer for device %s and parameter disk_usage: %w", deviceID, err)
+	updates := make([]string, len(columns))
+	for i, column := range columns {
+		updates[i] = fmt.Sprintf("%s = EXCLUDED.%s", column, column)
 	}
 
-	return 1, nil
-}
-
-func processRAMUsageData(deviceID string, startTime time.Time) (int, error) {
-	nextHour := startTime.Add(time.Hour)
-	endTime := nextHour.Add(-1 * time.Second)
-
-	query := `
-			INSERT INTO RAM_USAGE_HOURLY (
-					ID_DEVICE,
-					START_TIME,
-					AVG_USED_PERCENT_RAM,
-					MIN_USED_PERCENT_RAM,
-					MAX_USED_PERCENT_RAM,
-					TOTAL_RAM,
-					ROW_COUNT,
-					INSERTED_AT_UTC
-			)
-			SELECT 
-					ID_DEVICE,
-					$2 AS START_TIME,
-					AVG(USED_PERCENT_RAM) AS AVG_USED_PERCENT_RAM,
-					MIN(USED_PERCENT_RAM) AS MIN_USED_PERCENT_RAM,
-					MAX(USED_PERCENT_RAM) AS MAX_USED_PERCENT_RAM,
-					MAX(TOTAL_RAM) AS TOTAL_RAM,
-					COUNT(*) AS ROW_COUNT,
-					CURRENT_TIMESTAMP AS INSERTED_AT_UTC
-			FROM RAM_USAGE
+	query := fmt.Sprintf(`
+			INSERT INTO %s (%s, START_TIME, %s)
+			SELECT %s, $2 AS START_TIME, %s
+			FROM %s
 			WHERE ID_DEVICE = $1 AND COLLECTED_AT_UTC BETWEEN $2 AND $3
-			GROUP BY ID_DEVICE
-			ON CONFLICT (ID_DEVICE, START_TIME)
-			DO UPDATE SET 
-					AVG_USED_PERCENT_RAM = EXCLUDED.AVG_USED_PERCENT_RAM,
-					MIN_USED_PERCENT_RAM = EXCLUDED.MIN_USED_PERCENT_RAM,
-					MAX_USED_PERCENT_RAM = EXCLUDED.MAX_USED_PERCENT_RAM,
-					TOTAL_RAM = EXCLUDED.TOTAL_RAM,
-					ROW_COUNT = EXCLUDED.ROW_COUNT,
-					INSERTED_AT_UTC = EXCLUDED.INSERTED_AT_UTC
-	`
+			GROUP BY %s
+			ON CONFLICT (%s, START_TIME)
+			DO UPDATE SET %s
+	`,
+		parameter.HourlyTable, strings.Join(keys, ", "), strings.Join(columns, ", "),
+		strings.Join(keys, ", "), strings.Join(selects, ", "),
+		parameter.Table,
+		strings.Join(keys, ", "),
+		strings.Join(keys, ", "),
+		strings.Join(updates, ", "))
 
 	_, err := db.Exec(context.Background(), query, deviceID, startTime, endTime)
 	if err != nil {
-		return -1, fmt.Errorf("could not process RAM usage data for device %s: %w", deviceID, err)
+		return -1, fmt.Errorf("could not process %s data for device %s: %w", parameter.ID, deviceID, err)
 	}
 
-	err = updateProcessingPointer(deviceID, "ram", nextHour)
+	err = updateProcessingPointer(deviceID, parameter.ID, nextHour)
 	if err != nil {
-		return -1, fmt.Errorf("could not update processing pointer for device %s and parameter ram_usage: %w", deviceID, err)
+		return -1, fmt.Errorf("could not update processing pointer for device %s and parameter %s: %w", deviceID, parameter.ID, err)
 	}
 
 	return 1, nil
@@ -445,15 +230,3 @@ func updateProcessingPointer(deviceID, param string, nextHour time.Time) error {
 	`, deviceID, param, nextHour)
 	return err
 }
-
-type ProcessFunc func(deviceID string, startTime time.Time) (int, error)
-
-func getProcessFunctions() map[string]ProcessFunc {
-	return map[string]ProcessFunc{
-		"cpu_temp":     processCPUTempData,
-		"load_average": processLoadAverageData,
-		"disk":         processDiskUsageData,
-		"ram":          processRAMUsageData,
-		"cpu_usage":    processCPUUsageData,
-	}
-}
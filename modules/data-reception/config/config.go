@@ -4,23 +4,115 @@ import (
 	"fmt"
 	"net/url"
 	"os"
+	"time"
 
 	"ceiot-tf-background/modules/data-reception/models"
+	"ceiot-tf-background/modules/utils/deadletter"
+	"ceiot-tf-background/modules/utils/env"
+	"ceiot-tf-background/modules/utils/kafka"
+	"ceiot-tf-background/modules/utils/mqtt"
 )
 
 func LoadEnvVars() (*models.Config, error) {
+	serviceName := "data-reception"
+
+	kafkaClientID := "background-data-reception-kafka-client"
 	kafkaBroker := os.Getenv("KAFKA_BROKER")
 	kafkaBrokers := []string{kafkaBroker}
-	kafkaTopics := []string{"device-data-events"}
+	kafkaSecurity, err := kafka.SecurityFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	kafkaTopics := []string{env.GetString("KAFKA_TOPIC_DEVICE_DATA_EVENTS", "device-data-events")}
+	// Readings come from MQTT, so dead letters go to the topic of the service.
+	kafkaDeadLetterTopic := deadletter.TopicFor(serviceName)
+	kafkaTopicSpecs, err := kafka.TopicSpecsFromEnv(kafkaTopics[0], kafkaDeadLetterTopic)
+	if err != nil {
+		return nil, err
+	}
+	kafkaProducerAcks, err := kafka.ParseAcks(env.GetString("KAFKA_PRODUCER_ACKS", "all"))
+	if err != nil {
+		return nil, err
+	}
+	kafkaProducerIdempotent, err := env.GetBool("KAFKA_PRODUCER_IDEMPOTENT", true)
+	if err != nil {
+		return nil, err
+	}
+	kafkaProducerMaxAttempts, err := env.GetInt("KAFKA_PRODUCER_MAX_ATTEMPTS", 5)
+	if err != nil {
+		return nil, err
+	}
+	kafkaProducerInitialBackoff, err := env.GetDuration("KAFKA_PRODUCER_INITIAL_BACKOFF", 100*time.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+	kafkaProducerMaxBackoff, err := env.GetDuration("KAFKA_PRODUCER_MAX_BACKOFF", 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	kafkaProducerAsync, err := env.GetBool("KAFKA_PRODUCER_ASYNC", true)
+	if err != nil {
+		return nil, err
+	}
+	kafkaProducerBatchSize, err := env.GetInt("KAFKA_PRODUCER_BATCH_SIZE", 100)
+	if err != nil {
+		return nil, err
+	}
+	kafkaProducerLinger, err := env.GetDuration("KAFKA_PRODUCER_LINGER", 50*time.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+	kafkaProducerQueueSize, err := env.GetInt("KAFKA_PRODUCER_QUEUE_SIZE", 1000)
+	if err != nil {
+		return nil, err
+	}
+	kafkaProducerCompression, err := kafka.ParseCompression(env.GetString("KAFKA_PRODUCER_COMPRESSION", "lz4"))
+	if err != nil {
+		return nil, err
+	}
 
 	mqttClientID := "background-data-reception-mqtt-client"
 	mqttProtocol := os.Getenv("MQTT_PROTOCOL")
 	mqttHost := os.Getenv("MQTT_HOST")
 	mqttPort := os.Getenv("MQTT_PORT")
-	mqttBroker := fmt.Sprintf("%s://%s:%s", mqttProtocol, mqttHost, mqttPort)
+	mqttBroker := mqtt.BrokerURL(mqttProtocol, mqttHost, mqttPort)
+	mqttTLS, err := mqtt.TLSFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	mqttProtocolVersion, err := mqtt.ParseProtocolVersion(os.Getenv("MQTT_PROTOCOL_VERSION"))
+	if err != nil {
+		return nil, err
+	}
+	mqttSession, err := mqtt.SessionFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	// Replicas share the data subscription, the broker delivers each message
+	// to only one of them, and each replica needs its own client ID.
+	mqttStatusTopic := "server/status/" + serviceName
+	mqttSharedGroup := os.Getenv("MQTT_SHARED_SUBSCRIPTION_GROUP")
+	if mqttSharedGroup != "" || os.Getenv("MQTT_REPLICA_ID") != "" {
+		mqttClientID, err = mqtt.ReplicaClientID(mqttClientID)
+		if err != nil {
+			return nil, err
+		}
+		// A shared retained status would flip to offline when any replica stops.
+		mqttStatusTopic += "/" + mqttClientID
+	}
+
+	mqttSubDataTopic := mqtt.SharedTopic(mqttSharedGroup, "devices/+/data")
+	// Devices on metered links pick a compact format with a topic suffix, such as devices/<id>/data/msgpack.
+	mqttSubFormatDataTopic := mqtt.SharedTopic(mqttSharedGroup, "devices/+/data/+")
+	// Batches carry several readings of one device and accept the same format suffixes.
+	mqttSubBatchTopic := mqtt.SharedTopic(mqttSharedGroup, "devices/+/batch")
+	mqttSubFormatBatchTopic := mqtt.SharedTopic(mqttSharedGroup, "devices/+/batch/+")
+	mqttSubTopics := []string{mqttSubDataTopic, mqttSubFormatDataTopic, mqttSubBatchTopic, mqttSubFormatBatchTopic}
+	mqttSubQoS := mqtt.AtLeastOnce
 
-	mqttSubDataTopic := "devices/+/data"
-	mqttSubTopics := []string{mqttSubDataTopic}
+	mqttPubBatchResultTopicTemp := "server/batch/___DEVICE___"
+	mqttPubBatchResultQoS := mqtt.AtLeastOnce
 
 	postgresUser := os.Getenv("POSTGRES_USER")
 	postgresPassword := os.Getenv("POSTGRES_PASSWORD")
@@ -29,14 +121,85 @@ func LoadEnvVars() (*models.Config, error) {
 	postgresDB := os.Getenv("POSTGRES_DB")
 	encodedPostgresPassword := url.QueryEscape(postgresPassword)
 	postgresURL := fmt.Sprintf("postgres://%s:%s@%s:%s/%s", postgresUser, encodedPostgresPassword, postgresHost, postgresPort, postgresDB)
+	postgresBatchSize, err := env.GetInt("POSTGRES_BATCH_SIZE", 500)
+	if err != nil {
+		return nil, err
+	}
+	postgresBatchLinger, err := env.GetDuration("POSTGRES_BATCH_LINGER", 100*time.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+	postgresBatchQueueSize, err := env.GetInt("POSTGRES_BATCH_QUEUE_SIZE", 5000)
+	if err != nil {
+		return nil, err
+	}
+
+	outboxRelayInterval, err := env.GetDuration("OUTBOX_RELAY_INTERVAL", 1*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	outboxBatchSize, err := env.GetInt("OUTBOX_BATCH_SIZE", 500)
+	if err != nil {
+		return nil, err
+	}
+	outboxRetention, err := env.GetDuration("OUTBOX_RETENTION", 24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+
+	deviceRefreshInterval, err := env.GetDuration("DEVICE_CACHE_REFRESH_INTERVAL", 1*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	deviceMissTTL, err := env.GetDuration("DEVICE_CACHE_MISS_TTL", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	metricsAddr := env.GetString("METRICS_ADDR", ":4001")
 
 	config := &models.Config{
-		KafkaBrokers:  kafkaBrokers,
-		KafkaTopics:   kafkaTopics,
-		MQTTClientID:  mqttClientID,
-		MQTTBroker:    mqttBroker,
-		MQTTSubTopics: mqttSubTopics,
-		PostgresURL:   postgresURL,
+		ServiceName:                 serviceName,
+		KafkaClientID:               kafkaClientID,
+		KafkaBrokers:                kafkaBrokers,
+		KafkaSecurity:               kafkaSecurity,
+		KafkaTopics:                 kafkaTopics,
+		KafkaDeadLetterTopic:        kafkaDeadLetterTopic,
+		KafkaTopicSpecs:             kafkaTopicSpecs,
+		MQTTClientID:                mqttClientID,
+		MQTTTLS:                     mqttTLS,
+		MQTTProtocolVersion:         mqttProtocolVersion,
+		MQTTSession:                 mqttSession,
+		MQTTStatusTopic:             mqttStatusTopic,
+		MQTTBroker:                  mqttBroker,
+		MQTTSubTopics:               mqttSubTopics,
+		MQTTSubQoS:                  mqttSubQoS,
+		MQTTPubBatchResultTopicTemp: mqttPubBatchResultTopicTemp,
+		MQTTPubBatchResultQoS:       mqttPubBatchResultQoS,
+		PostgresURL:                 postgresURL,
+		PostgresBatchSize:           postgresBatchSize,
+		PostgresBatchLinger:         postgresBatchLinger,
+		PostgresBatchQueueSize:      postgresBatchQueueSize,
+		OutboxRelayInterval:         outboxRelayInterval,
+		OutboxBatchSize:             outboxBatchSize,
+		OutboxRetention:             outboxRetention,
+		DeviceRefreshInterval:       deviceRefreshInterval,
+		DeviceMissTTL:               deviceMissTTL,
+		MetricsAddr:                 metricsAddr,
+		KafkaProducer: kafka.ProducerOptions{
+			RequiredAcks: kafkaProducerAcks,
+			Idempotent:   kafkaProducerIdempotent,
+			Retry: kafka.RetryOptions{
+				MaxAttempts:    kafkaProducerMaxAttempts,
+				InitialBackoff: kafkaProducerInitialBackoff,
+				MaxBackoff:     kafkaProducerMaxBackoff,
+			},
+			Compression: kafkaProducerCompression,
+			Async:       kafkaProducerAsync,
+			BatchSize:   kafkaProducerBatchSize,
+			Linger:      kafkaProducerLinger,
+			QueueSize:   kafkaProducerQueueSize,
+		},
 	}
 
 	return config, nil
@@ -0,0 +1,205 @@
+// Package devices keeps the allow-list of devices that data-reception
+// accepts readings from.
+package devices
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+type Status int
+
+const (
+	StatusActive Status = iota
+	StatusInactive
+	StatusUnknown
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusActive:
+		return "active"
+	case StatusInactive:
+		return "inactive"
+	}
+	return "unknown"
+}
+
+type Options struct {
+	// LoadActive returns the IDs of every active device.
+	LoadActive func(ctx context.Context) ([]string, error)
+	// Lookup reports whether a single device exists and whether it is active.
+	Lookup func(ctx context.Context, deviceID string) (exists bool, active bool, err error)
+	// RefreshInterval is how often the whole list is reloaded, devices that
+	// are deactivated stop being accepted after at most this long.
+	RefreshInterval time.Duration
+	// MissTTL is how long a device that is not active is remembered before
+	// it is looked up again.
+	MissTTL time.Duration
+}
+
+type miss struct {
+	status    Status
+	checkedAt time.Time
+}
+
+// Cache answers whether a device is active without a query per message. A
+// device missing from the cache is looked up once, so a device registered
+// after the last refresh is accepted as soon as it reports.
+type Cache struct {
+	opts Options
+
+	mu          sync.RWMutex
+	active      map[string]bool
+	misses      map[string]miss
+	refreshErr  error
+	refreshedAt time.Time
+
+	started bool
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func NewCache(opts Options) *Cache {
+	if opts.RefreshInterval <= 0 {
+		opts.RefreshInterval = time.Minute
+	}
+	if opts.MissTTL <= 0 {
+		opts.MissTTL = 30 * time.Second
+	}
+	return &Cache{
+		opts:   opts,
+		active: map[string]bool{},
+		misses: map[string]miss{},
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// Start loads the active devices and keeps refreshing them in the background
+// until Close. It fails when the first load fails.
+func (c *Cache) Start(ctx context.Context) error {
+	if err := c.Refresh(ctx); err != nil {
+		return err
+	}
+	c.started = true
+	go c.refreshPeriodically()
+	return nil
+}
+
+func (c *Cache) refreshPeriodically() {
+	defer close(c.done)
+
+	ticker := time.NewTicker(c.opts.RefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), c.opts.RefreshInterval)
+			if err := c.Refresh(ctx); err != nil {
+				log.Printf("Error refreshing active devices, keeping the previous list: %v", err)
+			}
+			cancel()
+		}
+	}
+}
+
+// Refresh reloads the active devices and forgets every cached miss.
+func (c *Cache) Refresh(ctx context.Context) error {
+	ids, err := c.opts.LoadActive(ctx)
+	if err != nil {
+		c.mu.Lock()
+		c.refreshErr = err
+		c.mu.Unlock()
+		return fmt.Errorf("failed to load active devices: %w", err)
+	}
+
+	active := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		active[id] = true
+	}
+
+	c.mu.Lock()
+	c.active = active
+	c.misses = map[string]miss{}
+	c.refreshErr = nil
+	c.refreshedAt = time.Now()
+	c.mu.Unlock()
+
+	log.Printf("Loaded %d active device(s)\n", len(active))
+	return nil
+}
+
+// Check returns the status of deviceID, looking it up when it is not cached.
+func (c *Cache) Check(ctx context.Context, deviceID string) (Status, error) {
+	c.mu.RLock()
+	active := c.active[deviceID]
+	cached, missed := c.misses[deviceID]
+	c.mu.RUnlock()
+
+	if active {
+		return StatusActive, nil
+	}
+	if missed && time.Since(cached.checkedAt) < c.opts.MissTTL {
+		return cached.status, nil
+	}
+
+	exists, isActive, err := c.opts.Lookup(ctx, deviceID)
+	if err != nil {
+		return StatusUnknown, fmt.Errorf("failed to look up device %s: %w", deviceID, err)
+	}
+
+	status := StatusUnknown
+	switch {
+	case isActive:
+		status = StatusActive
+	case exists:
+		status = StatusInactive
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if status == StatusActive {
+		c.active[deviceID] = true
+		delete(c.misses, deviceID)
+	} else {
+		c.misses[deviceID] = miss{status: status, checkedAt: time.Now()}
+	}
+	return status, nil
+}
+
+// Size returns the number of devices currently known to be active.
+func (c *Cache) Size() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.active)
+}
+
+// Health fails while the last refresh failed, the cache then still answers
+// from the list loaded before.
+func (c *Cache) Health() error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.refreshErr != nil {
+		return fmt.Errorf("last refresh failed, list from %s: %w", c.refreshedAt.UTC().Format(time.RFC3339), c.refreshErr)
+	}
+	return nil
+}
+
+func (c *Cache) Close() {
+	select {
+	case <-c.stop:
+		return
+	default:
+	}
+	close(c.stop)
+	if c.started {
+		<-c.done
+	}
+}
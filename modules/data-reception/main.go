@@ -2,27 +2,65 @@ package main
 
 import (
 	"ceiot-tf-background/modules/data-reception/config"
+	"ceiot-tf-background/modules/data-reception/devices"
 	"ceiot-tf-background/modules/data-reception/models"
+	"ceiot-tf-background/modules/data-reception/outbox"
+	"ceiot-tf-background/modules/data-reception/payload"
 	"ceiot-tf-background/modules/data-reception/postgres"
+	"ceiot-tf-background/modules/utils/deadletter"
+	"ceiot-tf-background/modules/utils/events"
 	"ceiot-tf-background/modules/utils/kafka"
+	"ceiot-tf-background/modules/utils/metrics"
 	"ceiot-tf-background/modules/utils/mqtt"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 var (
-	err error
-	cfg *models.Config
+	err           error
+	cfg           *models.Config
+	kafkaProducer *kafka.Producer
+	deadLetters   *deadletter.Queue
+	mqttClient    *mqtt.Client
+	dbWriter      *postgres.Writer
+	outboxRelay   *outbox.Relay
+	deviceCache   *devices.Cache
+	metricsServer *http.Server
+	rejected      *metrics.Counter
+)
+
+// Reasons a message is rejected for, as reported by the rejected messages counter.
+const (
+	reasonMalformed         = "malformed"
+	reasonUnsupportedFormat = "unsupported_format"
+	reasonBatchTooLarge     = "batch_too_large"
+	reasonEmptyPayload      = "empty_payload"
+	reasonInvalidPayload    = "invalid_payload"
+	reasonUnknownParameter  = "unknown_parameter"
+	reasonTopicMismatch     = "topic_mismatch"
+	reasonUnknownDevice     = "unknown_device"
+	reasonInactiveDevice    = "inactive_device"
+	reasonLookupFailed      = "lookup_failed"
 )
 
 func main() {
 	loadConfiguration()
-	startMQTTClient()
-	startKafkaClient()
 	initializeDatabase()
-	defer postgres.CloseDB()
-	select {}
+	startDeviceCache()
+	startKafkaClient()
+	startMetricsServer()
+	startMQTTClient()
+	waitForShutdown()
 }
 
 func loadConfiguration() {
@@ -33,11 +71,57 @@ func loadConfiguration() {
 }
 
 func startMQTTClient() {
-	go mqtt.ConnectClient(cfg.MQTTBroker, cfg.MQTTClientID, cfg.MQTTSubTopics, mqttHandleMessage)
+	subscriptions := make([]mqtt.Subscription, len(cfg.MQTTSubTopics))
+	for i, topic := range cfg.MQTTSubTopics {
+		subscriptions[i] = mqtt.Subscription{Topic: topic, QoS: cfg.MQTTSubQoS, Handler: mqttHandleMessage}
+	}
+
+	mqttClient, err = mqtt.NewClient(mqtt.ClientOptions{
+		Broker:          cfg.MQTTBroker,
+		ProtocolVersion: cfg.MQTTProtocolVersion,
+		Session:         cfg.MQTTSession,
+		Status:          mqtt.ServiceStatus(cfg.MQTTStatusTopic, cfg.ServiceName, cfg.MQTTClientID),
+		ClientID:        cfg.MQTTClientID,
+		Subscriptions:   subscriptions,
+		TLS:             cfg.MQTTTLS,
+	})
+	if err != nil {
+		log.Fatalf("Failed to create MQTT client: %v", err)
+	}
+	mqttClient.Connect()
 }
 
 func startKafkaClient() {
-	go kafka.InitializeWriter(cfg.KafkaBrokers)
+	kafkaClient, err := kafka.NewClient(kafka.ClientOptions{
+		Brokers:  cfg.KafkaBrokers,
+		ClientID: cfg.KafkaClientID,
+		Security: cfg.KafkaSecurity,
+	})
+	if err != nil {
+		log.Fatalf("Failed to create Kafka client: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := kafkaClient.EnsureTopics(ctx, cfg.KafkaTopicSpecs...); err != nil {
+		log.Fatalf("Failed to prepare Kafka topics: %v", err)
+	}
+
+	kafkaProducer = kafkaClient.NewProducer(cfg.KafkaProducer)
+	deadLetters = deadletter.New(deadletter.Options{
+		Service:  cfg.ServiceName,
+		Topic:    cfg.KafkaDeadLetterTopic,
+		Producer: kafkaProducer,
+		Fallback: postgres.DeadLetterStore(),
+	})
+
+	outboxRelay = outbox.NewRelay(outbox.Options{
+		Relay:     relayOutbox,
+		Cleanup:   postgres.DeleteSentOutbox,
+		Interval:  cfg.OutboxRelayInterval,
+		BatchSize: cfg.OutboxBatchSize,
+		Retention: cfg.OutboxRetention,
+	})
 }
 
 func initializeDatabase() {
@@ -45,31 +129,476 @@ func initializeDatabase() {
 	if err != nil {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := postgres.EnsureNaturalKeys(ctx); err != nil {
+		log.Printf("Duplicate readings will not be detected, run ceiot-admin readings dedupe: %v", err)
+	}
+	if err := postgres.EnsureDeadLetterTable(ctx); err != nil {
+		log.Fatalf("Failed to prepare dead letters: %v", err)
+	}
+	if err := postgres.EnsureQuarantineTable(ctx); err != nil {
+		log.Fatalf("Failed to prepare quarantine: %v", err)
+	}
+	if err := postgres.EnsureOutboxTable(ctx); err != nil {
+		log.Fatalf("Failed to prepare outbox: %v", err)
+	}
+
+	dbWriter = postgres.NewWriter(postgres.WriterOptions{
+		BatchSize: cfg.PostgresBatchSize,
+		Linger:    cfg.PostgresBatchLinger,
+		QueueSize: cfg.PostgresBatchQueueSize,
+	})
+}
+
+func startDeviceCache() {
+	deviceCache = devices.NewCache(devices.Options{
+		LoadActive:      postgres.GetActiveDevices,
+		Lookup:          postgres.GetDevice,
+		RefreshInterval: cfg.DeviceRefreshInterval,
+		MissTTL:         cfg.DeviceMissTTL,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := deviceCache.Start(ctx); err != nil {
+		log.Fatalf("Failed to load devices: %v", err)
+	}
+}
+
+func startMetricsServer() {
+	metricsRegistry := metrics.NewRegistry()
+	rejected = metricsRegistry.Counter("data_reception_rejected_messages_total", "Messages that were not stored, by reason.", "reason")
+	activeDevices := metricsRegistry.Gauge("data_reception_active_devices", "Devices allowed to report readings.")
+	metricsRegistry.OnCollect(func() {
+		activeDevices.Set(float64(deviceCache.Size()))
+	})
+
+	metricsServer = metrics.Serve(cfg.MetricsAddr, metricsRegistry, map[string]metrics.HealthCheck{
+		"device-cache": deviceCache.Health,
+		"outbox-relay": outboxRelay.Health,
+	})
+}
+
+func waitForShutdown() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+	log.Println("Shutting down")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := metricsServer.Shutdown(ctx); err != nil {
+		log.Printf("Error stopping metrics server: %v", err)
+	}
+	mqttClient.Disconnect(250 * time.Millisecond)
+	deviceCache.Close()
+	// Queued readings add their events to the outbox when stored, so the
+	// writer drains before the relay's last pass and the producer closes.
+	if err := dbWriter.Close(ctx); err != nil {
+		log.Printf("Error closing PostgreSQL writer: %v", err)
+	}
+	if err := outboxRelay.Close(ctx); err != nil {
+		log.Printf("Error closing outbox relay: %v", err)
+	}
+	if err := kafkaProducer.Close(ctx); err != nil {
+		log.Printf("Error closing Kafka producer: %v", err)
+	}
+	postgres.CloseDB()
+}
+
+func mqttHandleMessage(msg mqtt.Message) {
+	topic, message := msg.Topic, msg.Payload
+	topicDevice, kind, format, ok := parseDeviceTopic(topic)
+	if !ok {
+		return
+	}
+	receivedAt := time.Now().UTC()
+	if kind == topicBatch {
+		handleBatch(topic, topicDevice, format, message, receivedAt)
+		return
+	}
+
+	dataPayload, err := payload.Parse(format, message)
+	if err != nil {
+		log.Printf("Error parsing data from %s: %v", topic, err)
+		rejected.Inc(rejectionReason(err))
+		sendToDeadLetters(deadletter.TransportMQTT, topic, message, err)
+		return
+	}
+	if !authorize(topic, topicDevice, dataPayload.IDDevice, message, receivedAt) {
+		return
+	}
+	reading, err := payload.Decode(dataPayload)
+	if err != nil {
+		log.Printf("Error validating data from %s: %v", topic, err)
+		rejected.Inc(rejectionReason(err))
+		sendToDeadLetters(deadletter.TransportMQTT, topic, message, err)
+		return
+	}
+
+	event, err := buildDataEvent(topic, dataPayload, receivedAt)
+	if err != nil {
+		log.Printf("Error building data event: %v", err)
+		sendToDeadLetters(deadletter.TransportMQTT, topic, message, err)
+		return
+	}
+
+	// The event is committed to the outbox with the reading, the relay publishes it.
+	onInserted := func(err error) {
+		if errors.Is(err, postgres.ErrDuplicateReading) {
+			// Already stored and published, a retransmission must not raise alerts again.
+			log.Printf("Duplicate %s reading from device %s collected at %s skipped", dataPayload.Parameter, dataPayload.IDDevice, dataPayload.CollectedAtUtc)
+			return
+		}
+		if err != nil {
+			log.Printf("Error inserting data: %v", err)
+			if isUnprocessable(err) {
+				rejected.Inc(rejectionReason(err))
+			}
+			// The message is already acknowledged, so a reading that failed to
+			// store for any reason is kept in the dead letters for replay.
+			sendToDeadLetters(deadletter.TransportMQTT, topic, message, err)
+			return
+		}
+		outboxRelay.Notify()
+	}
+
+	if err := dbWriter.InsertDataAsync(context.Background(), reading, event, onInserted); err != nil {
+		onInserted(err)
+	}
+}
+
+// handleBatch stores the readings of a batch message in one transaction and
+// reports the outcome of each one back to the device. Readings that fail
+// validation are rejected on their own, the rest are still stored.
+func handleBatch(topic string, topicDevice string, format string, message []byte, receivedAt time.Time) {
+	batch, err := payload.ParseBatch(format, message)
+	if err != nil {
+		log.Printf("Error parsing batch from %s: %v", topic, err)
+		rejected.Inc(rejectionReason(err))
+		sendToDeadLetters(deadletter.TransportMQTT, topic, message, err)
+		return
+	}
+	if !authorize(topic, topicDevice, batch.IDDevice, message, receivedAt) {
+		return
+	}
+
+	decoded, errs := payload.DecodeBatch(batch)
+	readings := []models.Reading{}
+	batchEvents := []kafka.Message{}
+	indexes := []int{}
+	for i, reading := range decoded {
+		if errs[i] != nil {
+			continue
+		}
+		// Every reading is announced with its own event, as if it came alone.
+		event, err := buildDataEvent(topic, reading.DataPayload, receivedAt)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		readings = append(readings, reading)
+		batchEvents = append(batchEvents, event)
+		indexes = append(indexes, i)
+	}
+
+	rejectedCount := 0
+	var firstErr error
+	for _, err := range errs {
+		if err != nil {
+			rejected.Inc(rejectionReason(err))
+			rejectedCount++
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	if rejectedCount > 0 {
+		log.Printf("Rejected %d of %d reading(s) of batch from %s: %v", rejectedCount, len(errs), topic, firstErr)
+	}
+
+	if len(readings) == 0 {
+		sendFailedReadings(topicDevice, batch, errs)
+		publishBatchResult(batch, errs)
+		return
+	}
+
+	onInserted := func(insertErrs []error) {
+		stored := false
+		for i, err := range insertErrs {
+			errs[indexes[i]] = err
+			stored = stored || err == nil
+		}
+		if stored {
+			outboxRelay.Notify()
+		}
+		sendFailedReadings(topicDevice, batch, errs)
+		publishBatchResult(batch, errs)
+	}
+
+	if err := dbWriter.InsertBatchAsync(context.Background(), readings, batchEvents, onInserted); err != nil {
+		log.Printf("Error inserting batch from %s: %v", topic, err)
+		insertErrs := make([]error, len(readings))
+		for i := range insertErrs {
+			insertErrs[i] = err
+		}
+		onInserted(insertErrs)
+	}
 }
 
-func mqttHandleMessage(topic string, message []byte) {
-	if !strings.HasPrefix(topic, "devices/") || !strings.HasSuffix(topic, "/data") {
+// sendFailedReadings sends the readings of batch that were rejected or failed
+// to store to dead letters, as a JSON batch of their own on the device's batch
+// topic, so a replay retries only those readings.
+func sendFailedReadings(deviceID string, batch models.BatchPayload, errs []error) {
+	failed := models.BatchPayload{BatchID: batch.BatchID, IDDevice: batch.IDDevice}
+	var firstErr error
+	for i, err := range errs {
+		if err == nil || errors.Is(err, postgres.ErrDuplicateReading) {
+			continue
+		}
+		failed.Readings = append(failed.Readings, batch.Readings[i])
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if len(failed.Readings) == 0 {
 		return
 	}
-	dataPayload, err := parseMqttMessage(message)
+
+	topic := "devices/" + deviceID + "/" + topicBatch
+	message, err := json.Marshal(failed)
 	if err != nil {
+		log.Printf("Error encoding failed readings of batch %q: %v", batch.BatchID, err)
 		return
 	}
+	sendToDeadLetters(deadletter.TransportMQTT, topic, message, fmt.Errorf("%d of %d reading(s) failed: %w", len(failed.Readings), len(errs), firstErr))
+}
+
+// publishBatchResult tells the device the outcome of every reading of its batch.
+func publishBatchResult(batch models.BatchPayload, errs []error) {
+	result := models.BatchResult{BatchID: batch.BatchID, Results: make([]models.ReadingResult, len(errs))}
+	counts := map[string]int{}
+	for i, err := range errs {
+		status := models.ResultStored
+		switch {
+		case err == nil:
+		case errors.Is(err, postgres.ErrDuplicateReading):
+			status = models.ResultDuplicate
+		case isUnprocessable(err):
+			status = models.ResultRejected
+		default:
+			status = models.ResultFailed
+		}
+		result.Results[i] = models.ReadingResult{Index: i, Status: status}
+		if status == models.ResultRejected || status == models.ResultFailed {
+			result.Results[i].Error = err.Error()
+		}
+		counts[status]++
+	}
+	log.Printf("Batch %q of device %s: %d stored, %d duplicate(s), %d rejected, %d failed",
+		batch.BatchID, batch.IDDevice, counts[models.ResultStored], counts[models.ResultDuplicate], counts[models.ResultRejected], counts[models.ResultFailed])
 
-	err = postgres.InsertData(dataPayload)
+	body, err := json.Marshal(result)
 	if err != nil {
-		log.Printf("Error inserting data: %v", err)
+		log.Printf("Error encoding batch result: %v", err)
 		return
 	}
+	topic := strings.Replace(cfg.MQTTPubBatchResultTopicTemp, "___DEVICE___", batch.IDDevice, 1)
+	if err := mqttClient.Publish(topic, cfg.MQTTPubBatchResultQoS, false, body); err != nil {
+		log.Printf("Error publishing batch result to %s: %v", topic, err)
+	}
+}
+
+// Kinds of device topics data-reception handles.
+const (
+	topicData  = "data"
+	topicBatch = "batch"
+)
+
+// parseDeviceTopic returns the device, kind and payload format of a
+// devices/<device>/<kind> or devices/<device>/<kind>/<format> topic.
+func parseDeviceTopic(topic string) (string, string, string, bool) {
+	segments := strings.Split(topic, "/")
+	if len(segments) < 3 || len(segments) > 4 || segments[0] != "devices" {
+		return "", "", "", false
+	}
+	if segments[2] != topicData && segments[2] != topicBatch {
+		return "", "", "", false
+	}
+	if len(segments) == 3 {
+		return segments[1], segments[2], payload.FormatJSON, true
+	}
+	return segments[1], segments[2], segments[3], true
+}
+
+// authorize checks that a message comes from an active device publishing on
+// its own topic. Messages that do not are quarantined, they are kept for
+// inspection but never stored as readings.
+func authorize(topic string, topicDevice string, deviceID string, message []byte, receivedAt time.Time) bool {
+	ctx := context.Background()
+	if deviceID != topicDevice {
+		log.Printf("Device %s published data of device %s on %s", topicDevice, deviceID, topic)
+		quarantine(reasonTopicMismatch, topic, deviceID, message, receivedAt)
+		return false
+	}
+
+	status, err := deviceCache.Check(ctx, deviceID)
+	if err != nil {
+		// Without an answer the message is parked, it can be replayed once the database is back.
+		log.Printf("Error authorizing data from %s: %v", topic, err)
+		rejected.Inc(reasonLookupFailed)
+		sendToDeadLetters(deadletter.TransportMQTT, topic, message, err)
+		return false
+	}
+
+	switch status {
+	case devices.StatusActive:
+		return true
+	case devices.StatusInactive:
+		quarantine(reasonInactiveDevice, topic, deviceID, message, receivedAt)
+	default:
+		quarantine(reasonUnknownDevice, topic, deviceID, message, receivedAt)
+	}
+	return false
+}
+
+func quarantine(reason string, topic string, deviceID string, message []byte, receivedAt time.Time) {
+	rejected.Inc(reason)
+	err := postgres.InsertQuarantined(context.Background(), models.QuarantinedMessage{
+		Reason:        reason,
+		DeviceID:      deviceID,
+		SourceTopic:   topic,
+		Payload:       message,
+		ReceivedAtUtc: receivedAt,
+	})
+	if err != nil {
+		log.Printf("Error quarantining message from %s: %v", topic, err)
+	}
+}
+
+func buildDataEvent(sourceTopic string, dataPayload models.DataPayload, receivedAt time.Time) (kafka.Message, error) {
+	msg, err := events.Encode(cfg.KafkaTopics[0], events.Metadata{
+		DeviceID:      dataPayload.IDDevice,
+		SourceTopic:   sourceTopic,
+		ReceivedAtUtc: receivedAt,
+	}, dataPayload)
+	if err != nil {
+		return kafka.Message{}, err
+	}
+	// Keying by device keeps each device's readings in order for consumers.
+	msg.Key = []byte(dataPayload.IDDevice)
+	return msg, nil
+}
 
-	kafka.PublishData(cfg.KafkaTopics[0], nil, message)
+// relayOutbox publishes pending outbox events, through the async queue when
+// the producer batches in the background and in one batch otherwise. The
+// message ID is taken from the outbox row, so an event sent again after a
+// failed pass keeps its ID and threshold-validator does not alert on it twice.
+func relayOutbox(ctx context.Context, limit int) (int, error) {
+	return postgres.RelayOutbox(ctx, limit, func(ctx context.Context, pending []models.OutboxEvent) []error {
+		msgs := make([]kafka.Message, len(pending))
+		for i, event := range pending {
+			msg := event.Message
+			headers := make(map[string]string, len(msg.Headers)+1)
+			for key, value := range msg.Headers {
+				headers[key] = value
+			}
+			headers[kafka.HeaderMessageID] = fmt.Sprintf("%s-outbox-%d", cfg.ServiceName, event.ID)
+			msg.Headers = headers
+			msgs[i] = msg
+		}
+		if !cfg.KafkaProducer.Async {
+			return kafkaProducer.PublishBatch(ctx, msgs)
+		}
+		return publishAsync(ctx, msgs)
+	})
 }
 
-func parseMqttMessage(message []byte) (models.DataPayload, error) {
-	var mqttMessage models.DataPayload
-	if err := json.Unmarshal(message, &mqttMessage); err != nil {
-		log.Printf("Error parsing kafka message: %v", err)
-		return models.DataPayload{}, err
+// publishAsync queues msgs in order and waits for their completions until ctx
+// is done, messages not settled by then are reported as failed. The queue
+// keeps their order, so a failure to queue one leaves the rest unqueued.
+func publishAsync(ctx context.Context, msgs []kafka.Message) []error {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	errs := make([]error, len(msgs))
+	settled := make([]bool, len(msgs))
+	settle := func(i int, err error) {
+		mu.Lock()
+		errs[i], settled[i] = err, true
+		mu.Unlock()
+	}
+
+	for i, msg := range msgs {
+		wg.Add(1)
+		err := kafkaProducer.PublishAsync(ctx, msg, func(err error) {
+			settle(i, err)
+			wg.Done()
+		})
+		if err != nil {
+			wg.Done()
+			for j := i; j < len(msgs); j++ {
+				settle(j, err)
+			}
+			break
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	result := make([]error, len(msgs))
+	for i := range msgs {
+		result[i] = errs[i]
+		if !settled[i] {
+			result[i] = fmt.Errorf("failed to publish to topic %s: %w", msgs[i].Topic, ctx.Err())
+		}
+	}
+	return result
+}
+
+func rejectionReason(err error) string {
+	switch {
+	case errors.Is(err, payload.ErrEmptyPayload):
+		return reasonEmptyPayload
+	case errors.Is(err, payload.ErrInvalidPayload):
+		return reasonInvalidPayload
+	case errors.Is(err, payload.ErrUnknownParameter):
+		return reasonUnknownParameter
+	case errors.Is(err, payload.ErrUnsupportedFormat):
+		return reasonUnsupportedFormat
+	case errors.Is(err, payload.ErrBatchTooLarge):
+		return reasonBatchTooLarge
+	}
+	return reasonMalformed
+}
+
+func isUnprocessable(err error) bool {
+	return errors.Is(err, payload.ErrEmptyPayload) ||
+		errors.Is(err, payload.ErrBatchTooLarge) ||
+		errors.Is(err, payload.ErrInvalidPayload) ||
+		errors.Is(err, payload.ErrUnknownParameter)
+}
+
+func sendToDeadLetters(transport string, topic string, message []byte, cause error) {
+	err := deadLetters.Send(context.Background(), deadletter.Entry{
+		SourceTransport: transport,
+		SourceTopic:     topic,
+		Payload:         message,
+		Error:           cause.Error(),
+	})
+	if err != nil {
+		log.Printf("Error sending message from %s to dead letters: %v", topic, err)
 	}
-	return mqttMessage, nil
 }
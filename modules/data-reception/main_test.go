@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"ceiot-tf-background/modules/data-reception/devices"
+	"ceiot-tf-background/modules/data-reception/models"
+	"ceiot-tf-background/modules/data-reception/postgres"
+	"ceiot-tf-background/modules/utils/deadletter"
+	"ceiot-tf-background/modules/utils/metrics"
+	"ceiot-tf-background/modules/utils/mqtt"
+	"ceiot-tf-background/modules/utils/mqtt/broker"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const timeout = 5 * time.Second
+
+func TestMain(m *testing.M) {
+	if os.Getenv("MQTT_TEST_VERBOSE") == "" {
+		log.SetOutput(io.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+// receiver runs mqttHandleMessage behind the embedded broker, with device d1
+// active and dead letters collected instead of written to Kafka. Readings
+// that reach the database are out of its reach, so every message sent here
+// must be turned down before that.
+type receiver struct {
+	broker      *broker.Broker
+	deadLetters chan deadletter.Entry
+}
+
+func newReceiver(t *testing.T) *receiver {
+	t.Helper()
+	b := broker.New(broker.Options{})
+	if err := b.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+
+	r := &receiver{broker: b, deadLetters: make(chan deadletter.Entry, 100)}
+
+	cfg = &models.Config{
+		ServiceName:                 "data-reception",
+		MQTTPubBatchResultTopicTemp: "server/batch/___DEVICE___",
+		MQTTPubBatchResultQoS:       mqtt.AtLeastOnce,
+	}
+	rejected = metrics.NewRegistry().Counter("rejected_messages_total", "Messages that were not stored, by reason.", "reason")
+	deadLetters = deadletter.New(deadletter.Options{
+		Service: cfg.ServiceName,
+		Fallback: func(ctx context.Context, entry deadletter.Entry) error {
+			r.deadLetters <- entry
+			return nil
+		},
+	})
+	deviceCache = devices.NewCache(devices.Options{
+		LoadActive: func(ctx context.Context) ([]string, error) {
+			return []string{"d1"}, nil
+		},
+		Lookup: func(ctx context.Context, deviceID string) (bool, bool, error) {
+			return false, false, errors.New("database unavailable")
+		},
+	})
+	if err := deviceCache.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(deviceCache.Close)
+
+	subscriptions := []mqtt.Subscription{}
+	for _, topic := range []string{"devices/+/data", "devices/+/data/+", "devices/+/batch", "devices/+/batch/+"} {
+		subscriptions = append(subscriptions, mqtt.Subscription{Topic: topic, QoS: mqtt.AtLeastOnce, Handler: mqttHandleMessage})
+	}
+	mqttClient = connect(t, mqtt.ClientOptions{Broker: b.URL(), ClientID: "data-reception", Subscriptions: subscriptions})
+	return r
+}
+
+func connect(t *testing.T, opts mqtt.ClientOptions) *mqtt.Client {
+	t.Helper()
+	client, err := mqtt.NewClient(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Connect()
+	t.Cleanup(func() { client.Disconnect(0) })
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := client.WaitConnected(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// publish sends payload as a device would.
+func (r *receiver) publish(t *testing.T, topic string, payload []byte) {
+	t.Helper()
+	if err := r.broker.Publish(topic, mqtt.AtLeastOnce, false, payload); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// nextDeadLetter publishes payload until a dead letter comes out, since the
+// broker only delivers to the receiver once its subscriptions are active.
+func (r *receiver) nextDeadLetter(t *testing.T, topic string, payload []byte) deadletter.Entry {
+	t.Helper()
+	deadline := time.After(timeout)
+	retry := time.NewTicker(100 * time.Millisecond)
+	defer retry.Stop()
+	r.publish(t, topic, payload)
+	for {
+		select {
+		case entry := <-r.deadLetters:
+			return entry
+		case <-retry.C:
+			// Nothing arrived yet, the subscription may not have been active.
+			r.publish(t, topic, payload)
+		case <-deadline:
+			t.Fatalf("no dead letter after %s", timeout)
+			return deadletter.Entry{}
+		}
+	}
+}
+
+func TestMalformedReadingIsDeadLettered(t *testing.T) {
+	r := newReceiver(t)
+
+	entry := r.nextDeadLetter(t, "devices/d1/data", []byte("not json"))
+	if entry.SourceTransport != deadletter.TransportMQTT || entry.SourceTopic != "devices/d1/data" || string(entry.Payload) != "not json" {
+		t.Fatalf("got %+v", entry)
+	}
+}
+
+func TestUnsupportedFormatIsDeadLettered(t *testing.T) {
+	r := newReceiver(t)
+
+	entry := r.nextDeadLetter(t, "devices/d1/data/xml", []byte("<reading/>"))
+	if entry.SourceTopic != "devices/d1/data/xml" {
+		t.Fatalf("got %+v", entry)
+	}
+}
+
+func TestFailedDeviceLookupIsDeadLettered(t *testing.T) {
+	r := newReceiver(t)
+
+	message := []byte(`{"IDDevice":"d9","Parameter":"uptime","Data":{"uptime":10},"CollectedAtUtc":"2026-01-01T00:00:00Z"}`)
+	entry := r.nextDeadLetter(t, "devices/d9/data", message)
+	if entry.SourceTopic != "devices/d9/data" || string(entry.Payload) != string(message) {
+		t.Fatalf("got %+v", entry)
+	}
+}
+
+func TestRejectedBatchIsReportedAndDeadLettered(t *testing.T) {
+	r := newReceiver(t)
+
+	results := make(chan mqtt.Message, 100)
+	connect(t, mqtt.ClientOptions{
+		Broker:        r.broker.URL(),
+		ClientID:      "d1",
+		Subscriptions: []mqtt.Subscription{{Topic: "server/batch/d1", QoS: mqtt.AtLeastOnce, Handler: func(msg mqtt.Message) { results <- msg }}},
+	})
+
+	message, err := msgpack.Marshal(map[string]any{
+		"BatchID":  "b1",
+		"IDDevice": "d1",
+		"Readings": []map[string]any{
+			{"Parameter": "unknown", "Data": map[string]any{}, "CollectedAtUtc": "2026-01-01T00:00:00Z"},
+			{"Parameter": "uptime", "Data": "x", "CollectedAtUtc": "2026-01-01T00:00:00Z"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A dead letter is re-encoded as a JSON batch, so it is replayed on the JSON topic.
+	entry := r.nextDeadLetter(t, "devices/d1/batch/msgpack", message)
+	if entry.SourceTopic != "devices/d1/batch" {
+		t.Fatalf("dead letter source topic is %s, want devices/d1/batch", entry.SourceTopic)
+	}
+	var failed models.BatchPayload
+	if err := json.Unmarshal(entry.Payload, &failed); err != nil {
+		t.Fatal(err)
+	}
+	if failed.BatchID != "b1" || len(failed.Readings) != 2 {
+		t.Fatalf("dead letter holds %+v", failed)
+	}
+
+	select {
+	case msg := <-results:
+		var result models.BatchResult
+		if err := json.Unmarshal(msg.Payload, &result); err != nil {
+			t.Fatal(err)
+		}
+		if result.BatchID != "b1" || len(result.Results) != 2 {
+			t.Fatalf("got result %+v", result)
+		}
+		for _, reading := range result.Results {
+			if reading.Status != models.ResultRejected || reading.Error == "" {
+				t.Fatalf("reading %d: got %+v, want rejected", reading.Index, reading)
+			}
+		}
+	case <-time.After(timeout):
+		t.Fatalf("no batch result after %s", timeout)
+	}
+}
+
+func TestOnlyFailedReadingsOfBatchAreDeadLettered(t *testing.T) {
+	r := newReceiver(t)
+
+	batch := models.BatchPayload{
+		BatchID:  "b2",
+		IDDevice: "d1",
+		Readings: []models.DataPayload{
+			{Parameter: "uptime", CollectedAtUtc: "2026-01-01T00:00:00Z"},
+			{Parameter: "uptime", CollectedAtUtc: "2026-01-01T00:01:00Z"},
+			{Parameter: "uptime", CollectedAtUtc: "2026-01-01T00:02:00Z"},
+		},
+	}
+	sendFailedReadings("d1", batch, []error{nil, postgres.ErrDuplicateReading, errors.New("connection reset")})
+
+	select {
+	case entry := <-r.deadLetters:
+		var failed models.BatchPayload
+		if err := json.Unmarshal(entry.Payload, &failed); err != nil {
+			t.Fatal(err)
+		}
+		if len(failed.Readings) != 1 || failed.Readings[0].CollectedAtUtc != "2026-01-01T00:02:00Z" {
+			t.Fatalf("dead letter holds %+v, want only the failed reading", failed.Readings)
+		}
+	case <-time.After(timeout):
+		t.Fatalf("no dead letter after %s", timeout)
+	}
+}
@@ -1,84 +1,109 @@
 package models
 
-type Config struct {
-	KafkaBrokers  []string
-	KafkaTopics   []string
-	MQTTBroker    string
-	MQTTClientID  string
-	MQTTSubTopics []string
-	PostgresURL   string
-}
+import (
+	"encoding/json"
+	"time"
 
-type DataPayload struct {
-	IDDevice       string `json:"IDDevice"`
-	Parameter      string `json:"Parameter"`
-	Data           any    `json:"Data"`
-	CollectedAtUtc string `json:"CollectedAtUtc"`
-}
+	"ceiot-tf-background/modules/utils/kafka"
+	"ceiot-tf-background/modules/utils/mqtt"
+	"ceiot-tf-background/modules/utils/parameters"
+)
 
-type MainDeviceInfo struct {
-	HostID    string `json:"hostID"`
-	Hostname  string `json:"hostname"`
-	Kernel    string `json:"kernel"`
-	OS        string `json:"os"`
-	Processor string `json:"processor"`
-	RAM       string `json:"ram"`
+type Config struct {
+	ServiceName                 string
+	KafkaClientID               string
+	KafkaBrokers                []string
+	KafkaSecurity               kafka.SecurityOptions
+	KafkaTopics                 []string
+	KafkaDeadLetterTopic        string
+	KafkaTopicSpecs             []kafka.TopicSpec
+	KafkaProducer               kafka.ProducerOptions
+	MQTTTLS                     mqtt.TLSOptions
+	MQTTProtocolVersion         byte
+	MQTTSession                 mqtt.SessionOptions
+	MQTTStatusTopic             string
+	MQTTBroker                  string
+	MQTTClientID                string
+	MQTTSubTopics               []string
+	MQTTSubQoS                  byte
+	MQTTPubBatchResultTopicTemp string
+	MQTTPubBatchResultQoS       byte
+	PostgresURL                 string
+	PostgresBatchSize           int
+	PostgresBatchLinger         time.Duration
+	PostgresBatchQueueSize      int
+	OutboxRelayInterval         time.Duration
+	OutboxBatchSize             int
+	OutboxRetention             time.Duration
+	DeviceRefreshInterval       time.Duration
+	DeviceMissTTL               time.Duration
+	MetricsAddr                 string
 }
 
-type RAMUsage struct {
-	TotalRAM       int64   `json:"totalRAM"`
-	FreeRAM        int64   `json:"freeRAM"`
-	UsedRAM        int64   `json:"usedRAM"`
-	UsedPercentRAM float64 `json:"usedPercentRAM"`
+type DataPayload struct {
+	IDDevice       string          `json:"IDDevice"`
+	Parameter      string          `json:"Parameter"`
+	Data           json.RawMessage `json:"Data"`
+	CollectedAtUtc string          `json:"CollectedAtUtc"`
 }
 
-type DiskUsage struct {
-	DiskName        string  `json:"diskName"`
-	TotalDisk       int64   `json:"totalDisk"`
-	FreeDisk        int64   `json:"freeDisk"`
-	UsedDisk        int64   `json:"usedDisk"`
-	UsedPercentDisk float64 `json:"usedPercentDisk"`
+// BatchPayload carries several readings of one device, they may span
+// parameters and collection times. Readings may leave IDDevice empty.
+type BatchPayload struct {
+	BatchID  string        `json:"BatchID"`
+	IDDevice string        `json:"IDDevice"`
+	Readings []DataPayload `json:"Readings"`
 }
 
-type NetworkStats struct {
-	InterfaceName string `json:"interfaceName"`
-	BytesSent     int64  `json:"bytesSent"`
-	BytesRecv     int64  `json:"bytesRecv"`
-	PacketsSent   int64  `json:"packetsSent"`
-	PacketsRecv   int64  `json:"packetsRecv"`
-	ErrOut        int64  `json:"errOut"`
-	ErrIn         int64  `json:"errIn"`
-	DropIn        int64  `json:"dropIn"`
-	DropOut       int64  `json:"dropOut"`
-}
+// Outcomes of a reading of a batch.
+const (
+	ResultStored    = "stored"
+	ResultDuplicate = "duplicate"
+	ResultRejected  = "rejected"
+	ResultFailed    = "failed"
+)
 
-type NetworkInformation struct {
-	InterfaceName string   `json:"interfaceName"`
-	MTU           int      `json:"mtu"`
-	HardwareAddr  string   `json:"hardwareAddr"`
-	Flags         []string `json:"flags"`
-	Addrs         []string `json:"addrs"`
+// BatchResult is sent back to the device once every reading of a batch is settled.
+type BatchResult struct {
+	BatchID string          `json:"BatchID"`
+	Results []ReadingResult `json:"Results"`
 }
 
-type CPUTemperature struct {
-	SensorKey   string  `json:"sensorKey"`
-	Temperature float64 `json:"temperature"`
+type ReadingResult struct {
+	Index  int    `json:"Index"`
+	Status string `json:"Status"`
+	Error  string `json:"Error,omitempty"`
 }
 
-type Uptime struct {
-	UptimeMinutes int `json:"uptime"`
+// Reading is a DataPayload with its Data checked against the schema of its Parameter.
+type Reading struct {
+	DataPayload
+	Parameter   *parameters.Parameter
+	Entries     []parameters.Entry
+	CollectedAt time.Time
 }
 
-type LastReboot struct {
-	LastReboot string `json:"lastReboot"`
+// QuarantinedMessage is a message held back because its sender is not
+// allowed to report, kept apart from dead letters as it is not replayed.
+type QuarantinedMessage struct {
+	Reason        string
+	DeviceID      string
+	SourceTopic   string
+	Payload       []byte
+	ReceivedAtUtc time.Time
 }
 
-type CPUUsage struct {
-	CPUUsage float64 `json:"cpuUsage"`
+// OutboxEvent is an event stored along with its reading, waiting to be published.
+type OutboxEvent struct {
+	ID      int64
+	Message kafka.Message
 }
 
-type LoadAverage struct {
-	LoadAverage1M  float64 `json:"loadAverage1m"`
-	LoadAverage5M  float64 `json:"loadAverage5m"`
-	LoadAverage15M float64 `json:"loadAverage15m"`
+type MainDeviceInfo struct {
+	HostID    string `json:"hostID"`
+	Hostname  string `json:"hostname"`
+	Kernel    string `json:"kernel"`
+	OS        string `json:"os"`
+	Processor string `json:"processor"`
+	RAM       string `json:"ram"`
 }
@@ -0,0 +1,157 @@
+// Package outbox publishes the events that data-reception stores along with
+// its readings, so an event is never lost once its reading is committed.
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+type Options struct {
+	// Relay publishes the oldest pending events, at most limit, and returns how many were sent.
+	Relay func(ctx context.Context, limit int) (int, error)
+	// Cleanup deletes the events sent before the given time.
+	Cleanup func(ctx context.Context, before time.Time) (int64, error)
+	// Interval is how often pending events are looked for when no Notify arrives.
+	Interval        time.Duration
+	BatchSize       int
+	Retention       time.Duration
+	CleanupInterval time.Duration
+}
+
+// Relay moves pending outbox events to Kafka in the background.
+type Relay struct {
+	opts Options
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+
+	mu       sync.Mutex
+	relayErr error
+}
+
+func NewRelay(opts Options) *Relay {
+	if opts.Interval <= 0 {
+		opts.Interval = time.Second
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 500
+	}
+	if opts.Retention <= 0 {
+		opts.Retention = 24 * time.Hour
+	}
+	if opts.CleanupInterval <= 0 {
+		opts.CleanupInterval = time.Hour
+	}
+
+	relay := &Relay{
+		opts: opts,
+		wake: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go relay.run()
+
+	log.Printf("Outbox relay started (interval: %s, retention: %s)\n", opts.Interval, opts.Retention)
+	return relay
+}
+
+// Notify asks for a relay pass right away, typically after events were committed.
+func (r *Relay) Notify() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (r *Relay) run() {
+	defer close(r.done)
+
+	ticker := time.NewTicker(r.opts.Interval)
+	defer ticker.Stop()
+	cleanup := time.NewTicker(r.opts.CleanupInterval)
+	defer cleanup.Stop()
+
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-r.wake:
+			r.drain(context.Background())
+		case <-ticker.C:
+			r.drain(context.Background())
+		case <-cleanup.C:
+			r.cleanup()
+		}
+	}
+}
+
+// drain relays full batches until the outbox is empty or a pass fails, the
+// failed events are retried on the next tick.
+func (r *Relay) drain(ctx context.Context) {
+	for {
+		passCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		sent, err := r.opts.Relay(passCtx, r.opts.BatchSize)
+		cancel()
+
+		r.mu.Lock()
+		r.relayErr = err
+		r.mu.Unlock()
+
+		if err != nil {
+			log.Printf("Error relaying outbox events, %d sent: %v", sent, err)
+			return
+		}
+		if sent < r.opts.BatchSize {
+			return
+		}
+	}
+}
+
+func (r *Relay) cleanup() {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	deleted, err := r.opts.Cleanup(ctx, time.Now().UTC().Add(-r.opts.Retention))
+	if err != nil {
+		log.Printf("Error cleaning up outbox events: %v", err)
+		return
+	}
+	if deleted > 0 {
+		log.Printf("Deleted %d sent outbox event(s)\n", deleted)
+	}
+}
+
+// Health fails while the last relay pass failed.
+func (r *Relay) Health() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.relayErr != nil {
+		return fmt.Errorf("last relay failed: %w", r.relayErr)
+	}
+	return nil
+}
+
+// Close stops the relay after one last pass, so events committed during
+// shutdown are not left for the next start.
+func (r *Relay) Close(ctx context.Context) error {
+	select {
+	case <-r.stop:
+		return nil
+	default:
+	}
+	close(r.stop)
+
+	select {
+	case <-r.done:
+	case <-ctx.Done():
+		return fmt.Errorf("outbox relay did not stop: %w", ctx.Err())
+	}
+
+	r.drain(ctx)
+	log.Println("Outbox relay closed")
+	return nil
+}
@@ -0,0 +1,63 @@
+package payload
+
+import (
+	"ceiot-tf-background/modules/data-reception/models"
+	"errors"
+	"fmt"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// MaxBatchReadings bounds the readings of one batch, they are all stored in
+// a single transaction.
+const MaxBatchReadings = 1000
+
+var ErrBatchTooLarge = errors.New("too many readings in batch")
+
+// ParseBatch is Parse for batch messages.
+func ParseBatch(format string, message []byte) (models.BatchPayload, error) {
+	var batch models.BatchPayload
+	if format == FormatMsgpack {
+		var decoded msgpackBatch
+		if err := msgpack.Unmarshal(message, &decoded); err != nil {
+			return models.BatchPayload{}, fmt.Errorf("error decoding MessagePack payload: %w", err)
+		}
+		batch = models.BatchPayload{BatchID: decoded.BatchID, IDDevice: decoded.IDDevice}
+		for i, reading := range decoded.Readings {
+			dataPayload, err := reading.dataPayload()
+			if err != nil {
+				return models.BatchPayload{}, fmt.Errorf("reading %d: %w", i, err)
+			}
+			batch.Readings = append(batch.Readings, dataPayload)
+		}
+	} else if err := unmarshalJSON(format, message, &batch); err != nil {
+		return models.BatchPayload{}, err
+	}
+
+	if len(batch.Readings) == 0 {
+		return models.BatchPayload{}, ErrEmptyPayload
+	}
+	if len(batch.Readings) > MaxBatchReadings {
+		return models.BatchPayload{}, fmt.Errorf("%w: %d, at most %d", ErrBatchTooLarge, len(batch.Readings), MaxBatchReadings)
+	}
+	return batch, nil
+}
+
+// DecodeBatch decodes every reading of batch on its own. It returns the
+// reading or the error of each one, in order, so a bad reading does not
+// reject the rest.
+func DecodeBatch(batch models.BatchPayload) ([]models.Reading, []error) {
+	readings := make([]models.Reading, len(batch.Readings))
+	errs := make([]error, len(batch.Readings))
+	for i, dataPayload := range batch.Readings {
+		if dataPayload.IDDevice == "" {
+			dataPayload.IDDevice = batch.IDDevice
+		}
+		if dataPayload.IDDevice != batch.IDDevice {
+			errs[i] = fmt.Errorf("%w: reading of device %s in a batch of device %s", ErrInvalidPayload, dataPayload.IDDevice, batch.IDDevice)
+			continue
+		}
+		readings[i], errs[i] = Decode(dataPayload)
+	}
+	return readings, errs
+}
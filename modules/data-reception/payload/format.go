@@ -0,0 +1,122 @@
+package payload
+
+import (
+	"bytes"
+	"ceiot-tf-background/modules/data-reception/models"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Formats a device can publish in, chosen with the last segment of
+// devices/<id>/data/<format>. Plain devices/<id>/data is JSON.
+const (
+	FormatJSON    = "json"
+	FormatMsgpack = "msgpack"
+	FormatGzip    = "gzip"
+)
+
+var ErrUnsupportedFormat = errors.New("unsupported payload format")
+
+// maxInflatedSize bounds gzip payloads, so a small message cannot inflate
+// into an unbounded one.
+const maxInflatedSize = 1 << 20
+
+// Parse turns a message published in format into a DataPayload, so the
+// readings of every format are validated and stored the same way.
+func Parse(format string, message []byte) (models.DataPayload, error) {
+	if format == FormatMsgpack {
+		var decoded msgpackPayload
+		if err := msgpack.Unmarshal(message, &decoded); err != nil {
+			return models.DataPayload{}, fmt.Errorf("error decoding MessagePack payload: %w", err)
+		}
+		return decoded.dataPayload()
+	}
+
+	var dataPayload models.DataPayload
+	if err := unmarshalJSON(format, message, &dataPayload); err != nil {
+		return models.DataPayload{}, err
+	}
+	return dataPayload, nil
+}
+
+// unmarshalJSON decodes the JSON based formats into v.
+func unmarshalJSON(format string, message []byte, v any) error {
+	switch format {
+	case "", FormatJSON:
+	case FormatGzip:
+		inflated, err := gunzip(message)
+		if err != nil {
+			return err
+		}
+		message = inflated
+	default:
+		return fmt.Errorf("%w: %q", ErrUnsupportedFormat, format)
+	}
+
+	if err := json.Unmarshal(message, v); err != nil {
+		return fmt.Errorf("error decoding JSON payload: %w", err)
+	}
+	return nil
+}
+
+func gunzip(message []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(message))
+	if err != nil {
+		return nil, fmt.Errorf("error decompressing gzip payload: %w", err)
+	}
+	defer reader.Close()
+
+	inflated, err := io.ReadAll(io.LimitReader(reader, maxInflatedSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("error decompressing gzip payload: %w", err)
+	}
+	if len(inflated) > maxInflatedSize {
+		return nil, fmt.Errorf("gzip payload inflates past %d bytes", maxInflatedSize)
+	}
+	return inflated, nil
+}
+
+type msgpackPayload struct {
+	IDDevice  string `msgpack:"IDDevice"`
+	Parameter string `msgpack:"Parameter"`
+	Data      any    `msgpack:"Data"`
+	// CollectedAtUtc is either an RFC 3339 string or a MessagePack timestamp.
+	CollectedAtUtc any `msgpack:"CollectedAtUtc"`
+}
+
+// dataPayload re-encodes Data as JSON, the form it is validated and
+// published in.
+func (decoded msgpackPayload) dataPayload() (models.DataPayload, error) {
+	data, err := json.Marshal(decoded.Data)
+	if err != nil {
+		return models.DataPayload{}, fmt.Errorf("error converting MessagePack data to JSON: %w", err)
+	}
+
+	dataPayload := models.DataPayload{
+		IDDevice:  decoded.IDDevice,
+		Parameter: decoded.Parameter,
+		Data:      data,
+	}
+	switch collectedAt := decoded.CollectedAtUtc.(type) {
+	case nil:
+	case string:
+		dataPayload.CollectedAtUtc = collectedAt
+	case time.Time:
+		dataPayload.CollectedAtUtc = collectedAt.UTC().Format(time.RFC3339Nano)
+	default:
+		return models.DataPayload{}, fmt.Errorf("error decoding MessagePack payload: CollectedAtUtc is a %T", collectedAt)
+	}
+	return dataPayload, nil
+}
+
+type msgpackBatch struct {
+	BatchID  string           `msgpack:"BatchID"`
+	IDDevice string           `msgpack:"IDDevice"`
+	Readings []msgpackPayload `msgpack:"Readings"`
+}
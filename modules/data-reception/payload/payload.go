@@ -0,0 +1,52 @@
+package payload
+
+import (
+	"ceiot-tf-background/modules/data-reception/models"
+	"ceiot-tf-background/modules/utils/parameters"
+	"errors"
+	"time"
+)
+
+var (
+	ErrEmptyPayload     = errors.New("empty data payload")
+	ErrInvalidPayload   = parameters.ErrInvalidPayload
+	ErrUnknownParameter = errors.New("function not found")
+)
+
+// Decode checks dataPayload against the schema of its parameter and returns
+// its entries, reporting every problem found in a parameters.ValidationError.
+func Decode(dataPayload models.DataPayload) (models.Reading, error) {
+	if len(dataPayload.Data) == 0 || string(dataPayload.Data) == "null" {
+		return models.Reading{}, ErrEmptyPayload
+	}
+
+	parameter, exists := parameters.Lookup(dataPayload.Parameter)
+	if !exists {
+		return models.Reading{}, ErrUnknownParameter
+	}
+
+	v := &parameters.Validator{}
+	if dataPayload.IDDevice == "" {
+		v.Fail("IDDevice", "is required")
+	}
+	// The collection time is part of the natural key of every reading, it is
+	// kept in UTC with the precision of a Postgres timestamp so that stored
+	// rows compare equal to it.
+	collectedAt, err := time.Parse(time.RFC3339Nano, dataPayload.CollectedAtUtc)
+	if dataPayload.CollectedAtUtc == "" {
+		v.Fail("CollectedAtUtc", "is required")
+	} else if err != nil {
+		v.Fail("CollectedAtUtc", "must be an RFC 3339 timestamp")
+	}
+	entries := parameter.DecodeInto(v, dataPayload.Data)
+	if err := v.Err(parameter.ID); err != nil {
+		return models.Reading{}, err
+	}
+
+	return models.Reading{
+		DataPayload: dataPayload,
+		Parameter:   parameter,
+		Entries:     entries,
+		CollectedAt: collectedAt.UTC().Truncate(time.Microsecond),
+	}, nil
+}
@@ -0,0 +1,155 @@
+package postgres
+
+import (
+	"ceiot-tf-background/modules/data-reception/models"
+	"ceiot-tf-background/modules/utils/kafka"
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// outboxLockID is the advisory lock held while relaying, so that only one
+// replica publishes at a time and events leave in the order they were stored.
+const outboxLockID = 0x6f7574626f78
+
+func EnsureOutboxTable(ctx context.Context) error {
+	queries := []string{`
+		CREATE TABLE IF NOT EXISTS OUTBOX_EVENTS (
+			ID BIGSERIAL PRIMARY KEY,
+			TOPIC TEXT NOT NULL,
+			MESSAGE_KEY BYTEA,
+			PAYLOAD BYTEA NOT NULL,
+			HEADERS JSONB NOT NULL,
+			CREATED_AT_UTC TIMESTAMP NOT NULL,
+			SENT_AT_UTC TIMESTAMP
+		)
+	`,
+		"CREATE INDEX IF NOT EXISTS OUTBOX_EVENTS_PENDING ON OUTBOX_EVENTS (ID) WHERE SENT_AT_UTC IS NULL",
+	}
+
+	for _, query := range queries {
+		if _, err := db.Exec(ctx, query); err != nil {
+			return fmt.Errorf("error creating OUTBOX_EVENTS: %w", err)
+		}
+	}
+	return nil
+}
+
+// insertOutbox stores events within the transaction of the readings they describe.
+func insertOutbox(ctx context.Context, tx pgx.Tx, events []kafka.Message) error {
+	const columns = 5
+	createdAt := time.Now().UTC()
+	perStatement := maxParameters / columns
+	for start := 0; start < len(events); start += perStatement {
+		chunk := events[start:min(start+perStatement, len(events))]
+
+		var query strings.Builder
+		query.WriteString("INSERT INTO OUTBOX_EVENTS (TOPIC, MESSAGE_KEY, PAYLOAD, HEADERS, CREATED_AT_UTC) VALUES ")
+		args := make([]any, 0, len(chunk)*columns)
+		for i, event := range chunk {
+			if i > 0 {
+				query.WriteString(", ")
+			}
+			n := len(args)
+			fmt.Fprintf(&query, "($%d, $%d, $%d, $%d, $%d)", n+1, n+2, n+3, n+4, n+5)
+			headers := event.Headers
+			if headers == nil {
+				headers = map[string]string{}
+			}
+			args = append(args, event.Topic, event.Key, event.Value, headers, createdAt)
+		}
+
+		if _, err := tx.Exec(ctx, query.String(), args...); err != nil {
+			return fmt.Errorf("failed to insert into OUTBOX_EVENTS: %w", err)
+		}
+	}
+	return nil
+}
+
+// publishTimeout bounds how long RelayOutbox publishes while it holds the
+// outbox lock and its transaction open, events left unsent wait for the next pass.
+const publishTimeout = 10 * time.Second
+
+// RelayOutbox hands the oldest pending events, at most limit, to publish and
+// marks sent the events published before the first failure, so events never
+// leave out of order. It returns how many were sent, nothing is relayed while
+// another replica holds the outbox.
+func RelayOutbox(ctx context.Context, limit int, publish func(ctx context.Context, events []models.OutboxEvent) []error) (int, error) {
+	tx, err := db.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	var locked bool
+	if err := tx.QueryRow(ctx, "SELECT pg_try_advisory_xact_lock($1)", outboxLockID).Scan(&locked); err != nil {
+		return 0, fmt.Errorf("failed to lock OUTBOX_EVENTS: %w", err)
+	}
+	if !locked {
+		return 0, nil
+	}
+
+	rows, err := tx.Query(ctx, `
+		SELECT ID, TOPIC, MESSAGE_KEY, PAYLOAD, HEADERS
+		FROM OUTBOX_EVENTS
+		WHERE SENT_AT_UTC IS NULL
+		ORDER BY ID
+		LIMIT $1
+	`, limit)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read OUTBOX_EVENTS: %w", err)
+	}
+	events := []models.OutboxEvent{}
+	for rows.Next() {
+		var event models.OutboxEvent
+		if err := rows.Scan(&event.ID, &event.Message.Topic, &event.Message.Key, &event.Message.Value, &event.Message.Headers); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to read OUTBOX_EVENTS: %w", err)
+		}
+		events = append(events, event)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to read OUTBOX_EVENTS: %w", err)
+	}
+	if len(events) == 0 {
+		return 0, nil
+	}
+
+	publishCtx, cancel := context.WithTimeout(ctx, publishTimeout)
+	errs := publish(publishCtx, events)
+	cancel()
+
+	// Events after a failure are published again with it on the next pass, so
+	// they may arrive twice but never ahead of it.
+	sent := []int64{}
+	var publishErr error
+	for i, event := range events {
+		if errs[i] != nil {
+			publishErr = fmt.Errorf("failed to publish outbox event %d: %w", event.ID, errs[i])
+			break
+		}
+		sent = append(sent, event.ID)
+	}
+
+	if len(sent) > 0 {
+		if _, err := tx.Exec(ctx, "UPDATE OUTBOX_EVENTS SET SENT_AT_UTC = $1 WHERE ID = ANY($2)", time.Now().UTC(), sent); err != nil {
+			return 0, fmt.Errorf("failed to mark OUTBOX_EVENTS sent: %w", err)
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return 0, fmt.Errorf("failed to mark OUTBOX_EVENTS sent: %w", err)
+		}
+	}
+	return len(sent), publishErr
+}
+
+// DeleteSentOutbox removes events that were sent before the given time.
+func DeleteSentOutbox(ctx context.Context, before time.Time) (int64, error) {
+	result, err := db.Exec(ctx, "DELETE FROM OUTBOX_EVENTS WHERE SENT_AT_UTC < $1", before)
+	if err != nil {
+		return 0, fmt.Errorf("error deleting from OUTBOX_EVENTS: %w", err)
+	}
+	return result.RowsAffected(), nil
+}
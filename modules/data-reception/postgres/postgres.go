@@ -2,19 +2,23 @@ package postgres
 
 import (
 	"ceiot-tf-background/modules/data-reception/models"
+	"ceiot-tf-background/modules/data-reception/payload"
+	"ceiot-tf-background/modules/utils/deadletter"
+	"ceiot-tf-background/modules/utils/kafka"
+	"ceiot-tf-background/modules/utils/parameters"
 	"context"
 	"errors"
 	"fmt"
 	"log"
 	"reflect"
+	"strings"
+	"time"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-var (
-	db *pgxpool.Pool
-)
+var db *pgxpool.Pool
 
 func ConnectDB(connString string) error {
 	ctx := context.Background()
@@ -35,316 +39,253 @@ func CloseDB() {
 	}
 }
 
-func insertRAMUsage(tx pgx.Tx, dataPayload models.DataPayload) error {
-	query := `
-		INSERT INTO RAM_USAGE (
-			ID_DEVICE, TOTAL_RAM, FREE_RAM, USED_RAM, USED_PERCENT_RAM, COLLECTED_AT_UTC
-		) VALUES ($1, $2, $3, $4, $5, $6)
-	`
+// tableRows is a reading turned into the rows of its raw table, keys holds
+// the natural key of each row and event the message announcing the reading.
+type tableRows struct {
+	parameter *parameters.Parameter
+	rows      [][]any
+	keys      []string
+	event     kafka.Message
+}
 
-	dataMap, ok := dataPayload.Data.(map[string]interface{})
-	if !ok {
-		return fmt.Errorf("invalid data payload format")
+func buildRows(reading models.Reading) (tableRows, error) {
+	if reading.Parameter == nil {
+		return tableRows{}, payload.ErrUnknownParameter
 	}
 
-	_, err := tx.Exec(
-		context.Background(),
-		query,
-		dataPayload.IDDevice,
-		dataMap["totalRAM"],
-		dataMap["freeRAM"],
-		dataMap["usedRAM"],
-		dataMap["usedPercentRAM"],
-		dataPayload.CollectedAtUtc)
-	if err != nil {
-		return err
+	rows := make([][]any, len(reading.Entries))
+	keys := make([]string, len(reading.Entries))
+	for i, entry := range reading.Entries {
+		rows[i] = reading.Parameter.Row(reading.IDDevice, reading.CollectedAt, entry)
+		keys[i] = rowKey(reading.Parameter, reading.IDDevice, entry.Key, reading.CollectedAt)
 	}
-
-	log.Printf("RAM usage data inserted for device %s\n", dataPayload.IDDevice)
-	return nil
+	return tableRows{parameter: reading.Parameter, rows: rows, keys: keys}, nil
 }
 
-func insertDiskUsage(tx pgx.Tx, dataPayload models.DataPayload) error {
-	query := `
-		INSERT INTO DISK_USAGE (
-			ID_DEVICE, DISK_NAME, TOTAL_DISK, FREE_DISK, USED_DISK, USED_PERCENT_DISK, COLLECTED_AT_UTC
-		) VALUES ($1, $2, $3, $4, $5, $6, $7)
-	`
-
-	dataMap, ok := dataPayload.Data.(map[string]interface{})
-	if !ok {
-		return fmt.Errorf("invalid data payload format")
-	}
+func rowKey(parameter *parameters.Parameter, deviceID string, dimension string, collectedAt time.Time) string {
+	return strings.Join([]string{parameter.Table, deviceID, dimension, collectedAt.UTC().Format(time.RFC3339Nano)}, "\x00")
+}
 
-	for diskName, diskData := range dataMap {
-		data := diskData.(map[string]interface{})
-		_, err := tx.Exec(
-			context.Background(),
-			query,
-			dataPayload.IDDevice,
-			diskName,
-			data["totalDisk"],
-			data["freeDisk"],
-			data["usedDisk"],
-			data["usedPercentDisk"],
-			dataPayload.CollectedAtUtc)
-		if err != nil {
-			return fmt.Errorf("failed to insert disk usage: %w", err)
+// EnsureNaturalKeys creates the unique index behind the natural key of every
+// raw table. It fails for tables that already hold duplicates, inserts into
+// them still work but duplicates are not detected until they are removed.
+func EnsureNaturalKeys(ctx context.Context) error {
+	errs := []error{}
+	for _, parameter := range parameters.All() {
+		query := fmt.Sprintf("CREATE UNIQUE INDEX IF NOT EXISTS %s_NATURAL_KEY ON %s (%s)",
+			parameter.Table, parameter.Table, strings.Join(parameter.NaturalKey(), ", "))
+		if _, err := db.Exec(ctx, query); err != nil {
+			errs = append(errs, fmt.Errorf("error creating natural key on %s: %w", parameter.Table, err))
 		}
-		log.Printf("Disk usage data inserted for device %s, disk %s\n", dataPayload.IDDevice, diskName)
 	}
-	return nil
+	return errors.Join(errs...)
 }
 
-func insertNetworkStats(tx pgx.Tx, dataPayload models.DataPayload) error {
-	query := `
-		INSERT INTO NETWORK_STATS (
-			ID_DEVICE, INTERFACE_NAME, BYTES_SENT, BYTES_RECV, PACKETS_SENT, PACKETS_RECV, ERROUT, ERRIN, DROPIN, DROPOUT, COLLECTED_AT_UTC
-		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
-	`
-
-	dataMap, ok := dataPayload.Data.(map[string]interface{})
-	if !ok {
-		return fmt.Errorf("invalid data payload format")
-	}
+// maxParameters is the PostgreSQL limit of bind parameters in one statement.
+const maxParameters = 65535
+
+// insertRows writes rows with as few multi-row INSERT statements as the
+// parameter limit allows, skipping rows whose natural key is already stored.
+// It returns the keys of the rows that were inserted.
+func insertRows(ctx context.Context, tx pgx.Tx, parameter *parameters.Parameter, rows [][]any) (map[string]bool, error) {
+	columns := parameter.Columns()
+	naturalKey := parameter.NaturalKey()
+	perStatement := maxParameters / len(columns)
+	inserted := map[string]bool{}
+	for start := 0; start < len(rows); start += perStatement {
+		chunk := rows[start:min(start+perStatement, len(rows))]
+
+		var query strings.Builder
+		fmt.Fprintf(&query, "INSERT INTO %s (%s) VALUES ", parameter.Table, strings.Join(columns, ", "))
+		args := make([]any, 0, len(chunk)*len(columns))
+		for i, row := range chunk {
+			if i > 0 {
+				query.WriteString(", ")
+			}
+			query.WriteString("(")
+			for j, value := range row {
+				if j > 0 {
+					query.WriteString(", ")
+				}
+				args = append(args, value)
+				fmt.Fprintf(&query, "$%d", len(args))
+			}
+			query.WriteString(")")
+		}
+		// No conflict target, so tables still missing their natural key keep accepting rows.
+		fmt.Fprintf(&query, " ON CONFLICT DO NOTHING RETURNING %s", strings.Join(naturalKey, ", "))
 
-	for ifaceName, ifaceData := range dataMap {
-		data := ifaceData.(map[string]interface{})
-		_, err := tx.Exec(
-			context.Background(),
-			query,
-			dataPayload.IDDevice,
-			ifaceName,
-			data["bytesSent"],
-			data["bytesRecv"],
-			data["packetsSent"],
-			data["packetsRecv"],
-			data["errout"],
-			data["errin"],
-			data["dropin"],
-			data["dropout"],
-			dataPayload.CollectedAtUtc)
+		result, err := tx.Query(ctx, query.String(), args...)
 		if err != nil {
-			return fmt.Errorf("failed to insert network stats: %w", err)
+			return nil, fmt.Errorf("failed to insert into %s: %w", parameter.Table, err)
+		}
+		for result.Next() {
+			var deviceID, dimension string
+			var collectedAt time.Time
+			dest := []any{&deviceID, &collectedAt}
+			if parameter.Dimension != nil {
+				dest = []any{&deviceID, &dimension, &collectedAt}
+			}
+			if err := result.Scan(dest...); err != nil {
+				result.Close()
+				return nil, fmt.Errorf("failed to read rows inserted into %s: %w", parameter.Table, err)
+			}
+			inserted[rowKey(parameter, deviceID, dimension, collectedAt)] = true
+		}
+		if err := result.Err(); err != nil {
+			return nil, fmt.Errorf("failed to insert into %s: %w", parameter.Table, err)
 		}
-		log.Printf("Network stats data inserted for device %s, ifaceName %s\n", dataPayload.IDDevice, ifaceName)
 	}
-	return nil
+	return inserted, nil
 }
 
-func insertNetworkInfo(tx pgx.Tx, dataPayload models.DataPayload) error {
-	query := `
-	INSERT INTO NETWORK_INFORMATION (
-		ID_DEVICE, INTERFACE_NAME, MTU, HARDWARE_ADDR, FLAGS, ADDRS, COLLECTED_AT_UTC
-	) VALUES ($1, $2, $3, $4, $5, $6, $7)
-	`
+// insertReadings stores readings in one transaction, grouping the rows of
+// each table into shared statements, along with the events of new readings.
+// It reports for every reading whether it was new, a reading is a duplicate
+// when all of its rows were already stored.
+func insertReadings(ctx context.Context, readings []tableRows) ([]bool, error) {
+	// Tables keep the order they first appear in, so concurrent batches lock them in the same order.
+	tables := []*parameters.Parameter{}
+	rows := map[string][][]any{}
+	for _, r := range readings {
+		if _, seen := rows[r.parameter.Table]; !seen {
+			tables = append(tables, r.parameter)
+		}
+		rows[r.parameter.Table] = append(rows[r.parameter.Table], r.rows...)
+	}
 
-	dataMap, ok := dataPayload.Data.(map[string]interface{})
-	if !ok {
-		return fmt.Errorf("invalid data payload format")
+	tx, err := db.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return nil, err
 	}
+	defer tx.Rollback(ctx)
 
-	for ifaceName, ifaceData := range dataMap {
-		data := ifaceData.(map[string]interface{})
-		flags := fmt.Sprintf("%v", data["flags"])
-		addrs := fmt.Sprintf("%v", data["addrs"])
-		_, err := tx.Exec(
-			context.Background(),
-			query,
-			dataPayload.IDDevice,
-			ifaceName,
-			data["mtu"],
-			data["hardwareAddr"],
-			flags,
-			addrs,
-			dataPayload.CollectedAtUtc)
+	inserted := map[string]bool{}
+	for _, parameter := range tables {
+		keys, err := insertRows(ctx, tx, parameter, rows[parameter.Table])
 		if err != nil {
-			return fmt.Errorf("failed to insert network info: %w", err)
+			return nil, err
+		}
+		for key := range keys {
+			inserted[key] = true
 		}
-		log.Printf("Network information data inserted for device %s, interface %s\n", dataPayload.IDDevice, ifaceName)
 	}
-	return nil
-}
-
-func insertCPUTemperature(tx pgx.Tx, dataPayload models.DataPayload) error {
-	query := `
-		INSERT INTO CPU_TEMPERATURE (
-			ID_DEVICE, SENSOR_KEY, TEMPERATURE, COLLECTED_AT_UTC
-		) VALUES ($1, $2, $3, $4)
-	`
 
-	dataMap, ok := dataPayload.Data.(map[string]interface{})
-	if !ok {
-		return fmt.Errorf("invalid data payload format")
+	// A key inserted once is credited to the first reading holding it, so a
+	// retransmission within the same batch is still a duplicate.
+	fresh := make([]bool, len(readings))
+	events := []kafka.Message{}
+	for i, r := range readings {
+		fresh[i] = len(r.keys) == 0
+		for _, key := range r.keys {
+			if inserted[key] {
+				fresh[i] = true
+				delete(inserted, key)
+			}
+		}
+		// Duplicates were announced when first stored.
+		if fresh[i] && r.event.Topic != "" {
+			events = append(events, r.event)
+		}
 	}
 
-	for sensorKey, sensorData := range dataMap {
-		_, err := tx.Exec(
-			context.Background(),
-			query,
-			dataPayload.IDDevice,
-			sensorKey,
-			sensorData,
-			dataPayload.CollectedAtUtc)
-		if err != nil {
-			return fmt.Errorf("failed to insert CPU temperature: %w", err)
-		}
-		log.Printf("CPU temperature data inserted for device %s, sensor %s\n", dataPayload.IDDevice, sensorKey)
+	if err := insertOutbox(ctx, tx, events); err != nil {
+		return nil, err
 	}
 
-	return nil
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return fresh, nil
 }
 
-func insertUptime(tx pgx.Tx, dataPayload models.DataPayload) error {
-	query := `
-		INSERT INTO UPTIME (
-			ID_DEVICE, UPTIME_MINUTES, COLLECTED_AT_UTC
-		) VALUES ($1, $2, $3)
-	`
-
-	dataMap, ok := dataPayload.Data.(map[string]interface{})
-	if !ok {
-		return fmt.Errorf("invalid data payload format")
+func hasNoData(data interface{}) bool {
+	v := reflect.ValueOf(data)
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		if !field.IsZero() {
+			return false
+		}
 	}
+	return true
+}
 
-	_, err := tx.Exec(context.Background(), query, dataPayload.IDDevice, dataMap["uptime"], dataPayload.CollectedAtUtc)
+func GetActiveDevices(ctx context.Context) ([]string, error) {
+	rows, err := db.Query(ctx, "SELECT ID_DEVICE FROM DEVICES WHERE ACTIVE = TRUE")
 	if err != nil {
-		return fmt.Errorf("failed to insert uptime: %w", err)
+		return nil, err
 	}
+	defer rows.Close()
 
-	log.Printf("Uptime data inserted for device %s\n", dataPayload.IDDevice)
-	return nil
-}
+	var devices []string
+	for rows.Next() {
+		var deviceID string
+		if err := rows.Scan(&deviceID); err != nil {
+			return nil, err
+		}
+		devices = append(devices, deviceID)
+	}
 
-func insertLastReboot(tx pgx.Tx, dataPayload models.DataPayload) error {
-	query := `
-		INSERT INTO LAST_REBOOT (
-			ID_DEVICE, LAST_REBOOT, COLLECTED_AT_UTC
-		) VALUES ($1, $2, $3)
-	`
+	return devices, rows.Err()
+}
 
-	dataMap, ok := dataPayload.Data.(map[string]interface{})
-	if !ok {
-		return fmt.Errorf("invalid data payload format")
+func GetDevice(ctx context.Context, deviceID string) (bool, bool, error) {
+	var active bool
+	err := db.QueryRow(ctx, "SELECT ACTIVE FROM DEVICES WHERE ID_DEVICE = $1", deviceID).Scan(&active)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, false, nil
 	}
-
-	_, err := tx.Exec(context.Background(), query, dataPayload.IDDevice, dataMap["lastReboot"], dataPayload.CollectedAtUtc)
 	if err != nil {
-		return fmt.Errorf("failed to insert last reboot: %w", err)
+		return false, false, err
 	}
-
-	log.Printf("Last reboot data inserted for device %s\n", dataPayload.IDDevice)
-	return nil
+	return true, active, nil
 }
 
-func insertCPUUsage(tx pgx.Tx, dataPayload models.DataPayload) error {
+func EnsureQuarantineTable(ctx context.Context) error {
 	query := `
-		INSERT INTO CPU_USAGE (
-			ID_DEVICE, CPU_USAGE, COLLECTED_AT_UTC
-		) VALUES ($1, $2, $3)
+		CREATE TABLE IF NOT EXISTS QUARANTINED_MESSAGES (
+			ID BIGSERIAL PRIMARY KEY,
+			REASON TEXT NOT NULL,
+			ID_DEVICE TEXT NOT NULL,
+			SOURCE_TOPIC TEXT NOT NULL,
+			PAYLOAD BYTEA NOT NULL,
+			RECEIVED_AT_UTC TIMESTAMP NOT NULL
+		)
 	`
 
-	dataMap, ok := dataPayload.Data.(map[string]interface{})
-	if !ok {
-		return fmt.Errorf("invalid data payload format")
-	}
-
-	_, err := tx.Exec(context.Background(), query, dataPayload.IDDevice, dataMap["cpuUsage"], dataPayload.CollectedAtUtc)
-	if err != nil {
-		return fmt.Errorf("failed to insert CPU usage: %w", err)
+	if _, err := db.Exec(ctx, query); err != nil {
+		return fmt.Errorf("error creating QUARANTINED_MESSAGES: %w", err)
 	}
-
-	log.Printf("CPU usage data inserted for device %s\n", dataPayload.IDDevice)
 	return nil
 }
 
-func insertLoadAverage(tx pgx.Tx, dataPayload models.DataPayload) error {
+func InsertQuarantined(ctx context.Context, message models.QuarantinedMessage) error {
 	query := `
-		INSERT INTO LOAD_AVERAGE (
-			ID_DEVICE, LOAD_AVERAGE_1M, LOAD_AVERAGE_5M, LOAD_AVERAGE_15M, COLLECTED_AT_UTC
+		INSERT INTO QUARANTINED_MESSAGES (
+			REASON, ID_DEVICE, SOURCE_TOPIC, PAYLOAD, RECEIVED_AT_UTC
 		) VALUES ($1, $2, $3, $4, $5)
 	`
 
-	dataMap, ok := dataPayload.Data.(map[string]interface{})
-	if !ok {
-		return fmt.Errorf("invalid data payload format")
-	}
-
-	_, err := tx.Exec(
-		context.Background(),
+	_, err := db.Exec(
+		ctx,
 		query,
-		dataPayload.IDDevice,
-		dataMap["loadAverage1m"],
-		dataMap["loadAverage5m"],
-		dataMap["loadAverage15m"],
-		dataPayload.CollectedAtUtc)
+		message.Reason,
+		message.DeviceID,
+		message.SourceTopic,
+		message.Payload,
+		message.ReceivedAtUtc)
 	if err != nil {
-		return fmt.Errorf("failed to insert load average: %w", err)
+		return fmt.Errorf("error inserting into QUARANTINED_MESSAGES: %w", err)
 	}
 
-	log.Printf("Load average data inserted for device %s\n", dataPayload.IDDevice)
+	log.Printf("Message from %s quarantined (%s)\n", message.SourceTopic, message.Reason)
 	return nil
 }
 
-type FuncType func(tx pgx.Tx, dataPayload models.DataPayload) error
-
-func getInsertDataFunctions() map[string]FuncType {
-	return map[string]FuncType{
-		"ram":          insertRAMUsage,
-		"disk":         insertDiskUsage,
-		"net_stats":    insertNetworkStats,
-		"net_info":     insertNetworkInfo,
-		"cpu_temp":     insertCPUTemperature,
-		"uptime":       insertUptime,
-		"last_reboot":  insertLastReboot,
-		"cpu_usage":    insertCPUUsage,
-		"load_average": insertLoadAverage,
-	}
+func EnsureDeadLetterTable(ctx context.Context) error {
+	return deadletter.EnsureTable(ctx, db)
 }
 
-func InsertData(dataPayload models.DataPayload) error {
-	ctx := context.Background()
-	if dataPayload.Data == nil {
-		return errors.New("empty data payload")
-	}
-
-	tx, err := db.BeginTx(ctx, pgx.TxOptions{})
-	if err != nil {
-		return err
-	}
-	defer func() {
-		if r := recover(); r != nil {
-			tx.Rollback(ctx)
-		}
-	}()
-	defer tx.Rollback(ctx)
-
-	functions := getInsertDataFunctions()
-	if function, exists := functions[dataPayload.Parameter]; exists {
-		err := function(tx, dataPayload)
-		if err != nil {
-			return err
-		}
-	} else {
-		return errors.New("function not found")
-	}
-
-	err = tx.Commit(ctx)
-	if err != nil {
-		return err
-	}
-
-	log.Println("Data insertion successful")
-	return nil
-}
-
-func hasNoData(data interface{}) bool {
-	v := reflect.ValueOf(data)
-	for i := 0; i < v.NumField(); i++ {
-		field := v.Field(i)
-		if !field.IsZero() {
-			return false
-		}
-	}
-	return true
+func DeadLetterStore() deadletter.Store {
+	return deadletter.PostgresStore(db)
 }
@@ -0,0 +1,241 @@
+package postgres
+
+import (
+	"ceiot-tf-background/modules/data-reception/models"
+	"ceiot-tf-background/modules/utils/kafka"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+var (
+	ErrWriterClosed = errors.New("postgres writer is closed")
+	// ErrDuplicateReading is reported for readings whose rows were all stored before.
+	ErrDuplicateReading = errors.New("reading already stored")
+)
+
+type Completion func(err error)
+
+// BatchCompletion reports the outcome of every reading of a batch, in order.
+type BatchCompletion func(errs []error)
+
+type WriterOptions struct {
+	BatchSize int
+	Linger    time.Duration
+	QueueSize int
+}
+
+// pendingReadings are readings queued together, they always share a transaction.
+type pendingReadings struct {
+	rows []tableRows
+	done BatchCompletion
+}
+
+// Writer buffers readings and stores them in batches, one transaction per
+// batch. Every reading is acknowledged only after its batch has committed.
+type Writer struct {
+	queue     chan pendingReadings
+	batchSize int
+	linger    time.Duration
+	inFlight  sync.WaitGroup
+	mu        sync.RWMutex
+	closed    bool
+}
+
+func NewWriter(opts WriterOptions) *Writer {
+	writer := &Writer{
+		batchSize: opts.BatchSize,
+		linger:    opts.Linger,
+	}
+	if writer.batchSize <= 0 {
+		writer.batchSize = 500
+	}
+	if writer.linger <= 0 {
+		writer.linger = 100 * time.Millisecond
+	}
+	queueSize := opts.QueueSize
+	if queueSize <= 0 {
+		queueSize = 10 * writer.batchSize
+	}
+	writer.queue = make(chan pendingReadings, queueSize)
+
+	writer.inFlight.Add(1)
+	go writer.dispatch()
+
+	log.Printf("PostgreSQL writer initialized (batch size: %d, linger: %s)\n", writer.batchSize, writer.linger)
+	return writer
+}
+
+// InsertDataAsync queues reading for the next batch. Readings that cannot
+// be stored are rejected right away, otherwise the outcome of the insert is
+// reported through done. event is written to the outbox in the same
+// transaction when the reading is new. It blocks while the queue is full.
+func (w *Writer) InsertDataAsync(ctx context.Context, reading models.Reading, event kafka.Message, done Completion) error {
+	return w.InsertBatchAsync(ctx, []models.Reading{reading}, []kafka.Message{event}, func(errs []error) {
+		if done != nil {
+			done(errs[0])
+		}
+	})
+}
+
+// InsertBatchAsync is InsertDataAsync for readings that must be stored in
+// the same transaction, events holds the event of each reading.
+func (w *Writer) InsertBatchAsync(ctx context.Context, readings []models.Reading, events []kafka.Message, done BatchCompletion) error {
+	if len(readings) != len(events) {
+		return fmt.Errorf("got %d event(s) for %d reading(s)", len(events), len(readings))
+	}
+	rows := make([]tableRows, len(readings))
+	for i, reading := range readings {
+		r, err := buildRows(reading)
+		if err != nil {
+			return err
+		}
+		r.event = events[i]
+		rows[i] = r
+	}
+
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	if w.closed {
+		return ErrWriterClosed
+	}
+
+	select {
+	case w.queue <- pendingReadings{rows: rows, done: done}:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("failed to queue %d reading(s): %w", len(readings), ctx.Err())
+	}
+}
+
+func (w *Writer) dispatch() {
+	defer w.inFlight.Done()
+
+	batch := make([]pendingReadings, 0, w.batchSize)
+	size := 0
+	linger := time.NewTimer(w.linger)
+	linger.Stop()
+
+	flush := func() {
+		linger.Stop()
+		if len(batch) == 0 {
+			return
+		}
+		w.flush(batch)
+		batch = batch[:0]
+		size = 0
+	}
+
+	for {
+		select {
+		case pending, ok := <-w.queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, pending)
+			size += len(pending.rows)
+			if len(batch) == 1 {
+				linger.Reset(w.linger)
+			}
+			if size >= w.batchSize {
+				flush()
+			}
+		case <-linger.C:
+			flush()
+		}
+	}
+}
+
+func (w *Writer) flush(batch []pendingReadings) {
+	ctx := context.Background()
+
+	readings := []tableRows{}
+	for _, pending := range batch {
+		readings = append(readings, pending.rows...)
+	}
+
+	fresh, err := insertReadings(ctx, readings)
+	if err == nil {
+		duplicates := 0
+		for _, isFresh := range fresh {
+			if !isFresh {
+				duplicates++
+			}
+		}
+		for _, pending := range batch {
+			complete(pending, fresh[:len(pending.rows)], nil)
+			fresh = fresh[len(pending.rows):]
+		}
+		log.Printf("Batch of %d reading(s) inserted, %d duplicate(s) skipped\n", len(readings)-duplicates, duplicates)
+		return
+	}
+
+	if len(batch) == 1 {
+		log.Printf("Error inserting %d reading(s): %v\n", len(readings), err)
+		complete(batch[0], nil, err)
+		return
+	}
+
+	// One bad row rolls back the whole batch, retrying the readings queued
+	// together one transaction at a time keeps the others from failing with it.
+	log.Printf("Error inserting batch of %d reading(s), retrying one by one: %v\n", len(readings), err)
+	failed := 0
+	for _, pending := range batch {
+		fresh, err := insertReadings(ctx, pending.rows)
+		if err != nil {
+			failed += len(pending.rows)
+			complete(pending, nil, err)
+			continue
+		}
+		complete(pending, fresh, nil)
+	}
+	log.Printf("Inserted %d of %d reading(s) one by one\n", len(readings)-failed, len(readings))
+}
+
+func complete(pending pendingReadings, fresh []bool, err error) {
+	if pending.done == nil {
+		return
+	}
+	errs := make([]error, len(pending.rows))
+	for i := range errs {
+		switch {
+		case err != nil:
+			errs[i] = err
+		case !fresh[i]:
+			errs[i] = ErrDuplicateReading
+		}
+	}
+	pending.done(errs)
+}
+
+// Close stops accepting readings and waits until the queued ones are stored.
+func (w *Writer) Close(ctx context.Context) error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.closed = true
+	close(w.queue)
+	w.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		w.inFlight.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		return fmt.Errorf("postgres writer did not drain: %w", ctx.Err())
+	}
+
+	log.Println("PostgreSQL writer closed")
+	return nil
+}
@@ -4,27 +4,85 @@ import (
 	"fmt"
 	"net/url"
 	"os"
+	"time"
 
 	"ceiot-tf-background/modules/device-configuration/models"
+	"ceiot-tf-background/modules/utils/deadletter"
+	"ceiot-tf-background/modules/utils/env"
+	"ceiot-tf-background/modules/utils/kafka"
+	"ceiot-tf-background/modules/utils/mqtt"
 )
 
 func LoadEnvVars() (*models.Config, error) {
+	serviceName := "device-configuration"
+
 	kafkaClientID := "background-device-configuration-kafka-client"
 	kafkaGroupID := "device-update-events-handler-group"
 	kafkaBroker := os.Getenv("KAFKA_BROKER")
 	kafkaBrokers := []string{kafkaBroker}
-	kafkaTopics := []string{"device-update-events"}
+	kafkaSecurity, err := kafka.SecurityFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	kafkaTopics := []string{env.GetString("KAFKA_TOPIC_DEVICE_UPDATE_EVENTS", "device-update-events")}
+	kafkaTopicSpecs, err := kafka.TopicSpecsFromEnv(kafkaTopics[0], deadletter.TopicFor(kafkaTopics[0]))
+	if err != nil {
+		return nil, err
+	}
+	kafkaRetryMaxAttempts, err := env.GetInt("KAFKA_RETRY_MAX_ATTEMPTS", 5)
+	if err != nil {
+		return nil, err
+	}
+	kafkaRetryInitialBackoff, err := env.GetDuration("KAFKA_RETRY_INITIAL_BACKOFF", 1*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	kafkaRetryMaxBackoff, err := env.GetDuration("KAFKA_RETRY_MAX_BACKOFF", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	kafkaLagThreshold, err := env.GetInt("KAFKA_CONSUMER_LAG_THRESHOLD", 1000)
+	if err != nil {
+		return nil, err
+	}
+	kafkaLagInterval, err := env.GetDuration("KAFKA_CONSUMER_LAG_INTERVAL", 15*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	metricsAddr := env.GetString("METRICS_ADDR", ":4000")
 
 	mqttClientID := "background-device-configuration-mqtt-client"
 	mqttProtocol := os.Getenv("MQTT_PROTOCOL")
 	mqttHost := os.Getenv("MQTT_HOST")
 	mqttPort := os.Getenv("MQTT_PORT")
-	mqttBroker := fmt.Sprintf("%s://%s:%s", mqttProtocol, mqttHost, mqttPort)
+	mqttBroker := mqtt.BrokerURL(mqttProtocol, mqttHost, mqttPort)
+	mqttTLS, err := mqtt.TLSFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	mqttProtocolVersion, err := mqtt.ParseProtocolVersion(os.Getenv("MQTT_PROTOCOL_VERSION"))
+	if err != nil {
+		return nil, err
+	}
+	mqttSession, err := mqtt.SessionFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	mqttStatusTopic := "server/status/" + serviceName
 
 	mqttSubConfigTopic := "devices/+/config"
 	mqttSubTopics := []string{mqttSubConfigTopic}
+	mqttSubQoS := mqtt.AtLeastOnce
 
 	mqttPubConfigTopicTemp := "server/config/___DEVICE___"
+	mqttPubConfigQoS := mqtt.AtLeastOnce
+	mqttConfigResponseTopicTemp := "devices/___DEVICE___/config"
+	mqttConfigExpiry, err := env.GetDuration("MQTT_CONFIG_EXPIRY", 1*time.Minute)
+	if err != nil {
+		return nil, err
+	}
 
 	postgresUser := os.Getenv("POSTGRES_USER")
 	postgresPassword := os.Getenv("POSTGRES_PASSWORD")
@@ -35,15 +93,34 @@ func LoadEnvVars() (*models.Config, error) {
 	postgresURL := fmt.Sprintf("postgres://%s:%s@%s:%s/%s", postgresUser, encodedPostgresPassword, postgresHost, postgresPort, postgresDB)
 
 	config := &models.Config{
-		KafkaClientID:          kafkaClientID,
-		KafkaGroupID:           kafkaGroupID,
-		KafkaBrokers:           kafkaBrokers,
-		KafkaTopics:            kafkaTopics,
-		MQTTClientID:           mqttClientID,
-		MQTTBroker:             mqttBroker,
-		MQTTSubTopics:          mqttSubTopics,
-		MQTTPubConfigTopicTemp: mqttPubConfigTopicTemp,
-		PostgresURL:            postgresURL,
+		ServiceName:                 serviceName,
+		KafkaClientID:               kafkaClientID,
+		KafkaGroupID:                kafkaGroupID,
+		KafkaBrokers:                kafkaBrokers,
+		KafkaSecurity:               kafkaSecurity,
+		KafkaTopics:                 kafkaTopics,
+		KafkaTopicSpecs:             kafkaTopicSpecs,
+		MQTTClientID:                mqttClientID,
+		MQTTTLS:                     mqttTLS,
+		MQTTProtocolVersion:         mqttProtocolVersion,
+		MQTTSession:                 mqttSession,
+		MQTTStatusTopic:             mqttStatusTopic,
+		MQTTBroker:                  mqttBroker,
+		MQTTSubTopics:               mqttSubTopics,
+		MQTTSubQoS:                  mqttSubQoS,
+		MQTTPubConfigTopicTemp:      mqttPubConfigTopicTemp,
+		MQTTPubConfigQoS:            mqttPubConfigQoS,
+		MQTTConfigResponseTopicTemp: mqttConfigResponseTopicTemp,
+		MQTTConfigExpiry:            mqttConfigExpiry,
+		PostgresURL:                 postgresURL,
+		KafkaRetry: kafka.RetryOptions{
+			MaxAttempts:    kafkaRetryMaxAttempts,
+			InitialBackoff: kafkaRetryInitialBackoff,
+			MaxBackoff:     kafkaRetryMaxBackoff,
+		},
+		KafkaLagThreshold: int64(kafkaLagThreshold),
+		KafkaLagInterval:  kafkaLagInterval,
+		MetricsAddr:       metricsAddr,
 	}
 
 	return config, nil
@@ -4,9 +4,16 @@ import (
 	"ceiot-tf-background/modules/device-configuration/config"
 	"ceiot-tf-background/modules/device-configuration/models"
 	"ceiot-tf-background/modules/device-configuration/postgres"
+	"ceiot-tf-background/modules/utils/deadletter"
 	"ceiot-tf-background/modules/utils/kafka"
+	"ceiot-tf-background/modules/utils/metrics"
 	"ceiot-tf-background/modules/utils/mqtt"
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"encoding/json"
@@ -14,18 +21,23 @@ import (
 )
 
 var (
-	err error
-	cfg *models.Config
+	err           error
+	cfg           *models.Config
+	kafkaConsumer *kafka.Consumer
+	kafkaProducer *kafka.Producer
+	metricsServer *http.Server
+	mqttClient    *mqtt.Client
+	// confirmConfiguration records that a device applied its configuration.
+	confirmConfiguration = postgres.UpdateDeviceAndInsertInfo
 )
 
 func main() {
 	loadConfiguration()
+	initializeDatabase()
 	startMQTTClient()
 	startKafkaClient()
-	initializeDatabase()
 	go periodicDatabaseCheck()
-	defer postgres.CloseDB()
-	select {}
+	waitForShutdown()
 }
 
 func loadConfiguration() {
@@ -36,11 +48,64 @@ func loadConfiguration() {
 }
 
 func startMQTTClient() {
-	go mqtt.ConnectClient(cfg.MQTTBroker, cfg.MQTTClientID, cfg.MQTTSubTopics, mqttHandleMessage)
+	subscriptions := make([]mqtt.Subscription, len(cfg.MQTTSubTopics))
+	for i, topic := range cfg.MQTTSubTopics {
+		subscriptions[i] = mqtt.Subscription{Topic: topic, QoS: cfg.MQTTSubQoS, Handler: mqttHandleMessage}
+	}
+
+	mqttClient, err = mqtt.NewClient(mqtt.ClientOptions{
+		Broker:          cfg.MQTTBroker,
+		ProtocolVersion: cfg.MQTTProtocolVersion,
+		Session:         cfg.MQTTSession,
+		Status:          mqtt.ServiceStatus(cfg.MQTTStatusTopic, cfg.ServiceName, cfg.MQTTClientID),
+		ClientID:        cfg.MQTTClientID,
+		Subscriptions:   subscriptions,
+		TLS:             cfg.MQTTTLS,
+	})
+	if err != nil {
+		log.Fatalf("Failed to create MQTT client: %v", err)
+	}
+	mqttClient.Connect()
 }
 
 func startKafkaClient() {
-	go kafka.InitializeReader(cfg.KafkaBrokers, cfg.KafkaGroupID, cfg.KafkaTopics, kafkaHandleMessage)
+	kafkaClient, err := kafka.NewClient(kafka.ClientOptions{
+		Brokers:  cfg.KafkaBrokers,
+		ClientID: cfg.KafkaClientID,
+		Security: cfg.KafkaSecurity,
+	})
+	if err != nil {
+		log.Fatalf("Failed to create Kafka client: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := kafkaClient.EnsureTopics(ctx, cfg.KafkaTopicSpecs...); err != nil {
+		log.Fatalf("Failed to prepare Kafka topics: %v", err)
+	}
+
+	kafkaProducer = kafkaClient.NewProducer(kafka.ProducerOptions{})
+	metricsRegistry := metrics.NewRegistry()
+	deadLetters := deadletter.New(deadletter.Options{
+		Service:  cfg.ServiceName,
+		Producer: kafkaProducer,
+		Fallback: postgres.DeadLetterStore(),
+	})
+
+	kafkaConsumer = kafkaClient.NewConsumer(kafka.ConsumerOptions{
+		GroupID:      cfg.KafkaGroupID,
+		Topics:       cfg.KafkaTopics,
+		Retry:        cfg.KafkaRetry,
+		Park:         deadLetters.Park,
+		Metrics:      kafka.NewPrometheusMetrics(metricsRegistry, cfg.KafkaGroupID),
+		LagThreshold: cfg.KafkaLagThreshold,
+		LagInterval:  cfg.KafkaLagInterval,
+	})
+	kafkaConsumer.Start(context.Background(), kafkaHandleMessage)
+
+	metricsServer = metrics.Serve(cfg.MetricsAddr, metricsRegistry, map[string]metrics.HealthCheck{
+		"kafka-consumer": kafkaConsumer.Health,
+	})
 }
 
 func initializeDatabase() {
@@ -48,36 +113,75 @@ func initializeDatabase() {
 	if err != nil {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := postgres.EnsureDeadLetterTable(ctx); err != nil {
+		log.Fatalf("Failed to prepare dead letters: %v", err)
+	}
 }
 
-func kafkaHandleMessage(topic string, message []byte) {
-	if topic != cfg.KafkaTopics[0] {
-		return
+func waitForShutdown() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+	log.Println("Shutting down")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := metricsServer.Shutdown(ctx); err != nil {
+		log.Printf("Error stopping metrics server: %v", err)
+	}
+	if err := kafkaConsumer.Close(ctx); err != nil {
+		log.Printf("Error closing Kafka consumer: %v", err)
+	}
+	mqttClient.Disconnect(250 * time.Millisecond)
+	if err := kafkaProducer.Close(ctx); err != nil {
+		log.Printf("Error closing Kafka producer: %v", err)
+	}
+	postgres.CloseDB()
+}
+
+func kafkaHandleMessage(ctx context.Context, msg kafka.Message) error {
+	if msg.Topic != cfg.KafkaTopics[0] {
+		return nil
 	}
 
-	kafkaMessage, err := parseKafkaMessage(message)
+	kafkaMessage, err := parseKafkaMessage(msg.Value)
 	if err != nil {
-		return
+		return kafka.Permanent(err)
 	}
 
-	publishConfigurationToDevice(kafkaMessage.IDDevice, kafkaMessage.HashUpdate, kafkaMessage.Type)
+	return publishConfigurationToDevice(kafkaMessage.IDDevice, kafkaMessage.HashUpdate, kafkaMessage.Type)
 }
 
-func publishConfigurationToDevice(idDevice string, hashUpdate string, idType string) {
+func publishConfigurationToDevice(idDevice string, hashUpdate string, idType string) error {
 	deviceReadingSettings, err := postgres.GetDeviceReadingSettings(idDevice)
 	if err != nil {
-		return
+		return err
 	}
 	messageConfigPayload := buildMessageConfigPayload(idDevice, hashUpdate, idType, deviceReadingSettings)
 
 	mqttPayload, err := stringifyPayload(messageConfigPayload)
 	if err != nil {
-		return
+		return kafka.Permanent(err)
 	}
 
 	mqttConfigDeviceTopic := strings.Replace(cfg.MQTTPubConfigTopicTemp, "___DEVICE___", messageConfigPayload.IDDevice, 1)
+	mqttConfigResponseTopic := strings.Replace(cfg.MQTTConfigResponseTopicTemp, "___DEVICE___", messageConfigPayload.IDDevice, 1)
 
-	mqtt.PublishData(mqttConfigDeviceTopic, mqttPayload)
+	// On MQTT 5 the hash travels as correlation data so the device can echo it
+	// back, and the broker drops the push once the next periodic retry supersedes it.
+	return mqttClient.PublishMessage(mqtt.Message{
+		Topic:           mqttConfigDeviceTopic,
+		QoS:             cfg.MQTTPubConfigQoS,
+		Payload:         []byte(mqttPayload),
+		ResponseTopic:   mqttConfigResponseTopic,
+		CorrelationData: []byte(hashUpdate),
+		UserProperties:  map[string]string{"type": idType},
+		MessageExpiry:   cfg.MQTTConfigExpiry,
+	})
 }
 
 func parseKafkaMessage(message []byte) (models.KafkaMessage, error) {
@@ -98,17 +202,27 @@ func buildMessageConfigPayload(IDDevice string, HashUpdate string, Type string,
 	}
 }
 
-func mqttHandleMessage(topic string, message []byte) {
-	if !strings.HasPrefix(topic, "devices/") || !strings.HasSuffix(topic, "/config") {
+func mqttHandleMessage(msg mqtt.Message) {
+	if !strings.HasPrefix(msg.Topic, "devices/") || !strings.HasSuffix(msg.Topic, "/config") {
 		return
 	}
 
-	responseConfigPayload, err := parseMqttMessage(message)
+	responseConfigPayload, err := parseMqttMessage(msg.Payload)
 	if err != nil {
 		return
 	}
 
-	err = postgres.UpdateDeviceAndInsertInfo(responseConfigPayload)
+	// MQTT 5 devices echo the correlation data of the push they are acknowledging.
+	if len(msg.CorrelationData) > 0 {
+		correlatedHash := string(msg.CorrelationData)
+		if responseConfigPayload.HashUpdate != "" && responseConfigPayload.HashUpdate != correlatedHash {
+			log.Printf("Ignoring config ack from device %s: hash %s does not match correlation data %s", responseConfigPayload.IDDevice, responseConfigPayload.HashUpdate, correlatedHash)
+			return
+		}
+		responseConfigPayload.HashUpdate = correlatedHash
+	}
+
+	err = confirmConfiguration(responseConfigPayload)
 	if err != nil {
 		return
 	}
@@ -144,7 +258,9 @@ func periodicDatabaseCheck() {
 		}
 
 		for _, device := range notUpdatedDevices {
-			publishConfigurationToDevice(device.IDDevice, device.HashUpdate, device.Type)
+			if err := publishConfigurationToDevice(device.IDDevice, device.HashUpdate, device.Type); err != nil {
+				log.Printf("Error publishing configuration to device %s: %v", device.IDDevice, err)
+			}
 		}
 
 		timer := time.NewTimer(1 * time.Minute)
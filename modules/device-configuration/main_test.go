@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"ceiot-tf-background/modules/device-configuration/models"
+	"ceiot-tf-background/modules/utils/mqtt"
+	"ceiot-tf-background/modules/utils/mqtt/broker"
+)
+
+const timeout = 5 * time.Second
+
+func TestMain(m *testing.M) {
+	if os.Getenv("MQTT_TEST_VERBOSE") == "" {
+		log.SetOutput(io.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+// confirmations replaces the database with a channel of the acks that would
+// have been stored.
+func confirmations(t *testing.T) chan models.ResponseConfigPayload {
+	confirmed := make(chan models.ResponseConfigPayload, 100)
+	previous := confirmConfiguration
+	confirmConfiguration = func(payload models.ResponseConfigPayload) error {
+		confirmed <- payload
+		return nil
+	}
+	t.Cleanup(func() { confirmConfiguration = previous })
+	return confirmed
+}
+
+func nextConfirmation(t *testing.T, confirmed chan models.ResponseConfigPayload) models.ResponseConfigPayload {
+	t.Helper()
+	select {
+	case payload := <-confirmed:
+		return payload
+	case <-time.After(timeout):
+		t.Fatalf("no configuration confirmed after %s", timeout)
+		return models.ResponseConfigPayload{}
+	}
+}
+
+func connect(t *testing.T, opts mqtt.ClientOptions) *mqtt.Client {
+	t.Helper()
+	client, err := mqtt.NewClient(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Connect()
+	t.Cleanup(func() { client.Disconnect(0) })
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := client.WaitConnected(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestAckThroughBrokerIsConfirmed(t *testing.T) {
+	confirmed := confirmations(t)
+
+	b := broker.New(broker.Options{})
+	if err := b.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+
+	connect(t, mqtt.ClientOptions{
+		Broker:        b.URL(),
+		ClientID:      "device-configuration",
+		Subscriptions: []mqtt.Subscription{{Topic: "devices/+/config", QoS: mqtt.AtLeastOnce, Handler: mqttHandleMessage}},
+	})
+	device := connect(t, mqtt.ClientOptions{Broker: b.URL(), ClientID: "d1"})
+
+	// The ack is sent again until the subscription of the service is active.
+	ack := []byte(`{"IDDevice":"d1","HashUpdate":"h1","Type":"full","UpdateDatetimeUTC":"2026-01-01T00:00:00Z"}`)
+	deadline := time.After(timeout)
+	for {
+		if err := device.Publish("devices/d1/config", mqtt.AtLeastOnce, false, ack); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case payload := <-confirmed:
+			if payload.IDDevice != "d1" || payload.HashUpdate != "h1" || payload.Type != "full" {
+				t.Fatalf("got %+v", payload)
+			}
+			return
+		case <-time.After(100 * time.Millisecond):
+		case <-deadline:
+			t.Fatalf("no configuration confirmed after %s", timeout)
+		}
+	}
+}
+
+func TestAckTakesHashFromCorrelationData(t *testing.T) {
+	confirmed := confirmations(t)
+
+	mqttHandleMessage(mqtt.Message{
+		Topic:           "devices/d1/config",
+		Payload:         []byte(`{"IDDevice":"d1","Type":"full"}`),
+		CorrelationData: []byte("h2"),
+	})
+
+	payload := nextConfirmation(t, confirmed)
+	if payload.HashUpdate != "h2" {
+		t.Fatalf("confirmed hash %q, want the correlation data h2", payload.HashUpdate)
+	}
+}
+
+func TestUnmatchedAcksAreIgnored(t *testing.T) {
+	confirmed := confirmations(t)
+
+	mqttHandleMessage(mqtt.Message{
+		Topic:           "devices/d1/config",
+		Payload:         []byte(`{"IDDevice":"d1","HashUpdate":"old","Type":"full"}`),
+		CorrelationData: []byte("new"),
+	})
+	mqttHandleMessage(mqtt.Message{Topic: "devices/d1/data", Payload: []byte(`{"IDDevice":"d1","HashUpdate":"h1"}`)})
+	mqttHandleMessage(mqtt.Message{Topic: "devices/d1/config", Payload: []byte("not json")})
+
+	select {
+	case payload := <-confirmed:
+		t.Fatalf("unexpected confirmation %+v", payload)
+	default:
+	}
+}
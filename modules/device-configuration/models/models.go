@@ -1,15 +1,37 @@
 package models
 
+import (
+	"time"
+
+	"ceiot-tf-background/modules/utils/kafka"
+	"ceiot-tf-background/modules/utils/mqtt"
+)
+
 type Config struct {
-	KafkaClientID          string
-	KafkaGroupID           string
-	KafkaBrokers           []string
-	KafkaTopics            []string
-	MQTTBroker             string
-	MQTTClientID           string
-	MQTTSubTopics          []string
-	PostgresURL            string
-	MQTTPubConfigTopicTemp string
+	ServiceName                 string
+	KafkaClientID               string
+	KafkaGroupID                string
+	KafkaBrokers                []string
+	KafkaSecurity               kafka.SecurityOptions
+	KafkaTopics                 []string
+	KafkaTopicSpecs             []kafka.TopicSpec
+	KafkaRetry                  kafka.RetryOptions
+	MQTTTLS                     mqtt.TLSOptions
+	MQTTProtocolVersion         byte
+	MQTTSession                 mqtt.SessionOptions
+	MQTTStatusTopic             string
+	MQTTBroker                  string
+	MQTTClientID                string
+	MQTTSubTopics               []string
+	MQTTSubQoS                  byte
+	KafkaLagThreshold           int64
+	KafkaLagInterval            time.Duration
+	MetricsAddr                 string
+	PostgresURL                 string
+	MQTTPubConfigTopicTemp      string
+	MQTTPubConfigQoS            byte
+	MQTTConfigResponseTopicTemp string
+	MQTTConfigExpiry            time.Duration
 }
 
 type KafkaMessage struct {
@@ -5,6 +5,7 @@ import (
 	"log"
 
 	"ceiot-tf-background/modules/device-configuration/models"
+	"ceiot-tf-background/modules/utils/deadletter"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
@@ -191,3 +192,11 @@ func UpdateDeviceAndInsertInfo(rCfgPayload models.ResponseConfigPayload) error {
 	log.Println("Transaction completed successfully for device configuration:", rCfgPayload.IDDevice)
 	return nil
 }
+
+func EnsureDeadLetterTable(ctx context.Context) error {
+	return deadletter.EnsureTable(ctx, db)
+}
+
+func DeadLetterStore() deadletter.Store {
+	return deadletter.PostgresStore(db)
+}
@@ -4,16 +4,61 @@ import (
 	"fmt"
 	"net/url"
 	"os"
+	"time"
 
 	"ceiot-tf-background/modules/threshold-validator/models"
+	"ceiot-tf-background/modules/utils/deadletter"
+	"ceiot-tf-background/modules/utils/env"
+	"ceiot-tf-background/modules/utils/kafka"
 )
 
 func LoadEnvVars() (*models.Config, error) {
+	serviceName := "threshold-validator"
+
 	kafkaClientID := "background-threshold-validators-kafka-client"
 	kafkaGroupID := "device-data-events-notification-group"
 	kafkaBroker := os.Getenv("KAFKA_BROKER")
 	kafkaBrokers := []string{kafkaBroker}
-	kafkaTopics := []string{"device-data-events"}
+	kafkaSecurity, err := kafka.SecurityFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	kafkaTopics := []string{env.GetString("KAFKA_TOPIC_DEVICE_DATA_EVENTS", "device-data-events")}
+	kafkaTopicSpecs, err := kafka.TopicSpecsFromEnv(kafkaTopics[0], deadletter.TopicFor(kafkaTopics[0]))
+	if err != nil {
+		return nil, err
+	}
+	kafkaRetryMaxAttempts, err := env.GetInt("KAFKA_RETRY_MAX_ATTEMPTS", 5)
+	if err != nil {
+		return nil, err
+	}
+	kafkaRetryInitialBackoff, err := env.GetDuration("KAFKA_RETRY_INITIAL_BACKOFF", 1*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	kafkaRetryMaxBackoff, err := env.GetDuration("KAFKA_RETRY_MAX_BACKOFF", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	kafkaLagThreshold, err := env.GetInt("KAFKA_CONSUMER_LAG_THRESHOLD", 1000)
+	if err != nil {
+		return nil, err
+	}
+	kafkaLagInterval, err := env.GetDuration("KAFKA_CONSUMER_LAG_INTERVAL", 15*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	metricsAddr := env.GetString("METRICS_ADDR", ":4003")
+	kafkaConsumerConcurrency, err := env.GetInt("KAFKA_CONSUMER_CONCURRENCY", 4)
+	if err != nil {
+		return nil, err
+	}
+
+	processedRetention, err := env.GetDuration("PROCESSED_MESSAGES_RETENTION", 7*24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
 
 	postgresUser := os.Getenv("POSTGRES_USER")
 	postgresPassword := os.Getenv("POSTGRES_PASSWORD")
@@ -33,12 +78,25 @@ func LoadEnvVars() (*models.Config, error) {
 	}
 
 	config := &models.Config{
-		KafkaClientID: kafkaClientID,
-		KafkaGroupID:  kafkaGroupID,
-		KafkaBrokers:  kafkaBrokers,
-		KafkaTopics:   kafkaTopics,
-		PostgresURL:   postgresURL,
-		SmtpConfig:    smtpConfig,
+		ServiceName:     serviceName,
+		KafkaClientID:   kafkaClientID,
+		KafkaGroupID:    kafkaGroupID,
+		KafkaBrokers:    kafkaBrokers,
+		KafkaSecurity:   kafkaSecurity,
+		KafkaTopics:     kafkaTopics,
+		KafkaTopicSpecs: kafkaTopicSpecs,
+		PostgresURL:     postgresURL,
+		SmtpConfig:      smtpConfig,
+		KafkaRetry: kafka.RetryOptions{
+			MaxAttempts:    kafkaRetryMaxAttempts,
+			InitialBackoff: kafkaRetryInitialBackoff,
+			MaxBackoff:     kafkaRetryMaxBackoff,
+		},
+		KafkaLagThreshold:        int64(kafkaLagThreshold),
+		KafkaLagInterval:         kafkaLagInterval,
+		MetricsAddr:              metricsAddr,
+		ProcessedRetention:       processedRetention,
+		KafkaConsumerConcurrency: kafkaConsumerConcurrency,
 	}
 
 	return config, nil
@@ -2,6 +2,7 @@ package mail
 
 import (
 	"ceiot-tf-background/modules/threshold-validator/models"
+	"ceiot-tf-background/modules/utils/parameters"
 	"crypto/tls"
 	"errors"
 	"fmt"
@@ -103,59 +104,9 @@ func SendNotification(smtpConfig models.SmtpConfig, body string) bool {
 }
 
 func BuildContent(dataPayload models.DataPayload, setting models.DeviceReadingSetting, exceededRegister models.ThresholdExceededData) (string, error) {
-
-	functions := getBuildContentFunctions()
-	if function, exists := functions[dataPayload.Parameter]; exists {
-		emailContent := function(dataPayload.IDDevice, float64(*setting.ThresholdValue), exceededRegister)
-		return emailContent, nil
-	} else {
+	parameter, exists := parameters.Lookup(dataPayload.Parameter)
+	if !exists || parameter.Threshold == nil {
 		return "", errors.New("function not found")
 	}
-}
-
-func buildContentCPUTemperature(id_device string, threshold float64, exceededRegister models.ThresholdExceededData) string {
-	emailContent := fmt.Sprintf(
-		"El sensor %s en el dispositivo %s reportó %.2f °C, superando el umbral definido de %.2f °C",
-		exceededRegister.Key, id_device, exceededRegister.Value, threshold)
-	return emailContent
-}
-
-func buildContentDiskUsage(id_device string, threshold float64, exceededRegister models.ThresholdExceededData) string {
-	emailContent := fmt.Sprintf(
-		"El disco %s en el dispositivo %s reportó un uso del %.2f %%, superando el umbral definido de %.2f %%",
-		exceededRegister.Key, id_device, exceededRegister.Value, threshold)
-	return emailContent
-}
-
-func buildContentRAMUsage(id_device string, threshold float64, exceededRegister models.ThresholdExceededData) string {
-	emailContent := fmt.Sprintf(
-		"El dispositivo %s reportó un uso de RAM de %.2f %%, superando el umbral definido de %.2f %%",
-		id_device, exceededRegister.Value, threshold)
-	return emailContent
-}
-
-func buildContentCPUUsage(id_device string, threshold float64, exceededRegister models.ThresholdExceededData) string {
-	emailContent := fmt.Sprintf(
-		"El dispositivo %s reportó un uso de CPU de %.2f %%, superando el umbral definido de %.2f %%",
-		id_device, exceededRegister.Value, threshold)
-	return emailContent
-}
-
-func buildContentLoadAverage(id_device string, threshold float64, exceededRegister models.ThresholdExceededData) string {
-	emailContent := fmt.Sprintf(
-		"El dispositivo %s reportó una carga de CPU de %.2f %%, superando el umbral definido de %.2f %%",
-		id_device, exceededRegister.Value, threshold)
-	return emailContent
-}
-
-type FuncType func(id_device string, threshold float64, exceededRegister models.ThresholdExceededData) string
-
-func getBuildContentFunctions() map[string]FuncType {
-	return map[string]FuncType{
-		"ram":          buildContentRAMUsage,
-		"disk":         buildContentDiskUsage,
-		"cpu_temp":     buildContentCPUTemperature,
-		"cpu_usage":    buildContentCPUUsage,
-		"load_average": buildContentLoadAverage,
-	}
+	return parameter.Message(dataPayload.IDDevice, exceededRegister.Key, exceededRegister.Value, *setting.ThresholdValue), nil
 }
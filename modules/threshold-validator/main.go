@@ -6,24 +6,37 @@ import (
 	"ceiot-tf-background/modules/threshold-validator/mail"
 	"ceiot-tf-background/modules/threshold-validator/models"
 	"ceiot-tf-background/modules/threshold-validator/postgres"
+	"ceiot-tf-background/modules/utils/deadletter"
+	"ceiot-tf-background/modules/utils/events"
 	"ceiot-tf-background/modules/utils/kafka"
+	"ceiot-tf-background/modules/utils/metrics"
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
-	"encoding/json"
 	"log"
+
+	"github.com/jackc/pgx/v5"
 )
 
 var (
-	err error
-	cfg *models.Config
+	err           error
+	cfg           *models.Config
+	kafkaConsumer *kafka.Consumer
+	kafkaProducer *kafka.Producer
+	metricsServer *http.Server
+	stopCleanup   = make(chan struct{})
 )
 
 func main() {
 	loadConfiguration()
-	startKafkaClient()
 	initializeDatabase()
-	defer postgres.CloseDB()
-	select {}
+	startKafkaClient()
+	waitForShutdown()
 }
 
 func loadConfiguration() {
@@ -34,7 +47,45 @@ func loadConfiguration() {
 }
 
 func startKafkaClient() {
-	go kafka.InitializeReader(cfg.KafkaBrokers, cfg.KafkaGroupID, cfg.KafkaTopics, kafkaHandleMessage)
+	kafkaClient, err := kafka.NewClient(kafka.ClientOptions{
+		Brokers:  cfg.KafkaBrokers,
+		ClientID: cfg.KafkaClientID,
+		Security: cfg.KafkaSecurity,
+	})
+	if err != nil {
+		log.Fatalf("Failed to create Kafka client: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := kafkaClient.EnsureTopics(ctx, cfg.KafkaTopicSpecs...); err != nil {
+		log.Fatalf("Failed to prepare Kafka topics: %v", err)
+	}
+
+	kafkaProducer = kafkaClient.NewProducer(kafka.ProducerOptions{})
+	metricsRegistry := metrics.NewRegistry()
+	deadLetters := deadletter.New(deadletter.Options{
+		Service:  cfg.ServiceName,
+		Producer: kafkaProducer,
+		Fallback: postgres.DeadLetterStore(),
+	})
+
+	kafkaConsumer = kafkaClient.NewConsumer(kafka.ConsumerOptions{
+		GroupID:      cfg.KafkaGroupID,
+		Topics:       cfg.KafkaTopics,
+		Retry:        cfg.KafkaRetry,
+		Park:         deadLetters.Park,
+		Metrics:      kafka.NewPrometheusMetrics(metricsRegistry, cfg.KafkaGroupID),
+		LagThreshold: cfg.KafkaLagThreshold,
+		LagInterval:  cfg.KafkaLagInterval,
+		// Readings are keyed by device, so each device is still handled in order.
+		Concurrency: cfg.KafkaConsumerConcurrency,
+	})
+	kafkaConsumer.Start(context.Background(), kafkaHandleMessage)
+
+	metricsServer = metrics.Serve(cfg.MetricsAddr, metricsRegistry, map[string]metrics.HealthCheck{
+		"kafka-consumer": kafkaConsumer.Health,
+	})
 }
 
 func initializeDatabase() {
@@ -42,76 +93,167 @@ func initializeDatabase() {
 	if err != nil {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := postgres.EnsureDeadLetterTable(ctx); err != nil {
+		log.Fatalf("Failed to prepare dead letters: %v", err)
+	}
+	if err := postgres.EnsureProcessedTable(ctx); err != nil {
+		log.Fatalf("Failed to prepare processed messages: %v", err)
+	}
+	go cleanupProcessedMessages()
 }
 
-func kafkaHandleMessage(topic string, message []byte) {
-	if topic != cfg.KafkaTopics[0] {
-		return
+// cleanupProcessedMessages forgets, once an hour, the message IDs older than
+// the retention, by then Kafka no longer redelivers those messages.
+func cleanupProcessedMessages() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopCleanup:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			deleted, err := postgres.DeleteProcessedMessages(ctx, time.Now().UTC().Add(-cfg.ProcessedRetention))
+			cancel()
+			if err != nil {
+				log.Printf("Error cleaning up processed messages: %v", err)
+				continue
+			}
+			if deleted > 0 {
+				log.Printf("Deleted %d processed message(s)\n", deleted)
+			}
+		}
 	}
+}
 
-	dataPayload, err := parseKafkaMessage(message)
+func waitForShutdown() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+	log.Println("Shutting down")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	close(stopCleanup)
+	if err := metricsServer.Shutdown(ctx); err != nil {
+		log.Printf("Error stopping metrics server: %v", err)
+	}
+	if err := kafkaConsumer.Close(ctx); err != nil {
+		log.Printf("Error closing Kafka consumer: %v", err)
+	}
+	if err := kafkaProducer.Close(ctx); err != nil {
+		log.Printf("Error closing Kafka producer: %v", err)
+	}
+	postgres.CloseDB()
+}
+
+func kafkaHandleMessage(ctx context.Context, msg kafka.Message) error {
+	if msg.Topic != cfg.KafkaTopics[0] {
+		return nil
+	}
+
+	dataPayload, err := parseKafkaMessage(msg)
 	if err != nil {
-		return
+		return kafka.Permanent(err)
 	}
 
-	if dataPayload.Data == nil {
-		return
+	if len(dataPayload.Data) == 0 || string(dataPayload.Data) == "null" {
+		return nil
 	}
 
 	oneHourAgo := time.Now().UTC().Add(-1 * time.Hour).Format(time.RFC3339)
 	exists, err := postgres.ExistsRecentAlert(dataPayload.IDDevice, dataPayload.Parameter, oneHourAgo)
 	if err != nil {
 		log.Printf("Error checking recent alert: %v", err)
-		return
+		return err
 	}
 
 	if exists {
 		log.Printf("Recent alert exists for device %s, parameter %s. Skipping...", dataPayload.IDDevice, dataPayload.Parameter)
-		return
+		return nil
 	}
 
 	setting, err := postgres.GetParamater(dataPayload.IDDevice, dataPayload.Parameter)
 	if err != nil {
-		return
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil
+		}
+		return err
 	}
 
 	if !setting.HasThreshold {
-		return
+		return nil
 	}
 
 	thresholdExceededData, err := evaluator.GetThresholdExceededData(setting, dataPayload)
 	if err != nil {
-		return
+		return kafka.Permanent(err)
 	}
 
 	if len(thresholdExceededData) == 0 {
 		log.Printf("No exceeded data")
-		return
+		return nil
 	}
 
-	sendNotificationsAndLog(dataPayload, setting, thresholdExceededData)
+	return sendNotificationsAndLog(msg.Headers[kafka.HeaderMessageID], dataPayload, setting, thresholdExceededData)
 }
 
+// sendNotificationsAndLog alerts on every exceeded register. Each register is
+// claimed for the message ID before its notification is sent, so a message
+// redelivered by Kafka, even while the first delivery is still running, does
+// not send its notifications again.
 func sendNotificationsAndLog(
+	messageID string,
 	dataPayload models.DataPayload,
 	setting models.DeviceReadingSetting,
-	thresholdExceededData []models.ThresholdExceededData) {
+	thresholdExceededData []models.ThresholdExceededData) error {
 	for _, exceededRegister := range thresholdExceededData {
+		if messageID != "" {
+			claimed, err := postgres.ClaimProcessedAlert(messageID, exceededRegister.Key)
+			if err != nil {
+				return err
+			}
+			if !claimed {
+				log.Printf("Alert for message %s already processed. Skipping...", messageID)
+				continue
+			}
+		}
+
 		emailContent, err := mail.BuildContent(dataPayload, setting, exceededRegister)
 		if err != nil {
+			releaseProcessedAlert(messageID, exceededRegister.Key)
 			continue
 		}
 		sentEmail := mail.SendNotification(cfg.SmtpConfig, emailContent)
 		err = postgres.InsertLog(dataPayload, setting, exceededRegister, sentEmail)
 		if err != nil {
 			log.Println(err)
+			// A sent notification keeps its claim, it must not go out twice.
+			if !sentEmail {
+				releaseProcessedAlert(messageID, exceededRegister.Key)
+			}
 		}
 	}
+	return nil
+}
+
+func releaseProcessedAlert(messageID, key string) {
+	if messageID == "" {
+		return
+	}
+	if err := postgres.ReleaseProcessedAlert(messageID, key); err != nil {
+		log.Println(err)
+	}
 }
 
-func parseKafkaMessage(message []byte) (models.DataPayload, error) {
-	var kafkaMessage models.DataPayload
-	if err := json.Unmarshal(message, &kafkaMessage); err != nil {
+func parseKafkaMessage(msg kafka.Message) (models.DataPayload, error) {
+	kafkaMessage, _, err := events.Decode[models.DataPayload](msg)
+	if err != nil {
 		log.Printf("Error parsing kafka message: %v", err)
 		return models.DataPayload{}, err
 	}
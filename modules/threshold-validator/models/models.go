@@ -1,21 +1,37 @@
 package models
 
+import (
+	"encoding/json"
+	"time"
+
+	"ceiot-tf-background/modules/utils/kafka"
+)
+
 type Config struct {
-	KafkaClientID string
-	KafkaGroupID  string
-	KafkaBrokers  []string
-	KafkaTopics   []string
-	PostgresURL   string
-	SmtpConfig    SmtpConfig
-	SmtpTo        string
-	SmtpCc        string
+	ServiceName              string
+	KafkaClientID            string
+	KafkaGroupID             string
+	KafkaBrokers             []string
+	KafkaSecurity            kafka.SecurityOptions
+	KafkaTopics              []string
+	KafkaTopicSpecs          []kafka.TopicSpec
+	KafkaRetry               kafka.RetryOptions
+	KafkaConsumerConcurrency int
+	KafkaLagThreshold        int64
+	KafkaLagInterval         time.Duration
+	MetricsAddr              string
+	ProcessedRetention       time.Duration
+	PostgresURL              string
+	SmtpConfig               SmtpConfig
+	SmtpTo                   string
+	SmtpCc                   string
 }
 
 type DataPayload struct {
-	IDDevice       string `json:"IDDevice"`
-	Parameter      string `json:"Parameter"`
-	Data           any    `json:"Data"`
-	CollectedAtUtc string `json:"CollectedAtUtc"`
+	IDDevice       string          `json:"IDDevice"`
+	Parameter      string          `json:"Parameter"`
+	Data           json.RawMessage `json:"Data"`
+	CollectedAtUtc string          `json:"CollectedAtUtc"`
 }
 
 type DeviceReadingSetting struct {
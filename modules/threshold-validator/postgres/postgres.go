@@ -2,12 +2,16 @@ package postgres
 
 import (
 	"ceiot-tf-background/modules/threshold-validator/models"
+	"ceiot-tf-background/modules/utils/deadletter"
+	"ceiot-tf-background/modules/utils/parameters"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"time"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
@@ -99,86 +103,104 @@ func InsertLog(dataPayload models.DataPayload, setting models.DeviceReadingSetti
 }
 
 func buildQueryToGetIdRef(dataPayload models.DataPayload, setting models.DeviceReadingSetting, exceededRegister models.ThresholdExceededData) (string, []interface{}, error) {
-	functions := getBuildQueryToGetIdRefFunctions()
-	if function, exists := functions[dataPayload.Parameter]; exists {
-		query, args := function(dataPayload, setting, exceededRegister)
-		return query, args, nil
-	} else {
+	parameter, exists := parameters.Lookup(dataPayload.Parameter)
+	if !exists || parameter.Threshold == nil {
 		return "", nil, errors.New("function not found")
 	}
-}
 
-func buildQueryToGetIdRefCPUTemperature(dataPayload models.DataPayload, setting models.DeviceReadingSetting, exceededRegister models.ThresholdExceededData) (string, []interface{}) {
-	query := `
-		SELECT ID FROM %s WHERE ID_DEVICE = $1 AND SENSOR_KEY = $2 AND COLLECTED_AT_UTC = $3
-	`
-	query = fmt.Sprintf(query, setting.TablePointer)
-	args := []interface{}{dataPayload.IDDevice, exceededRegister.Key, dataPayload.CollectedAtUtc}
-	return query, args
-}
+	// Readings stored before natural keys existed may be duplicated, the first one is the reference.
+	if parameter.Dimension == nil {
+		query := fmt.Sprintf(`
+		SELECT ID FROM %s WHERE ID_DEVICE = $1 AND COLLECTED_AT_UTC = $2 ORDER BY ID LIMIT 1
+	`, setting.TablePointer)
+		return query, []interface{}{dataPayload.IDDevice, dataPayload.CollectedAtUtc}, nil
+	}
 
-func buildQueryToGetIdRefDiskUsage(dataPayload models.DataPayload, setting models.DeviceReadingSetting, exceededRegister models.ThresholdExceededData) (string, []interface{}) {
-	query := `
-		SELECT ID FROM %s WHERE ID_DEVICE = $1 AND DISK_NAME = $2 AND COLLECTED_AT_UTC = $3
-	`
-	query = fmt.Sprintf(query, setting.TablePointer)
-	args := []interface{}{dataPayload.IDDevice, exceededRegister.Key, dataPayload.CollectedAtUtc}
-	return query, args
+	query := fmt.Sprintf(`
+		SELECT ID FROM %s WHERE ID_DEVICE = $1 AND %s = $2 AND COLLECTED_AT_UTC = $3 ORDER BY ID LIMIT 1
+	`, setting.TablePointer, parameter.Dimension.Column)
+	return query, []interface{}{dataPayload.IDDevice, exceededRegister.Key, dataPayload.CollectedAtUtc}, nil
 }
 
-func buildQueryToGetIdRefRAMUsage(dataPayload models.DataPayload, setting models.DeviceReadingSetting, exceededRegister models.ThresholdExceededData) (string, []interface{}) {
+func ExistsRecentAlert(id_device, id_parameter, sinceUTC string) (bool, error) {
 	query := `
-		SELECT ID FROM %s WHERE ID_DEVICE = $1 AND COLLECTED_AT_UTC = $2
+		SELECT EXISTS (
+			SELECT 1 FROM THRESHOLD_ALERTS 
+			WHERE ID_DEVICE = $1 
+			AND ID_PARAMETER = $2 
+			AND EMAIL_SENT = true 
+			AND CREATED_AT_UTC >= $3
+		)
 	`
-	query = fmt.Sprintf(query, setting.TablePointer)
-	args := []interface{}{dataPayload.IDDevice, dataPayload.CollectedAtUtc}
-	return query, args
+	var exists bool
+	err := db.QueryRow(context.Background(), query, id_device, id_parameter, sinceUTC).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("error checking recent alert existence: %w", err)
+	}
+	return exists, nil
 }
 
-func buildQueryToGetIdRefCPUUsage(dataPayload models.DataPayload, setting models.DeviceReadingSetting, exceededRegister models.ThresholdExceededData) (string, []interface{}) {
+func EnsureProcessedTable(ctx context.Context) error {
 	query := `
-		SELECT ID FROM %s WHERE ID_DEVICE = $1 AND COLLECTED_AT_UTC = $2
+		CREATE TABLE IF NOT EXISTS PROCESSED_MESSAGES (
+			MESSAGE_ID TEXT NOT NULL,
+			ALERT_KEY TEXT NOT NULL,
+			PROCESSED_AT_UTC TIMESTAMP NOT NULL,
+			PRIMARY KEY (MESSAGE_ID, ALERT_KEY)
+		)
 	`
-	query = fmt.Sprintf(query, setting.TablePointer)
-	args := []interface{}{dataPayload.IDDevice, dataPayload.CollectedAtUtc}
-	return query, args
+
+	if _, err := db.Exec(ctx, query); err != nil {
+		return fmt.Errorf("error creating PROCESSED_MESSAGES: %w", err)
+	}
+	return nil
 }
 
-func buildQueryToGetIdRefLoadAverage(dataPayload models.DataPayload, setting models.DeviceReadingSetting, exceededRegister models.ThresholdExceededData) (string, []interface{}) {
+// ClaimProcessedAlert records that the alert for key of the message with the
+// given message-id header is being processed. It reports false when another
+// delivery of the message already claimed it.
+func ClaimProcessedAlert(messageID, key string) (bool, error) {
 	query := `
-		SELECT ID FROM %s WHERE ID_DEVICE = $1 AND COLLECTED_AT_UTC = $2
+		INSERT INTO PROCESSED_MESSAGES (MESSAGE_ID, ALERT_KEY, PROCESSED_AT_UTC)
+		VALUES ($1, $2, $3)
+		ON CONFLICT DO NOTHING
+		RETURNING MESSAGE_ID
 	`
-	query = fmt.Sprintf(query, setting.TablePointer)
-	args := []interface{}{dataPayload.IDDevice, dataPayload.CollectedAtUtc}
-	return query, args
+	var claimed string
+	err := db.QueryRow(context.Background(), query, messageID, key, time.Now().UTC()).Scan(&claimed)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error inserting into PROCESSED_MESSAGES: %w", err)
+	}
+	return true, nil
 }
 
-type FuncType func(dataPayload models.DataPayload, setting models.DeviceReadingSetting, exceededRegister models.ThresholdExceededData) (string, []interface{})
-
-func getBuildQueryToGetIdRefFunctions() map[string]FuncType {
-	return map[string]FuncType{
-		"ram":          buildQueryToGetIdRefRAMUsage,
-		"disk":         buildQueryToGetIdRefDiskUsage,
-		"cpu_temp":     buildQueryToGetIdRefCPUTemperature,
-		"cpu_usage":    buildQueryToGetIdRefCPUUsage,
-		"load_average": buildQueryToGetIdRefLoadAverage,
+// ReleaseProcessedAlert drops a claim whose alert was not notified, so a
+// redelivery of the message can try again.
+func ReleaseProcessedAlert(messageID, key string) error {
+	query := "DELETE FROM PROCESSED_MESSAGES WHERE MESSAGE_ID = $1 AND ALERT_KEY = $2"
+	if _, err := db.Exec(context.Background(), query, messageID, key); err != nil {
+		return fmt.Errorf("error deleting from PROCESSED_MESSAGES: %w", err)
 	}
+	return nil
 }
 
-func ExistsRecentAlert(id_device, id_parameter, sinceUTC string) (bool, error) {
-	query := `
-		SELECT EXISTS (
-			SELECT 1 FROM THRESHOLD_ALERTS 
-			WHERE ID_DEVICE = $1 
-			AND ID_PARAMETER = $2 
-			AND EMAIL_SENT = true 
-			AND CREATED_AT_UTC >= $3
-		)
-	`
-	var exists bool
-	err := db.QueryRow(context.Background(), query, id_device, id_parameter, sinceUTC).Scan(&exists)
+// DeleteProcessedMessages forgets the messages processed before the given
+// time, which Kafka no longer redelivers.
+func DeleteProcessedMessages(ctx context.Context, before time.Time) (int64, error) {
+	result, err := db.Exec(ctx, "DELETE FROM PROCESSED_MESSAGES WHERE PROCESSED_AT_UTC < $1", before)
 	if err != nil {
-		return false, fmt.Errorf("error checking recent alert existence: %w", err)
+		return 0, fmt.Errorf("error deleting from PROCESSED_MESSAGES: %w", err)
 	}
-	return exists, nil
+	return result.RowsAffected(), nil
+}
+
+func EnsureDeadLetterTable(ctx context.Context) error {
+	return deadletter.EnsureTable(ctx, db)
+}
+
+func DeadLetterStore() deadletter.Store {
+	return deadletter.PostgresStore(db)
 }
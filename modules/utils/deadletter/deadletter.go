@@ -0,0 +1,174 @@
+package deadletter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"ceiot-tf-background/modules/utils/kafka"
+)
+
+const (
+	TransportKafka = "kafka"
+	TransportMQTT  = "mqtt"
+
+	HeaderService         = "dlq-service"
+	HeaderSourceTransport = "dlq-source-transport"
+	HeaderSourceTopic     = "dlq-source-topic"
+	HeaderError           = "dlq-error"
+	HeaderFailedAt        = "dlq-failed-at"
+
+	headerPrefix = "dlq-"
+	topicSuffix  = ".dlq"
+)
+
+type Entry struct {
+	Service         string
+	SourceTransport string
+	SourceTopic     string
+	Key             []byte
+	Payload         []byte
+	// Headers are the headers of the original message, such as the envelope
+	// content type and the message id, given back to it on replay.
+	Headers     map[string]string
+	Error       string
+	FailedAtUtc time.Time
+}
+
+// Store persists entries that could not be written to the dead-letter topic.
+type Store func(ctx context.Context, entry Entry) error
+
+type Options struct {
+	Service  string
+	Topic    string
+	Producer *kafka.Producer
+	Fallback Store
+}
+
+type Queue struct {
+	service  string
+	topic    string
+	producer *kafka.Producer
+	fallback Store
+}
+
+func New(opts Options) *Queue {
+	return &Queue{
+		service:  opts.Service,
+		topic:    opts.Topic,
+		producer: opts.Producer,
+		fallback: opts.Fallback,
+	}
+}
+
+func TopicFor(sourceTopic string) string {
+	return sourceTopic + topicSuffix
+}
+
+func (q *Queue) Send(ctx context.Context, entry Entry) error {
+	if entry.Service == "" {
+		entry.Service = q.service
+	}
+	if entry.FailedAtUtc.IsZero() {
+		entry.FailedAtUtc = time.Now().UTC()
+	}
+
+	topic := q.topic
+	if topic == "" {
+		topic = TopicFor(entry.SourceTopic)
+	}
+
+	var publishErr error
+	if q.producer != nil {
+		publishErr = q.producer.Publish(ctx, ToMessage(topic, entry))
+		if publishErr == nil {
+			log.Printf("Dead letter from %s written to topic %s\n", entry.SourceTopic, topic)
+			return nil
+		}
+	} else {
+		publishErr = errors.New("no dead-letter producer configured")
+	}
+
+	if q.fallback == nil {
+		return fmt.Errorf("failed to write dead letter to topic %s: %w", topic, publishErr)
+	}
+
+	if err := q.fallback(ctx, entry); err != nil {
+		return errors.Join(
+			fmt.Errorf("failed to write dead letter to topic %s: %w", topic, publishErr),
+			fmt.Errorf("failed to store dead letter: %w", err))
+	}
+
+	log.Printf("Dead letter from %s stored in fallback store: %v\n", entry.SourceTopic, publishErr)
+	return nil
+}
+
+// Park adapts the queue to kafka.ConsumerOptions.Park.
+func (q *Queue) Park(ctx context.Context, msg kafka.Message, cause error) error {
+	return q.Send(ctx, Entry{
+		SourceTransport: TransportKafka,
+		SourceTopic:     msg.Topic,
+		Key:             msg.Key,
+		Payload:         msg.Value,
+		Headers:         msg.Headers,
+		Error:           cause.Error(),
+	})
+}
+
+// ToMessage keeps the original headers of entry next to the dlq- headers
+// that describe the failure.
+func ToMessage(topic string, entry Entry) kafka.Message {
+	headers := make(map[string]string, len(entry.Headers)+5)
+	for key, value := range entry.Headers {
+		headers[key] = value
+	}
+	headers[HeaderService] = entry.Service
+	headers[HeaderSourceTransport] = entry.SourceTransport
+	headers[HeaderSourceTopic] = entry.SourceTopic
+	headers[HeaderError] = entry.Error
+	headers[HeaderFailedAt] = entry.FailedAtUtc.Format(time.RFC3339Nano)
+
+	return kafka.Message{
+		Topic:   topic,
+		Key:     entry.Key,
+		Value:   entry.Payload,
+		Headers: headers,
+	}
+}
+
+func FromMessage(msg kafka.Message) (Entry, error) {
+	sourceTopic := msg.Headers[HeaderSourceTopic]
+	if sourceTopic == "" {
+		return Entry{}, fmt.Errorf("message at offset %d is not a dead letter: missing %s header", msg.Offset, HeaderSourceTopic)
+	}
+
+	failedAt, err := time.Parse(time.RFC3339Nano, msg.Headers[HeaderFailedAt])
+	if err != nil {
+		failedAt = msg.Time
+	}
+
+	var headers map[string]string
+	for key, value := range msg.Headers {
+		if strings.HasPrefix(key, headerPrefix) {
+			continue
+		}
+		if headers == nil {
+			headers = map[string]string{}
+		}
+		headers[key] = value
+	}
+
+	return Entry{
+		Service:         msg.Headers[HeaderService],
+		SourceTransport: msg.Headers[HeaderSourceTransport],
+		SourceTopic:     sourceTopic,
+		Key:             msg.Key,
+		Payload:         msg.Value,
+		Headers:         headers,
+		Error:           msg.Headers[HeaderError],
+		FailedAtUtc:     failedAt,
+	}, nil
+}
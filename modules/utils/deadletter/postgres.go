@@ -0,0 +1,69 @@
+package deadletter
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// EnsureTable creates the DEAD_LETTERS table that PostgresStore writes to
+// and ceiot-admin dlq --table replays from.
+func EnsureTable(ctx context.Context, db *pgxpool.Pool) error {
+	query := `
+		CREATE TABLE IF NOT EXISTS DEAD_LETTERS (
+			ID SERIAL PRIMARY KEY,
+			SERVICE TEXT NOT NULL,
+			SOURCE_TRANSPORT TEXT NOT NULL,
+			SOURCE_TOPIC TEXT NOT NULL,
+			MESSAGE_KEY BYTEA,
+			PAYLOAD BYTEA,
+			HEADERS JSONB,
+			ERROR TEXT NOT NULL,
+			FAILED_AT_UTC TIMESTAMP NOT NULL,
+			REPLAYED_AT_UTC TIMESTAMP
+		)
+	`
+
+	if _, err := db.Exec(ctx, query); err != nil {
+		return fmt.Errorf("error creating DEAD_LETTERS: %w", err)
+	}
+
+	// Tables created before the original headers were kept lack the column.
+	query = "ALTER TABLE DEAD_LETTERS ADD COLUMN IF NOT EXISTS HEADERS JSONB"
+	if _, err := db.Exec(ctx, query); err != nil {
+		return fmt.Errorf("error adding HEADERS to DEAD_LETTERS: %w", err)
+	}
+	return nil
+}
+
+// PostgresStore returns a Store that inserts entries into DEAD_LETTERS, for
+// use as the fallback when the dead-letter topic cannot be written.
+func PostgresStore(db *pgxpool.Pool) Store {
+	return func(ctx context.Context, entry Entry) error {
+		query := `
+			INSERT INTO DEAD_LETTERS (
+				SERVICE, SOURCE_TRANSPORT, SOURCE_TOPIC, MESSAGE_KEY, PAYLOAD, HEADERS, ERROR, FAILED_AT_UTC
+			) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		`
+
+		_, err := db.Exec(
+			ctx,
+			query,
+			entry.Service,
+			entry.SourceTransport,
+			entry.SourceTopic,
+			entry.Key,
+			entry.Payload,
+			entry.Headers,
+			entry.Error,
+			entry.FailedAtUtc)
+		if err != nil {
+			return fmt.Errorf("error inserting into DEAD_LETTERS: %w", err)
+		}
+
+		log.Printf("Dead letter from %s inserted into DEAD_LETTERS\n", entry.SourceTopic)
+		return nil
+	}
+}
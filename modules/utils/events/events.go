@@ -0,0 +1,125 @@
+package events
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"ceiot-tf-background/modules/utils/kafka"
+)
+
+const (
+	SchemaVersion   = 1
+	ContentTypeJSON = "application/json"
+
+	HeaderContentType   = "content-type"
+	HeaderSchemaVersion = "schema-version"
+	HeaderDeviceID      = "device-id"
+	HeaderIngestedAt    = "ingest-timestamp"
+	HeaderTraceID       = "trace-id"
+)
+
+type Metadata struct {
+	SchemaVersion int
+	DeviceID      string
+	SourceTopic   string
+	ReceivedAtUtc time.Time
+	TraceID       string
+}
+
+type Envelope[T any] struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	DeviceID      string `json:"deviceId"`
+	SourceTopic   string `json:"sourceTopic"`
+	ReceivedAtUtc string `json:"receivedAtUtc"`
+	TraceID       string `json:"traceId"`
+	Payload       T      `json:"payload"`
+}
+
+func NewTraceID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(id)
+}
+
+// Encode wraps payload in the current envelope version and mirrors its
+// metadata in the message headers.
+func Encode[T any](topic string, meta Metadata, payload T) (kafka.Message, error) {
+	if meta.ReceivedAtUtc.IsZero() {
+		meta.ReceivedAtUtc = time.Now().UTC()
+	}
+	if meta.TraceID == "" {
+		meta.TraceID = NewTraceID()
+	}
+	receivedAt := meta.ReceivedAtUtc.UTC().Format(time.RFC3339Nano)
+
+	value, err := json.Marshal(Envelope[T]{
+		SchemaVersion: SchemaVersion,
+		DeviceID:      meta.DeviceID,
+		SourceTopic:   meta.SourceTopic,
+		ReceivedAtUtc: receivedAt,
+		TraceID:       meta.TraceID,
+		Payload:       payload,
+	})
+	if err != nil {
+		return kafka.Message{}, fmt.Errorf("error encoding envelope: %w", err)
+	}
+
+	return kafka.Message{
+		Topic: topic,
+		Value: value,
+		Headers: map[string]string{
+			HeaderContentType:   ContentTypeJSON,
+			HeaderSchemaVersion: strconv.Itoa(SchemaVersion),
+			HeaderDeviceID:      meta.DeviceID,
+			HeaderIngestedAt:    receivedAt,
+			HeaderTraceID:       meta.TraceID,
+		},
+	}, nil
+}
+
+// Decode accepts both enveloped messages and the legacy raw payloads that were
+// published before the envelope existed. Legacy messages get SchemaVersion 0.
+func Decode[T any](msg kafka.Message) (T, Metadata, error) {
+	var payload T
+
+	var probe struct {
+		SchemaVersion *int `json:"schemaVersion"`
+	}
+	if err := json.Unmarshal(msg.Value, &probe); err != nil {
+		return payload, Metadata{}, fmt.Errorf("error decoding message: %w", err)
+	}
+
+	if probe.SchemaVersion == nil {
+		if err := json.Unmarshal(msg.Value, &payload); err != nil {
+			return payload, Metadata{}, fmt.Errorf("error decoding legacy message: %w", err)
+		}
+		return payload, Metadata{
+			DeviceID: msg.Headers[HeaderDeviceID],
+			TraceID:  msg.Headers[HeaderTraceID],
+		}, nil
+	}
+
+	if *probe.SchemaVersion < 1 || *probe.SchemaVersion > SchemaVersion {
+		return payload, Metadata{}, fmt.Errorf("unsupported envelope schema version %d", *probe.SchemaVersion)
+	}
+
+	var envelope Envelope[T]
+	if err := json.Unmarshal(msg.Value, &envelope); err != nil {
+		return payload, Metadata{}, fmt.Errorf("error decoding envelope: %w", err)
+	}
+
+	receivedAt, _ := time.Parse(time.RFC3339Nano, envelope.ReceivedAtUtc)
+	return envelope.Payload, Metadata{
+		SchemaVersion: envelope.SchemaVersion,
+		DeviceID:      envelope.DeviceID,
+		SourceTopic:   envelope.SourceTopic,
+		ReceivedAtUtc: receivedAt,
+		TraceID:       envelope.TraceID,
+	}, nil
+}
@@ -0,0 +1,285 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"ceiot-tf-background/modules/utils/env"
+
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	CleanupPolicyDelete  = "delete"
+	CleanupPolicyCompact = "compact"
+
+	configRetentionMs   = "retention.ms"
+	configCleanupPolicy = "cleanup.policy"
+)
+
+type TopicSpec struct {
+	Name              string
+	Partitions        int
+	ReplicationFactor int
+	// Retention below zero keeps messages forever.
+	Retention     time.Duration
+	CleanupPolicy string
+	// AllowDrift only logs an existing topic with fewer partitions or a lower
+	// replication factor than configured, instead of failing.
+	AllowDrift bool
+}
+
+type TopicStatus struct {
+	Name              string
+	Exists            bool
+	Partitions        int
+	ReplicationFactor int
+	Configs           map[string]string
+}
+
+// TopicSpecsFromEnv applies the shared topic settings to every named topic.
+func TopicSpecsFromEnv(names ...string) ([]TopicSpec, error) {
+	partitions, err := env.GetInt("KAFKA_TOPIC_PARTITIONS", 6)
+	if err != nil {
+		return nil, err
+	}
+	replicationFactor, err := env.GetInt("KAFKA_TOPIC_REPLICATION_FACTOR", 1)
+	if err != nil {
+		return nil, err
+	}
+	retention, err := env.GetDuration("KAFKA_TOPIC_RETENTION", 7*24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	cleanupPolicy := env.GetString("KAFKA_TOPIC_CLEANUP_POLICY", CleanupPolicyDelete)
+	allowDrift, err := env.GetBool("KAFKA_TOPICS_ALLOW_DRIFT", false)
+	if err != nil {
+		return nil, err
+	}
+
+	if partitions <= 0 {
+		return nil, fmt.Errorf("invalid KAFKA_TOPIC_PARTITIONS %d: must be positive", partitions)
+	}
+	if replicationFactor <= 0 {
+		return nil, fmt.Errorf("invalid KAFKA_TOPIC_REPLICATION_FACTOR %d: must be positive", replicationFactor)
+	}
+	switch cleanupPolicy {
+	case CleanupPolicyDelete, CleanupPolicyCompact, CleanupPolicyCompact + "," + CleanupPolicyDelete, CleanupPolicyDelete + "," + CleanupPolicyCompact:
+	default:
+		return nil, fmt.Errorf("invalid KAFKA_TOPIC_CLEANUP_POLICY %q", cleanupPolicy)
+	}
+
+	specs := make([]TopicSpec, len(names))
+	for i, name := range names {
+		specs[i] = TopicSpec{
+			Name:              name,
+			Partitions:        partitions,
+			ReplicationFactor: replicationFactor,
+			Retention:         retention,
+			CleanupPolicy:     cleanupPolicy,
+			AllowDrift:        allowDrift,
+		}
+	}
+	return specs, nil
+}
+
+func (s TopicSpec) configs() map[string]string {
+	retentionMs := int64(-1)
+	if s.Retention >= 0 {
+		retentionMs = s.Retention.Milliseconds()
+	}
+	return map[string]string{
+		configRetentionMs:   strconv.FormatInt(retentionMs, 10),
+		configCleanupPolicy: s.CleanupPolicy,
+	}
+}
+
+func (c *Client) admin() *kafka.Client {
+	return &kafka.Client{
+		Addr:      kafka.TCP(c.brokers...),
+		Transport: c.transport,
+	}
+}
+
+func (c *Client) DescribeTopics(ctx context.Context, names ...string) ([]TopicStatus, error) {
+	statuses, _, err := c.describeTopics(ctx, names)
+	return statuses, err
+}
+
+func (c *Client) describeTopics(ctx context.Context, names []string) ([]TopicStatus, int, error) {
+	admin := c.admin()
+
+	metadata, err := admin.Metadata(ctx, &kafka.MetadataRequest{Topics: names})
+	if err != nil {
+		return nil, 0, fmt.Errorf("error reading kafka metadata: %w", err)
+	}
+
+	topics := make(map[string]kafka.Topic, len(metadata.Topics))
+	for _, topic := range metadata.Topics {
+		topics[topic.Name] = topic
+	}
+
+	statuses := make([]TopicStatus, len(names))
+	resources := []kafka.DescribeConfigRequestResource{}
+	for i, name := range names {
+		statuses[i].Name = name
+
+		topic, ok := topics[name]
+		if !ok || errors.Is(topic.Error, kafka.UnknownTopicOrPartition) {
+			continue
+		}
+		if topic.Error != nil {
+			return nil, 0, fmt.Errorf("error reading metadata of topic %s: %w", name, topic.Error)
+		}
+
+		statuses[i].Exists = true
+		statuses[i].Partitions = len(topic.Partitions)
+		if len(topic.Partitions) > 0 {
+			statuses[i].ReplicationFactor = len(topic.Partitions[0].Replicas)
+		}
+		resources = append(resources, kafka.DescribeConfigRequestResource{
+			ResourceType: kafka.ResourceTypeTopic,
+			ResourceName: name,
+			ConfigNames:  []string{configRetentionMs, configCleanupPolicy},
+		})
+	}
+
+	if len(resources) == 0 {
+		return statuses, len(metadata.Brokers), nil
+	}
+
+	described, err := admin.DescribeConfigs(ctx, &kafka.DescribeConfigsRequest{Resources: resources})
+	if err != nil {
+		return nil, 0, fmt.Errorf("error describing kafka topic configs: %w", err)
+	}
+
+	configs := make(map[string]map[string]string, len(described.Resources))
+	for _, resource := range described.Resources {
+		if resource.Error != nil {
+			return nil, 0, fmt.Errorf("error describing configs of topic %s: %w", resource.ResourceName, resource.Error)
+		}
+		entries := make(map[string]string, len(resource.ConfigEntries))
+		for _, entry := range resource.ConfigEntries {
+			entries[entry.ConfigName] = entry.ConfigValue
+		}
+		configs[resource.ResourceName] = entries
+	}
+	for i := range statuses {
+		statuses[i].Configs = configs[statuses[i].Name]
+	}
+
+	return statuses, len(metadata.Brokers), nil
+}
+
+// EnsureTopics creates the missing topics and aligns the retention and cleanup
+// policy of existing ones. Partition counts and replication factors are never
+// changed on existing topics, since that would reshuffle keys between
+// partitions, so a mismatch is reported as an error instead, or only logged
+// for specs that allow drift.
+func (c *Client) EnsureTopics(ctx context.Context, specs ...TopicSpec) error {
+	names := make([]string, len(specs))
+	for i, spec := range specs {
+		names[i] = spec.Name
+	}
+
+	statuses, brokers, err := c.describeTopics(ctx, names)
+	if err != nil {
+		return err
+	}
+
+	var problems []error
+	create := []kafka.TopicConfig{}
+	alter := []kafka.IncrementalAlterConfigsRequestResource{}
+
+	for i, spec := range specs {
+		status := statuses[i]
+
+		if !status.Exists {
+			if spec.ReplicationFactor > brokers {
+				problems = append(problems, fmt.Errorf("topic %s needs replication factor %d but the cluster has %d broker(s)", spec.Name, spec.ReplicationFactor, brokers))
+				continue
+			}
+			topic := kafka.TopicConfig{
+				Topic:             spec.Name,
+				NumPartitions:     spec.Partitions,
+				ReplicationFactor: spec.ReplicationFactor,
+			}
+			for name, value := range spec.configs() {
+				topic.ConfigEntries = append(topic.ConfigEntries, kafka.ConfigEntry{ConfigName: name, ConfigValue: value})
+			}
+			create = append(create, topic)
+			continue
+		}
+
+		drift := []error{}
+		if status.Partitions < spec.Partitions {
+			drift = append(drift, fmt.Errorf("topic %s has %d partition(s), %d configured", spec.Name, status.Partitions, spec.Partitions))
+		}
+		if status.ReplicationFactor < spec.ReplicationFactor {
+			drift = append(drift, fmt.Errorf("topic %s has replication factor %d, %d configured", spec.Name, status.ReplicationFactor, spec.ReplicationFactor))
+		}
+		for _, err := range drift {
+			if !spec.AllowDrift {
+				problems = append(problems, fmt.Errorf("%w, set KAFKA_TOPICS_ALLOW_DRIFT=true to use it as it is", err))
+				continue
+			}
+			log.Printf("Kafka %v, used as it is since drift is allowed\n", err)
+		}
+
+		changes := []kafka.IncrementalAlterConfigsRequestConfig{}
+		for name, value := range spec.configs() {
+			if status.Configs[name] != value {
+				changes = append(changes, kafka.IncrementalAlterConfigsRequestConfig{Name: name, Value: value})
+			}
+		}
+		if len(changes) > 0 {
+			alter = append(alter, kafka.IncrementalAlterConfigsRequestResource{
+				ResourceType: kafka.ResourceTypeTopic,
+				ResourceName: spec.Name,
+				Configs:      changes,
+			})
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("kafka topics do not match the required settings: %w", errors.Join(problems...))
+	}
+
+	admin := c.admin()
+
+	if len(create) > 0 {
+		created, err := admin.CreateTopics(ctx, &kafka.CreateTopicsRequest{Topics: create})
+		if err != nil {
+			return fmt.Errorf("error creating kafka topics: %w", err)
+		}
+		for _, topic := range create {
+			err := created.Errors[topic.Topic]
+			// Another instance may have created it in the meantime.
+			if err != nil && !errors.Is(err, kafka.TopicAlreadyExists) {
+				problems = append(problems, fmt.Errorf("error creating topic %s: %w", topic.Topic, err))
+				continue
+			}
+			log.Printf("Kafka topic %s created with %d partition(s) and replication factor %d\n", topic.Topic, topic.NumPartitions, topic.ReplicationFactor)
+		}
+	}
+
+	if len(alter) > 0 {
+		altered, err := admin.IncrementalAlterConfigs(ctx, &kafka.IncrementalAlterConfigsRequest{Resources: alter})
+		if err != nil {
+			return fmt.Errorf("error updating kafka topic configs: %w", err)
+		}
+		for _, resource := range altered.Resources {
+			if resource.Error != nil {
+				problems = append(problems, fmt.Errorf("error updating configs of topic %s: %w", resource.ResourceName, resource.Error))
+				continue
+			}
+			log.Printf("Kafka topic %s configs updated\n", resource.ResourceName)
+		}
+	}
+
+	return errors.Join(problems...)
+}
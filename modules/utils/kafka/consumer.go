@@ -0,0 +1,304 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+type Handler func(ctx context.Context, msg Message) error
+
+// ParkFunc receives messages that exhausted their retries or failed permanently.
+// The offset is only committed once it returns nil.
+type ParkFunc func(ctx context.Context, msg Message, cause error) error
+
+type ConsumerOptions struct {
+	GroupID  string
+	Topics   []string
+	MinBytes int
+	MaxBytes int
+	Retry    RetryOptions
+	Park     ParkFunc
+	// Concurrency is the number of workers. Messages with the same key always
+	// go to the same worker, so they are handled in order.
+	Concurrency int
+	Metrics     Metrics
+	// LagThreshold marks the consumer unhealthy once any partition lags behind
+	// by more messages. Zero disables the check.
+	LagThreshold int64
+	LagInterval  time.Duration
+}
+
+type Consumer struct {
+	client       *Client
+	reader       *kafka.Reader
+	groupID      string
+	topics       []string
+	retry        RetryOptions
+	park         ParkFunc
+	concurrency  int
+	metrics      Metrics
+	lagThreshold int64
+	lagInterval  time.Duration
+	lag          lagState
+	cancel       context.CancelFunc
+	done         chan struct{}
+	mu           sync.Mutex
+}
+
+func (c *Client) NewConsumer(opts ConsumerOptions) *Consumer {
+	if opts.MinBytes == 0 {
+		opts.MinBytes = 10e2 // 1KB
+	}
+	if opts.MaxBytes == 0 {
+		opts.MaxBytes = 10e6 // 10MB
+	}
+
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:     c.brokers,
+		GroupID:     opts.GroupID,
+		GroupTopics: opts.Topics,
+		Dialer:      c.dialer,
+		MinBytes:    opts.MinBytes,
+		MaxBytes:    opts.MaxBytes,
+	})
+
+	park := opts.Park
+	if park == nil {
+		park = logParkedMessage
+	}
+
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	metrics := opts.Metrics
+	if metrics == nil {
+		metrics = noopMetrics{}
+	}
+
+	lagInterval := opts.LagInterval
+	if lagInterval <= 0 {
+		lagInterval = 15 * time.Second
+	}
+
+	log.Printf("Kafka consumer initialized for group %s and topics %v (workers: %d)\n", opts.GroupID, opts.Topics, concurrency)
+	return &Consumer{
+		client:       c,
+		reader:       reader,
+		groupID:      opts.GroupID,
+		topics:       opts.Topics,
+		retry:        opts.Retry.withDefaults(consumerRetryDefaults),
+		park:         park,
+		concurrency:  concurrency,
+		metrics:      metrics,
+		lagThreshold: opts.LagThreshold,
+		lagInterval:  lagInterval,
+	}
+}
+
+func (c *Consumer) Start(ctx context.Context, handle Handler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.done != nil {
+		log.Println("Kafka consumer is already started")
+		return
+	}
+
+	ctx, c.cancel = context.WithCancel(ctx)
+	c.done = make(chan struct{})
+	go c.listen(ctx, handle)
+	go c.monitorLag(ctx)
+}
+
+func (c *Consumer) listen(ctx context.Context, handle Handler) {
+	defer close(c.done)
+
+	// In-flight handlers must be allowed to finish while the consumer drains.
+	handlerCtx := context.WithoutCancel(ctx)
+
+	offsets := newOffsetTracker()
+	completed := make(chan kafka.Message, c.concurrency)
+	committed := make(chan struct{})
+	go func() {
+		defer close(committed)
+		c.commit(handlerCtx, offsets, completed)
+	}()
+
+	var workers sync.WaitGroup
+	queues := make([]chan kafka.Message, c.concurrency)
+	for i := range queues {
+		queues[i] = make(chan kafka.Message, workerQueueSize)
+		workers.Add(1)
+		go func(queue <-chan kafka.Message) {
+			defer workers.Done()
+			c.work(ctx, handlerCtx, queue, completed, handle)
+		}(queues[i])
+	}
+
+	defer func() {
+		for _, queue := range queues {
+			close(queue)
+		}
+		workers.Wait()
+		close(completed)
+		<-committed
+	}()
+
+	for {
+		m, err := c.reader.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Error fetching message: %v\n", err)
+			c.metrics.ConsumerError("", OperationFetch)
+			if !sleep(ctx, 2*time.Second) {
+				return
+			}
+			continue
+		}
+
+		offsets.track(m)
+
+		select {
+		case queues[c.workerFor(m)] <- m:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+const workerQueueSize = 16
+
+func (c *Consumer) workerFor(m kafka.Message) int {
+	if c.concurrency == 1 {
+		return 0
+	}
+
+	hash := fnv.New32a()
+	if len(m.Key) > 0 {
+		hash.Write(m.Key)
+	} else {
+		// Without a key, order can only be kept per partition.
+		fmt.Fprintf(hash, "%s/%d", m.Topic, m.Partition)
+	}
+	return int(hash.Sum32() % uint32(c.concurrency))
+}
+
+func (c *Consumer) work(ctx context.Context, handlerCtx context.Context, queue <-chan kafka.Message, completed chan<- kafka.Message, handle Handler) {
+	for m := range queue {
+		// Queued messages are left uncommitted once stopping, they are redelivered.
+		if ctx.Err() != nil {
+			continue
+		}
+		if c.process(ctx, handlerCtx, fromKafkaMessage(m), handle) {
+			completed <- m
+		}
+	}
+}
+
+// commit advances each partition's offset up to the last message that was
+// completed without gaps, since workers finish out of fetch order.
+func (c *Consumer) commit(ctx context.Context, offsets *offsetTracker, completed <-chan kafka.Message) {
+	for m := range completed {
+		next, ok := offsets.complete(m)
+		if !ok {
+			continue
+		}
+		if err := c.reader.CommitMessages(ctx, next); err != nil {
+			log.Printf("Error committing offset %d on topic %s partition %d: %v\n", next.Offset, next.Topic, next.Partition, err)
+			c.metrics.ConsumerError(next.Topic, OperationCommit)
+		}
+	}
+}
+
+// process returns false when the consumer is stopping before the message was
+// handled or parked, leaving its offset uncommitted so it is redelivered.
+func (c *Consumer) process(ctx context.Context, handlerCtx context.Context, msg Message, handle Handler) bool {
+	for attempt := 1; ; attempt++ {
+		started := time.Now()
+		err := handle(handlerCtx, msg)
+		c.metrics.MessageHandled(msg.Topic, msg.Partition, time.Since(started), err)
+		if err == nil {
+			return true
+		}
+
+		if IsPermanent(err) || attempt >= c.retry.MaxAttempts {
+			log.Printf("Parking message from topic %s partition %d offset %d after %d attempt(s): %v\n", msg.Topic, msg.Partition, msg.Offset, attempt, err)
+			return c.parkMessage(ctx, handlerCtx, msg, err)
+		}
+
+		backoff := c.retry.backoff(attempt)
+		log.Printf("Error handling message from topic %s partition %d offset %d (attempt %d/%d), retrying in %s: %v\n", msg.Topic, msg.Partition, msg.Offset, attempt, c.retry.MaxAttempts, backoff, err)
+		if !sleep(ctx, backoff) {
+			return false
+		}
+	}
+}
+
+func (c *Consumer) parkMessage(ctx context.Context, handlerCtx context.Context, msg Message, cause error) bool {
+	for attempt := 1; ; attempt++ {
+		err := c.park(handlerCtx, msg, cause)
+		if err == nil {
+			c.metrics.MessageParked(msg.Topic, msg.Partition)
+			return true
+		}
+		c.metrics.ConsumerError(msg.Topic, OperationPark)
+
+		backoff := c.retry.backoff(attempt)
+		log.Printf("Error parking message from topic %s partition %d offset %d, retrying in %s: %v\n", msg.Topic, msg.Partition, msg.Offset, backoff, err)
+		if !sleep(ctx, backoff) {
+			return false
+		}
+	}
+}
+
+func logParkedMessage(ctx context.Context, msg Message, cause error) error {
+	log.Printf("Discarding message from topic %s partition %d offset %d: %v\n", msg.Topic, msg.Partition, msg.Offset, cause)
+	return nil
+}
+
+func (c *Consumer) Close(ctx context.Context) error {
+	c.mu.Lock()
+	cancel, done := c.cancel, c.done
+	c.mu.Unlock()
+
+	var drainErr error
+	if cancel != nil {
+		cancel()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			drainErr = fmt.Errorf("kafka consumer did not drain: %w", ctx.Err())
+		}
+	}
+
+	err := c.reader.Close()
+	if err != nil {
+		log.Printf("Error closing Kafka reader: %v\n", err)
+	}
+
+	log.Println("Kafka consumer closed")
+	return errors.Join(drainErr, err)
+}
+
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
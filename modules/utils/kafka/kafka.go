@@ -1,125 +1,102 @@
 package kafka
 
 import (
-	"context"
-	"log"
-	"sync"
+	"errors"
 	"time"
 
 	"github.com/segmentio/kafka-go"
 )
 
-var (
-	reader         *kafka.Reader
-	writer         *kafka.Writer
-	isConnected    bool
-	connectionLock sync.Mutex
-)
-
-func InitializeReader(brokers []string, groupID string, topics []string, handleMessage func(topic string, message []byte)) {
-	connectionLock.Lock()
-	defer connectionLock.Unlock()
-
-	if reader != nil {
-		log.Println("Kafka reader is already initialized")
-		return
-	}
-
-	reader = kafka.NewReader(kafka.ReaderConfig{
-		Brokers:     brokers,
-		GroupID:     groupID,
-		GroupTopics: topics,
-		MinBytes:    10e2, // 1KB
-		MaxBytes:    10e6, // 10MB
-	})
-
-	isConnected = true
-	log.Println("Kafka reader initialized")
-
-	go StartListening(handleMessage)
+type ClientOptions struct {
+	Brokers  []string
+	ClientID string
+	Security SecurityOptions
 }
 
-func InitializeWriter(brokers []string) {
-	connectionLock.Lock()
-	defer connectionLock.Unlock()
-
-	if writer != nil {
-		log.Println("Kafka writer is already initialized")
-		return
-	}
-
-	writer = &kafka.Writer{
-		Addr:     kafka.TCP(brokers...),
-		Balancer: &kafka.LeastBytes{},
-	}
-
-	isConnected = true
-	log.Println("Kafka writer initialized")
+type Client struct {
+	brokers   []string
+	clientID  string
+	dialer    *kafka.Dialer
+	transport *kafka.Transport
 }
 
-func StartListening(handleMessage func(topic string, message []byte)) {
-	for {
-		if !isConnected {
-			timer := time.NewTimer(2 * time.Second)
-			<-timer.C
-			continue
-		}
+type Message struct {
+	Topic     string
+	Partition int
+	Offset    int64
+	Key       []byte
+	Value     []byte
+	Headers   map[string]string
+	Time      time.Time
+}
 
-		m, err := reader.ReadMessage(context.Background())
-		if err != nil {
-			log.Printf("Error reading message: %v\n", err)
-			continue
+func NewClient(opts ClientOptions) (*Client, error) {
+	brokers := []string{}
+	for _, broker := range opts.Brokers {
+		if broker != "" {
+			brokers = append(brokers, broker)
 		}
-		handleMessage(m.Topic, m.Value)
 	}
-}
-
-func PublishData(topic string, key, data []byte) {
-	connectionLock.Lock()
-	defer connectionLock.Unlock()
-
-	if writer == nil {
-		log.Println("Kafka writer is not initialized")
-		return
+	if len(brokers) == 0 {
+		return nil, errors.New("no kafka brokers configured")
 	}
 
-	if !isConnected {
-		log.Println("Kafka client is not connected.")
-		return
+	tlsConfig, err := opts.Security.tlsConfig()
+	if err != nil {
+		return nil, err
 	}
-
-	err := writer.WriteMessages(context.Background(), kafka.Message{
-		Topic: topic,
-		Key:   key,
-		Value: data,
-	})
+	saslMechanism, err := opts.Security.saslMechanism()
 	if err != nil {
-		log.Printf("Error publishing message to topic %s: %v\n", topic, err)
-	} else {
-		log.Printf("Message published to topic %s: %s\n", topic, data)
+		return nil, err
+	}
+
+	client := &Client{
+		brokers:  brokers,
+		clientID: opts.ClientID,
+		dialer: &kafka.Dialer{
+			ClientID:      opts.ClientID,
+			Timeout:       10 * time.Second,
+			DualStack:     true,
+			TLS:           tlsConfig,
+			SASLMechanism: saslMechanism,
+		},
+		transport: &kafka.Transport{
+			ClientID: opts.ClientID,
+			TLS:      tlsConfig,
+			SASL:     saslMechanism,
+		},
 	}
+
+	return client, nil
 }
 
-func Close() {
-	connectionLock.Lock()
-	defer connectionLock.Unlock()
+func fromKafkaMessage(m kafka.Message) Message {
+	headers := make(map[string]string, len(m.Headers))
+	for _, header := range m.Headers {
+		headers[header.Key] = string(header.Value)
+	}
 
-	if reader != nil {
-		err := reader.Close()
-		if err != nil {
-			log.Printf("Error closing Kafka reader: %v\n", err)
-		}
-		reader = nil
+	return Message{
+		Topic:     m.Topic,
+		Partition: m.Partition,
+		Offset:    m.Offset,
+		Key:       m.Key,
+		Value:     m.Value,
+		Headers:   headers,
+		Time:      m.Time,
 	}
+}
 
-	if writer != nil {
-		err := writer.Close()
-		if err != nil {
-			log.Printf("Error closing Kafka writer: %v\n", err)
-		}
-		writer = nil
+func toKafkaMessage(msg Message) kafka.Message {
+	headers := make([]kafka.Header, 0, len(msg.Headers))
+	for key, value := range msg.Headers {
+		headers = append(headers, kafka.Header{Key: key, Value: []byte(value)})
 	}
 
-	isConnected = false
-	log.Println("Kafka connection closed")
+	return kafka.Message{
+		Topic:   msg.Topic,
+		Key:     msg.Key,
+		Value:   msg.Value,
+		Headers: headers,
+	}
 }
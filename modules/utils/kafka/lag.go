@@ -0,0 +1,148 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// ConsumerLag returns, for every partition of topics, how many messages are
+// past the consumer group's committed offset.
+func (c *Client) ConsumerLag(ctx context.Context, groupID string, topics ...string) (map[string]map[int]int64, error) {
+	admin := c.admin()
+
+	metadata, err := admin.Metadata(ctx, &kafka.MetadataRequest{Topics: topics})
+	if err != nil {
+		return nil, fmt.Errorf("error reading kafka metadata: %w", err)
+	}
+
+	partitions := map[string][]int{}
+	requests := map[string][]kafka.OffsetRequest{}
+	for _, topic := range metadata.Topics {
+		if topic.Error != nil {
+			return nil, fmt.Errorf("error reading metadata of topic %s: %w", topic.Name, topic.Error)
+		}
+		for _, partition := range topic.Partitions {
+			partitions[topic.Name] = append(partitions[topic.Name], partition.ID)
+			requests[topic.Name] = append(requests[topic.Name], kafka.FirstOffsetOf(partition.ID), kafka.LastOffsetOf(partition.ID))
+		}
+	}
+
+	committed, err := admin.OffsetFetch(ctx, &kafka.OffsetFetchRequest{GroupID: groupID, Topics: partitions})
+	if err != nil {
+		return nil, fmt.Errorf("error fetching offsets of group %s: %w", groupID, err)
+	}
+	if committed.Error != nil {
+		return nil, fmt.Errorf("error fetching offsets of group %s: %w", groupID, committed.Error)
+	}
+
+	listed, err := admin.ListOffsets(ctx, &kafka.ListOffsetsRequest{Topics: requests})
+	if err != nil {
+		return nil, fmt.Errorf("error listing topic offsets: %w", err)
+	}
+
+	lags := make(map[string]map[int]int64, len(partitions))
+	for topic, offsets := range listed.Topics {
+		commits := map[int]int64{}
+		for _, partition := range committed.Topics[topic] {
+			if partition.Error != nil {
+				return nil, fmt.Errorf("error fetching offset of group %s on %s/%d: %w", groupID, topic, partition.Partition, partition.Error)
+			}
+			commits[partition.Partition] = partition.CommittedOffset
+		}
+
+		lags[topic] = make(map[int]int64, len(offsets))
+		for _, partition := range offsets {
+			if partition.Error != nil {
+				return nil, fmt.Errorf("error listing offsets of %s/%d: %w", topic, partition.Partition, partition.Error)
+			}
+			// Without a commit the group starts at the oldest retained message.
+			position, ok := commits[partition.Partition]
+			if !ok || position < partition.FirstOffset {
+				position = partition.FirstOffset
+			}
+			lag := partition.LastOffset - position
+			if lag < 0 {
+				lag = 0
+			}
+			lags[topic][partition.Partition] = lag
+		}
+	}
+
+	return lags, nil
+}
+
+type lagState struct {
+	mu   sync.Mutex
+	lags map[string]map[int]int64
+	err  error
+}
+
+func (c *Consumer) monitorLag(ctx context.Context) {
+	ticker := time.NewTicker(c.lagInterval)
+	defer ticker.Stop()
+
+	for {
+		c.updateLag(ctx)
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *Consumer) updateLag(ctx context.Context) {
+	checkCtx, cancel := context.WithTimeout(ctx, c.lagInterval)
+	defer cancel()
+
+	lags, err := c.client.ConsumerLag(checkCtx, c.groupID, c.topics...)
+	if err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Error checking lag of consumer group %s: %v\n", c.groupID, err)
+		c.metrics.ConsumerError("", OperationLag)
+	}
+
+	for topic, partitions := range lags {
+		for partition, lag := range partitions {
+			c.metrics.PartitionLag(topic, partition, lag)
+		}
+	}
+
+	c.lag.mu.Lock()
+	defer c.lag.mu.Unlock()
+	c.lag.err = err
+	if err == nil {
+		c.lag.lags = lags
+	}
+}
+
+// Health reports an error while the consumer group lags beyond the threshold
+// or its lag cannot be read.
+func (c *Consumer) Health() error {
+	c.lag.mu.Lock()
+	defer c.lag.mu.Unlock()
+
+	if c.lag.err != nil {
+		return fmt.Errorf("lag of consumer group %s unknown: %w", c.groupID, c.lag.err)
+	}
+	if c.lagThreshold <= 0 {
+		return nil
+	}
+
+	for topic, partitions := range c.lag.lags {
+		for partition, lag := range partitions {
+			if lag > c.lagThreshold {
+				return fmt.Errorf("consumer group %s lags %d message(s) behind on %s/%d, threshold is %d", c.groupID, lag, topic, partition, c.lagThreshold)
+			}
+		}
+	}
+	return nil
+}
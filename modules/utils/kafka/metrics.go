@@ -0,0 +1,145 @@
+package kafka
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"ceiot-tf-background/modules/utils/metrics"
+)
+
+const (
+	OperationFetch  = "fetch"
+	OperationCommit = "commit"
+	OperationPark   = "park"
+	OperationLag    = "lag"
+)
+
+// Metrics receives consumer instrumentation. It is called from every worker,
+// so implementations must be safe for concurrent use.
+type Metrics interface {
+	MessageHandled(topic string, partition int, duration time.Duration, err error)
+	MessageParked(topic string, partition int)
+	ConsumerError(topic string, operation string)
+	PartitionLag(topic string, partition int, lag int64)
+}
+
+type noopMetrics struct{}
+
+func (noopMetrics) MessageHandled(string, int, time.Duration, error) {}
+func (noopMetrics) MessageParked(string, int)                        {}
+func (noopMetrics) ConsumerError(string, string)                     {}
+func (noopMetrics) PartitionLag(string, int, int64)                  {}
+
+// PrometheusMetrics records consumer metrics of one consumer group in a registry.
+type PrometheusMetrics struct {
+	groupID  string
+	messages *metrics.Counter
+	duration *metrics.Histogram
+	parked   *metrics.Counter
+	errors   *metrics.Counter
+	lag      *metrics.Gauge
+	rate     *metrics.Gauge
+
+	mu     sync.Mutex
+	meters map[string]*rateMeter
+}
+
+func NewPrometheusMetrics(registry *metrics.Registry, groupID string) *PrometheusMetrics {
+	m := &PrometheusMetrics{
+		groupID:  groupID,
+		messages: registry.Counter("kafka_consumer_messages_total", "Handler attempts by result.", "group", "topic", "partition", "result"),
+		duration: registry.Histogram("kafka_consumer_handler_duration_seconds", "Handler latency.", nil, "group", "topic"),
+		parked:   registry.Counter("kafka_consumer_parked_total", "Messages sent to the dead-letter queue.", "group", "topic", "partition"),
+		errors:   registry.Counter("kafka_consumer_errors_total", "Consumer errors by operation.", "group", "topic", "operation"),
+		lag:      registry.Gauge("kafka_consumer_lag", "Messages past the committed offset.", "group", "topic", "partition"),
+		rate:     registry.Gauge("kafka_consumer_messages_per_second", "Successfully handled messages per second over the last minute.", "group", "topic"),
+		meters:   map[string]*rateMeter{},
+	}
+	registry.OnCollect(m.collect)
+	return m
+}
+
+func (m *PrometheusMetrics) MessageHandled(topic string, partition int, duration time.Duration, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	m.messages.Inc(m.groupID, topic, strconv.Itoa(partition), result)
+	m.duration.Observe(duration.Seconds(), m.groupID, topic)
+	if err == nil {
+		m.meter(topic).mark(time.Now())
+	}
+}
+
+func (m *PrometheusMetrics) MessageParked(topic string, partition int) {
+	m.parked.Inc(m.groupID, topic, strconv.Itoa(partition))
+}
+
+func (m *PrometheusMetrics) ConsumerError(topic string, operation string) {
+	m.errors.Inc(m.groupID, topic, operation)
+}
+
+func (m *PrometheusMetrics) PartitionLag(topic string, partition int, lag int64) {
+	m.lag.Set(float64(lag), m.groupID, topic, strconv.Itoa(partition))
+}
+
+func (m *PrometheusMetrics) meter(topic string) *rateMeter {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	meter, ok := m.meters[topic]
+	if !ok {
+		meter = &rateMeter{}
+		m.meters[topic] = meter
+	}
+	return meter
+}
+
+func (m *PrometheusMetrics) collect() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for topic, meter := range m.meters {
+		m.rate.Set(meter.rate(now), m.groupID, topic)
+	}
+}
+
+const rateWindow = 60
+
+// rateMeter counts events in one-second buckets over a sliding minute.
+// The current second shares its bucket with the oldest one, so rates cover
+// the last rateWindow-1 complete seconds.
+type rateMeter struct {
+	mu      sync.Mutex
+	counts  [rateWindow]uint64
+	seconds [rateWindow]int64
+}
+
+func (r *rateMeter) mark(now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	second := now.Unix()
+	i := second % rateWindow
+	if r.seconds[i] != second {
+		r.seconds[i] = second
+		r.counts[i] = 0
+	}
+	r.counts[i]++
+}
+
+func (r *rateMeter) rate(now time.Time) float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	second := now.Unix()
+	total := uint64(0)
+	for i := range r.counts {
+		if age := second - r.seconds[i]; age >= 1 && age < rateWindow {
+			total += r.counts[i]
+		}
+	}
+	return float64(total) / (rateWindow - 1)
+}
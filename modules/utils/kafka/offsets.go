@@ -0,0 +1,65 @@
+package kafka
+
+import (
+	"sync"
+
+	"github.com/segmentio/kafka-go"
+)
+
+type topicPartition struct {
+	topic     string
+	partition int
+}
+
+type partitionOffsets struct {
+	pending []kafka.Message
+	done    map[int64]bool
+}
+
+// offsetTracker keeps the fetched messages of every partition in fetch order,
+// so only offsets without uncompleted messages before them get committed.
+type offsetTracker struct {
+	mu         sync.Mutex
+	partitions map[topicPartition]*partitionOffsets
+}
+
+func newOffsetTracker() *offsetTracker {
+	return &offsetTracker{partitions: map[topicPartition]*partitionOffsets{}}
+}
+
+func (t *offsetTracker) track(m kafka.Message) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := topicPartition{topic: m.Topic, partition: m.Partition}
+	offsets, ok := t.partitions[key]
+	// A rebalance rewinds the partition to its committed offset.
+	if !ok || (len(offsets.pending) > 0 && m.Offset <= offsets.pending[len(offsets.pending)-1].Offset) {
+		offsets = &partitionOffsets{done: map[int64]bool{}}
+		t.partitions[key] = offsets
+	}
+	offsets.pending = append(offsets.pending, m)
+}
+
+// complete marks m as handled and returns the message to commit, if the
+// partition's committable offset moved forward.
+func (t *offsetTracker) complete(m kafka.Message) (kafka.Message, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	offsets, ok := t.partitions[topicPartition{topic: m.Topic, partition: m.Partition}]
+	if !ok || len(offsets.pending) == 0 || m.Offset < offsets.pending[0].Offset {
+		return kafka.Message{}, false
+	}
+	offsets.done[m.Offset] = true
+
+	var next kafka.Message
+	advanced := false
+	for len(offsets.pending) > 0 && offsets.done[offsets.pending[0].Offset] {
+		next = offsets.pending[0]
+		delete(offsets.done, next.Offset)
+		offsets.pending = offsets.pending[1:]
+		advanced = true
+	}
+	return next, advanced
+}
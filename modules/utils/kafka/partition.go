@@ -0,0 +1,57 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// ReadPartition reads up to limit messages of a single partition starting at
+// offset, without joining a consumer group or committing anything.
+func (c *Client) ReadPartition(ctx context.Context, topic string, partition int, offset int64, limit int) ([]Message, error) {
+	conn, err := c.dialer.DialLeader(ctx, "tcp", c.brokers[0], topic, partition)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial leader for %s/%d: %w", topic, partition, err)
+	}
+	first, last, err := conn.ReadOffsets()
+	conn.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read offsets for %s/%d: %w", topic, partition, err)
+	}
+
+	if offset < first {
+		offset = first
+	}
+	end := last
+	if limit > 0 && offset+int64(limit) < end {
+		end = offset + int64(limit)
+	}
+	if offset >= end {
+		return []Message{}, nil
+	}
+
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:   c.brokers,
+		Topic:     topic,
+		Partition: partition,
+		Dialer:    c.dialer,
+	})
+	defer reader.Close()
+
+	if err := reader.SetOffset(offset); err != nil {
+		return nil, err
+	}
+
+	messages := []Message{}
+	for offset < end {
+		m, err := reader.ReadMessage(ctx)
+		if err != nil {
+			return messages, fmt.Errorf("failed to read %s/%d at offset %d: %w", topic, partition, offset, err)
+		}
+		messages = append(messages, fromKafkaMessage(m))
+		offset = m.Offset + 1
+	}
+
+	return messages, nil
+}
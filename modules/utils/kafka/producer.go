@@ -0,0 +1,413 @@
+package kafka
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+const HeaderMessageID = "message-id"
+
+var (
+	ErrProducerClosed   = errors.New("kafka producer is closed")
+	ErrProducerNotAsync = errors.New("kafka producer is not in async mode")
+)
+
+type Acks int
+
+const (
+	AcksAll Acks = iota
+	AcksLeader
+	AcksNone
+)
+
+func ParseAcks(value string) (Acks, error) {
+	switch strings.ToLower(value) {
+	case "", "all", "-1":
+		return AcksAll, nil
+	case "leader", "one", "1":
+		return AcksLeader, nil
+	case "none", "0":
+		return AcksNone, nil
+	default:
+		return AcksAll, fmt.Errorf("invalid kafka acks %q", value)
+	}
+}
+
+type Compression = kafka.Compression
+
+func ParseCompression(value string) (Compression, error) {
+	var compression Compression
+	if value == "" {
+		return compression, nil
+	}
+	if err := compression.UnmarshalText([]byte(strings.ToLower(value))); err != nil {
+		return compression, fmt.Errorf("invalid kafka compression %q: %w", value, err)
+	}
+	return compression, nil
+}
+
+// Completion is called once per asynchronously published message, from the
+// producer's dispatcher goroutine, so it should not block for long.
+type Completion func(err error)
+
+type ProducerOptions struct {
+	BatchTimeout time.Duration
+	RequiredAcks Acks
+	// Idempotent forces acks from all in-sync replicas and stamps every message
+	// with a message-id header that stays the same across retries. kafka-go has
+	// no idempotent producer, so consumers with side effects, like the alerts
+	// of threshold-validator, deduplicate on that header.
+	Idempotent  bool
+	Retry       RetryOptions
+	Compression Compression
+
+	Async     bool
+	BatchSize int
+	Linger    time.Duration
+	QueueSize int
+}
+
+type pendingMessage struct {
+	msg  Message
+	done Completion
+}
+
+type Producer struct {
+	writer     *kafka.Writer
+	retry      RetryOptions
+	idempotent bool
+	queue      chan pendingMessage
+	batchSize  int
+	linger     time.Duration
+	inFlight   sync.WaitGroup
+	mu         sync.RWMutex
+	closed     bool
+}
+
+func (c *Client) NewProducer(opts ProducerOptions) *Producer {
+	requiredAcks := kafka.RequireAll
+	if !opts.Idempotent {
+		switch opts.RequiredAcks {
+		case AcksLeader:
+			requiredAcks = kafka.RequireOne
+		case AcksNone:
+			requiredAcks = kafka.RequireNone
+		}
+	}
+
+	writer := &kafka.Writer{
+		Addr: kafka.TCP(c.brokers...),
+		// Keyed messages always land on the same partition, keyless ones are spread round-robin.
+		Balancer:     &kafka.Hash{},
+		Transport:    c.transport,
+		BatchTimeout: opts.BatchTimeout,
+		RequiredAcks: requiredAcks,
+		Compression:  opts.Compression,
+		// Retries are handled by the producer so that backoff and jitter are ours.
+		MaxAttempts: 1,
+	}
+
+	producer := &Producer{
+		writer:     writer,
+		retry:      opts.Retry.withDefaults(producerRetryDefaults),
+		idempotent: opts.Idempotent,
+	}
+
+	if opts.Async {
+		producer.batchSize = opts.BatchSize
+		if producer.batchSize <= 0 {
+			producer.batchSize = 100
+		}
+		producer.linger = opts.Linger
+		if producer.linger <= 0 {
+			producer.linger = 50 * time.Millisecond
+		}
+		queueSize := opts.QueueSize
+		if queueSize <= 0 {
+			queueSize = 10 * producer.batchSize
+		}
+		producer.queue = make(chan pendingMessage, queueSize)
+
+		// Batches are assembled by the dispatcher, the writer must flush them as is.
+		writer.BatchSize = producer.batchSize
+		writer.BatchTimeout = time.Millisecond
+
+		producer.inFlight.Add(1)
+		go producer.dispatch()
+	}
+
+	log.Printf("Kafka producer initialized (async: %t, compression: %s)\n", opts.Async, opts.Compression)
+	return producer
+}
+
+func (p *Producer) Publish(ctx context.Context, msg Message) error {
+	p.mu.RLock()
+	if p.closed {
+		p.mu.RUnlock()
+		return ErrProducerClosed
+	}
+	p.inFlight.Add(1)
+	p.mu.RUnlock()
+	defer p.inFlight.Done()
+
+	if p.idempotent {
+		msg = withMessageID(msg)
+	}
+
+	err := p.write(ctx, []Message{msg})[0]
+	if err != nil {
+		log.Printf("Error publishing message to topic %s: %v\n", msg.Topic, err)
+		return err
+	}
+
+	log.Printf("Message published to topic %s: %s\n", msg.Topic, msg.Value)
+	return nil
+}
+
+// PublishBatch writes msgs in one batch, so messages that share a partition
+// keep their order, and returns the error of every message.
+func (p *Producer) PublishBatch(ctx context.Context, msgs []Message) []error {
+	p.mu.RLock()
+	if p.closed {
+		p.mu.RUnlock()
+		errs := make([]error, len(msgs))
+		for i := range errs {
+			errs[i] = ErrProducerClosed
+		}
+		return errs
+	}
+	p.inFlight.Add(1)
+	p.mu.RUnlock()
+	defer p.inFlight.Done()
+
+	if p.idempotent {
+		for i := range msgs {
+			msgs[i] = withMessageID(msgs[i])
+		}
+	}
+
+	errs := p.write(ctx, msgs)
+
+	failed := 0
+	var firstErr error
+	for _, err := range errs {
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			failed++
+		}
+	}
+	if failed > 0 {
+		log.Printf("Error publishing %d of %d message(s): %v\n", failed, len(msgs), firstErr)
+	} else {
+		log.Printf("Batch of %d message(s) published\n", len(msgs))
+	}
+	return errs
+}
+
+// PublishAsync queues msg for the next batch. It blocks while the queue is full
+// and reports the outcome of the write through done.
+func (p *Producer) PublishAsync(ctx context.Context, msg Message, done Completion) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.closed {
+		return ErrProducerClosed
+	}
+	if p.queue == nil {
+		return ErrProducerNotAsync
+	}
+
+	if p.idempotent {
+		msg = withMessageID(msg)
+	}
+
+	select {
+	case p.queue <- pendingMessage{msg: msg, done: done}:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("failed to queue message for topic %s: %w", msg.Topic, ctx.Err())
+	}
+}
+
+func (p *Producer) dispatch() {
+	defer p.inFlight.Done()
+
+	batch := make([]pendingMessage, 0, p.batchSize)
+	linger := time.NewTimer(p.linger)
+	linger.Stop()
+
+	flush := func() {
+		linger.Stop()
+		if len(batch) == 0 {
+			return
+		}
+		p.flush(batch)
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case pending, ok := <-p.queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, pending)
+			if len(batch) == 1 {
+				linger.Reset(p.linger)
+			}
+			if len(batch) >= p.batchSize {
+				flush()
+			}
+		case <-linger.C:
+			flush()
+		}
+	}
+}
+
+func (p *Producer) flush(batch []pendingMessage) {
+	msgs := make([]Message, len(batch))
+	for i, pending := range batch {
+		msgs[i] = pending.msg
+	}
+
+	errs := p.write(context.Background(), msgs)
+
+	failed := 0
+	for i, pending := range batch {
+		if errs[i] != nil {
+			failed++
+		}
+		if pending.done != nil {
+			pending.done(errs[i])
+		}
+	}
+
+	if failed > 0 {
+		log.Printf("Error publishing %d of %d batched message(s)\n", failed, len(batch))
+	} else {
+		log.Printf("Batch of %d message(s) published\n", len(batch))
+	}
+}
+
+// write sends msgs, retrying only the messages that failed with a transient
+// error, and returns the final error of every message.
+func (p *Producer) write(ctx context.Context, msgs []Message) []error {
+	errs := make([]error, len(msgs))
+	pending := make([]int, len(msgs))
+	for i := range msgs {
+		pending[i] = i
+	}
+
+	for attempt := 1; ; attempt++ {
+		batch := make([]kafka.Message, len(pending))
+		for i, index := range pending {
+			batch[i] = toKafkaMessage(msgs[index])
+		}
+
+		err := p.writer.WriteMessages(ctx, batch...)
+
+		var writeErrors kafka.WriteErrors
+		if err != nil && errors.As(err, &writeErrors) && len(writeErrors) == len(pending) {
+			for i, index := range pending {
+				errs[index] = writeErrors[i]
+			}
+		} else {
+			for _, index := range pending {
+				errs[index] = err
+			}
+		}
+
+		retryable := []int{}
+		for _, index := range pending {
+			if errs[index] != nil && IsTransient(errs[index]) {
+				retryable = append(retryable, index)
+			}
+		}
+
+		if len(retryable) == 0 || attempt >= p.retry.MaxAttempts {
+			for _, index := range pending {
+				if errs[index] != nil {
+					errs[index] = fmt.Errorf("failed to publish to topic %s after %d attempt(s): %w", msgs[index].Topic, attempt, errs[index])
+				}
+			}
+			return errs
+		}
+
+		backoff := jitter(p.retry.backoff(attempt))
+		log.Printf("Error publishing %d message(s) (attempt %d/%d), retrying in %s: %v\n", len(retryable), attempt, p.retry.MaxAttempts, backoff, errs[retryable[0]])
+		if !sleep(ctx, backoff) {
+			for _, index := range retryable {
+				errs[index] = fmt.Errorf("failed to publish to topic %s: %w", msgs[index].Topic, ctx.Err())
+			}
+			return errs
+		}
+		pending = retryable
+	}
+}
+
+func withMessageID(msg Message) Message {
+	if msg.Headers[HeaderMessageID] != "" {
+		return msg
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return msg
+	}
+
+	headers := make(map[string]string, len(msg.Headers)+1)
+	for key, value := range msg.Headers {
+		headers[key] = value
+	}
+	headers[HeaderMessageID] = hex.EncodeToString(id)
+	msg.Headers = headers
+	return msg
+}
+
+// Close stops accepting messages, flushes the async queue and waits for
+// in-flight writes before closing the writer.
+func (p *Producer) Close(ctx context.Context) error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	if p.queue != nil {
+		close(p.queue)
+	}
+	p.mu.Unlock()
+
+	var drainErr error
+	drained := make(chan struct{})
+	go func() {
+		p.inFlight.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		drainErr = fmt.Errorf("kafka producer did not drain: %w", ctx.Err())
+	}
+
+	err := p.writer.Close()
+	if err != nil {
+		log.Printf("Error closing Kafka writer: %v\n", err)
+	}
+
+	log.Println("Kafka producer closed")
+	return errors.Join(drainErr, err)
+}
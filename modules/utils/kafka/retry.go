@@ -0,0 +1,118 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+type RetryOptions struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+var (
+	consumerRetryDefaults = RetryOptions{
+		MaxAttempts:    5,
+		InitialBackoff: 1 * time.Second,
+		MaxBackoff:     30 * time.Second,
+	}
+	// Publishing is on the path of the caller, so the producer backs off for less.
+	producerRetryDefaults = RetryOptions{
+		MaxAttempts:    5,
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     5 * time.Second,
+	}
+)
+
+// withDefaults fills the unset fields of r from defaults.
+func (r RetryOptions) withDefaults(defaults RetryOptions) RetryOptions {
+	if r.MaxAttempts <= 0 {
+		r.MaxAttempts = defaults.MaxAttempts
+	}
+	if r.InitialBackoff <= 0 {
+		r.InitialBackoff = defaults.InitialBackoff
+	}
+	if r.MaxBackoff <= 0 {
+		r.MaxBackoff = defaults.MaxBackoff
+	}
+	if r.MaxBackoff < r.InitialBackoff {
+		r.MaxBackoff = r.InitialBackoff
+	}
+	return r
+}
+
+func (r RetryOptions) backoff(attempt int) time.Duration {
+	backoff := r.InitialBackoff
+	for i := 1; i < attempt; i++ {
+		backoff *= 2
+		if backoff >= r.MaxBackoff {
+			return r.MaxBackoff
+		}
+	}
+	return backoff
+}
+
+// jitter spreads retries of concurrent publishers over [d/2, d].
+func jitter(d time.Duration) time.Duration {
+	if d <= 1 {
+		return d
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1))
+}
+
+// IsTransient reports whether a broker error may succeed when retried.
+func IsTransient(err error) bool {
+	if err == nil || errors.Is(err, ErrProducerClosed) ||
+		errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var writeErrors kafka.WriteErrors
+	if errors.As(err, &writeErrors) {
+		for _, writeErr := range writeErrors {
+			if writeErr != nil && !IsTransient(writeErr) {
+				return false
+			}
+		}
+		return true
+	}
+
+	var kafkaErr kafka.Error
+	if errors.As(err, &kafkaErr) {
+		return kafkaErr.Temporary()
+	}
+
+	// Network failures such as a refused connection while the broker restarts.
+	return true
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// Permanent marks an error as not worth retrying, so the message is parked right away.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+func IsPermanent(err error) bool {
+	var permanent *permanentError
+	return errors.As(err, &permanent)
+}
@@ -0,0 +1,121 @@
+package kafka
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"ceiot-tf-background/modules/utils/env"
+
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+)
+
+const (
+	SASLMechanismNone        = ""
+	SASLMechanismPlain       = "PLAIN"
+	SASLMechanismScramSHA256 = "SCRAM-SHA-256"
+	SASLMechanismScramSHA512 = "SCRAM-SHA-512"
+)
+
+type SecurityOptions struct {
+	TLSEnabled            bool
+	TLSCAFile             string
+	TLSCertFile           string
+	TLSKeyFile            string
+	TLSServerName         string
+	TLSInsecureSkipVerify bool
+
+	SASLMechanism string
+	SASLUsername  string
+	SASLPassword  string
+}
+
+// SecurityFromEnv reads the broker security settings shared by every service.
+func SecurityFromEnv() (SecurityOptions, error) {
+	tlsEnabled, err := env.GetBool("KAFKA_TLS_ENABLED", false)
+	if err != nil {
+		return SecurityOptions{}, err
+	}
+	tlsInsecureSkipVerify, err := env.GetBool("KAFKA_TLS_INSECURE_SKIP_VERIFY", false)
+	if err != nil {
+		return SecurityOptions{}, err
+	}
+
+	security := SecurityOptions{
+		TLSEnabled:            tlsEnabled,
+		TLSCAFile:             os.Getenv("KAFKA_TLS_CA_FILE"),
+		TLSCertFile:           os.Getenv("KAFKA_TLS_CERT_FILE"),
+		TLSKeyFile:            os.Getenv("KAFKA_TLS_KEY_FILE"),
+		TLSServerName:         os.Getenv("KAFKA_TLS_SERVER_NAME"),
+		TLSInsecureSkipVerify: tlsInsecureSkipVerify,
+		SASLMechanism:         strings.ToUpper(os.Getenv("KAFKA_SASL_MECHANISM")),
+		SASLUsername:          os.Getenv("KAFKA_SASL_USERNAME"),
+		SASLPassword:          os.Getenv("KAFKA_SASL_PASSWORD"),
+	}
+
+	if _, err := security.tlsConfig(); err != nil {
+		return SecurityOptions{}, err
+	}
+	if _, err := security.saslMechanism(); err != nil {
+		return SecurityOptions{}, err
+	}
+
+	return security, nil
+}
+
+func (s SecurityOptions) tlsConfig() (*tls.Config, error) {
+	if !s.TLSEnabled {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         s.TLSServerName,
+		InsecureSkipVerify: s.TLSInsecureSkipVerify,
+	}
+
+	if s.TLSCAFile != "" {
+		caCert, err := os.ReadFile(s.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading kafka CA certificate: %w", err)
+		}
+		caCertPool := x509.NewCertPool()
+		if !caCertPool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no certificates found in %s", s.TLSCAFile)
+		}
+		tlsConfig.RootCAs = caCertPool
+	}
+
+	if s.TLSCertFile != "" || s.TLSKeyFile != "" {
+		if s.TLSCertFile == "" || s.TLSKeyFile == "" {
+			return nil, errors.New("KAFKA_TLS_CERT_FILE and KAFKA_TLS_KEY_FILE must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(s.TLSCertFile, s.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading kafka client certificate and key: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+func (s SecurityOptions) saslMechanism() (sasl.Mechanism, error) {
+	switch s.SASLMechanism {
+	case SASLMechanismNone:
+		return nil, nil
+	case SASLMechanismPlain:
+		return plain.Mechanism{Username: s.SASLUsername, Password: s.SASLPassword}, nil
+	case SASLMechanismScramSHA256:
+		return scram.Mechanism(scram.SHA256, s.SASLUsername, s.SASLPassword)
+	case SASLMechanismScramSHA512:
+		return scram.Mechanism(scram.SHA512, s.SASLUsername, s.SASLPassword)
+	default:
+		return nil, fmt.Errorf("unsupported kafka SASL mechanism %q", s.SASLMechanism)
+	}
+}
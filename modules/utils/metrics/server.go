@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// HealthCheck returns an error while the component it checks is unhealthy.
+type HealthCheck func() error
+
+// Serve exposes /metrics and /healthz on addr until the returned server is shut down.
+func Serve(addr string, registry *Registry, checks map[string]HealthCheck) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", registry.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+		names := make([]string, 0, len(checks))
+		for name := range checks {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		failures := []string{}
+		for _, name := range names {
+			if err := checks[name](); err != nil {
+				failures = append(failures, fmt.Sprintf("%s: %v", name, err))
+			}
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if len(failures) > 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			for _, failure := range failures {
+				fmt.Fprintln(w, failure)
+			}
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	go func() {
+		log.Printf("Metrics server listening on %s\n", addr)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Metrics server stopped: %v\n", err)
+		}
+	}()
+
+	return server
+}
@@ -0,0 +1,295 @@
+// Package broker is a small in-process MQTT 3.1.1 broker for integration
+// tests and local development. It supports QoS 0 and 1, wildcards, retained
+// messages, Last Will, shared subscriptions and persistent sessions kept in
+// memory. QoS 2 is downgraded to QoS 1 and there is no authentication or TLS.
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"ceiot-tf-background/modules/utils/mqtt"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+const (
+	connectTimeout = 10 * time.Second
+	writeTimeout   = 5 * time.Second
+	// maxInflight bounds the QoS 1 messages kept per session while its client is away.
+	maxInflight = 1000
+)
+
+type Options struct {
+	// Logf receives connection and subscription events, nothing is logged when nil.
+	Logf func(format string, args ...any)
+}
+
+type Broker struct {
+	logf func(format string, args ...any)
+
+	mu        sync.Mutex
+	listener  net.Listener
+	sessions  map[string]*session
+	retained  map[string]*packets.PublishPacket
+	sharedRR  map[string]int
+	anonymous int
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+func New(opts Options) *Broker {
+	logf := opts.Logf
+	if logf == nil {
+		logf = func(string, ...any) {}
+	}
+	return &Broker{
+		logf:     logf,
+		sessions: map[string]*session{},
+		retained: map[string]*packets.PublishPacket{},
+		sharedRR: map[string]int{},
+	}
+}
+
+// Logger logs broker events with the standard logger.
+func Logger(format string, args ...any) {
+	log.Printf("[broker] "+format, args...)
+}
+
+// Listen starts accepting connections on addr, use ":0" for a random port.
+func (b *Broker) Listen(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("error escuchando en %s: %w", addr, err)
+	}
+	b.Serve(listener)
+	return nil
+}
+
+// Serve accepts connections on listener in the background until Close.
+func (b *Broker) Serve(listener net.Listener) {
+	b.mu.Lock()
+	b.listener = listener
+	b.mu.Unlock()
+
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					b.logf("Error aceptando conexión: %v", err)
+				}
+				return
+			}
+			b.wg.Add(1)
+			go func() {
+				defer b.wg.Done()
+				b.handle(conn)
+			}()
+		}
+	}()
+}
+
+// Addr is the address the broker listens on.
+func (b *Broker) Addr() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.listener == nil {
+		return ""
+	}
+	return b.listener.Addr().String()
+}
+
+// URL is the broker address in the form expected by mqtt.ClientOptions.
+func (b *Broker) URL() string {
+	return "tcp://" + b.Addr()
+}
+
+// Close stops listening and drops every connection without sending their wills.
+func (b *Broker) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	listener := b.listener
+	for _, s := range b.sessions {
+		if s.conn != nil {
+			s.conn.will = nil
+			s.conn.close()
+		}
+	}
+	b.mu.Unlock()
+
+	var err error
+	if listener != nil {
+		err = listener.Close()
+	}
+	b.wg.Wait()
+	return err
+}
+
+// DropClient closes a client connection as if the network failed, so its will is published.
+func (b *Broker) DropClient(clientID string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s, ok := b.sessions[clientID]
+	if !ok || s.conn == nil {
+		return false
+	}
+	s.conn.close()
+	return true
+}
+
+// Connected reports whether a client with clientID is currently connected.
+func (b *Broker) Connected(clientID string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s, ok := b.sessions[clientID]
+	return ok && s.conn != nil
+}
+
+// Retained returns the retained payload for topic.
+func (b *Broker) Retained(topic string) ([]byte, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	msg, ok := b.retained[topic]
+	if !ok {
+		return nil, false
+	}
+	return append([]byte(nil), msg.Payload...), true
+}
+
+// Publish delivers a message from the broker itself, as a client publish would.
+func (b *Broker) Publish(topic string, qos byte, retain bool, payload []byte) error {
+	if err := validateTopic(topic); err != nil {
+		return err
+	}
+	msg := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	msg.TopicName = topic
+	msg.Qos = min(qos, mqtt.AtLeastOnce)
+	msg.Retain = retain
+	msg.Payload = append([]byte(nil), payload...)
+	b.route(msg)
+	return nil
+}
+
+func (b *Broker) route(msg *packets.PublishPacket) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if msg.Retain {
+		if len(msg.Payload) == 0 {
+			delete(b.retained, msg.TopicName)
+		} else {
+			b.retained[msg.TopicName] = msg
+		}
+	}
+
+	deliveries := map[*session]byte{}
+	shared := map[string][]*session{}
+	sharedQoS := map[string]map[*session]byte{}
+
+	for _, s := range b.sessions {
+		for filter, qos := range s.subscriptions {
+			group, sharedFilter, isShared := splitShared(filter)
+			if isShared {
+				if !mqtt.MatchTopic(sharedFilter, msg.TopicName) {
+					continue
+				}
+				key := group + "/" + sharedFilter
+				if sharedQoS[key] == nil {
+					sharedQoS[key] = map[*session]byte{}
+				}
+				if _, seen := sharedQoS[key][s]; !seen {
+					shared[key] = append(shared[key], s)
+				}
+				sharedQoS[key][s] = max(sharedQoS[key][s], qos)
+				continue
+			}
+			if !mqtt.MatchTopic(filter, msg.TopicName) {
+				continue
+			}
+			if current, ok := deliveries[s]; !ok || qos > current {
+				deliveries[s] = qos
+			}
+		}
+	}
+
+	for s, qos := range deliveries {
+		// Retain is only kept for messages sent because of a new subscription.
+		s.deliver(msg.TopicName, msg.Payload, min(msg.Qos, qos), false)
+	}
+
+	for key, members := range shared {
+		s := b.pickShared(key, members)
+		s.deliver(msg.TopicName, msg.Payload, min(msg.Qos, sharedQoS[key][s]), false)
+	}
+}
+
+// pickShared round-robins a shared subscription, preferring connected members.
+func (b *Broker) pickShared(key string, members []*session) *session {
+	online := []*session{}
+	for _, s := range members {
+		if s.conn != nil {
+			online = append(online, s)
+		}
+	}
+	if len(online) > 0 {
+		members = online
+	}
+	// Map iteration order is random, sort so the rotation is stable.
+	sort.Slice(members, func(i, j int) bool { return members[i].clientID < members[j].clientID })
+
+	next := b.sharedRR[key] % len(members)
+	b.sharedRR[key] = next + 1
+	return members[next]
+}
+
+func splitShared(filter string) (group string, topic string, ok bool) {
+	if !strings.HasPrefix(filter, "$share/") {
+		return "", filter, false
+	}
+	parts := strings.SplitN(filter, "/", 3)
+	if len(parts) < 3 || parts[1] == "" {
+		return "", filter, false
+	}
+	return parts[1], parts[2], true
+}
+
+func validateTopic(topic string) error {
+	if topic == "" || strings.ContainsAny(topic, "+#\x00") {
+		return fmt.Errorf("tópico inválido %q", topic)
+	}
+	return nil
+}
+
+func validateFilter(filter string) error {
+	if _, topic, shared := splitShared(filter); shared {
+		filter = topic
+	} else if strings.HasPrefix(filter, "$share/") {
+		return fmt.Errorf("suscripción compartida inválida %q", filter)
+	}
+	if filter == "" || strings.Contains(filter, "\x00") {
+		return fmt.Errorf("filtro inválido %q", filter)
+	}
+
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.Contains(level, "#") && (level != "#" || i != len(levels)-1) {
+			return fmt.Errorf("filtro inválido %q", filter)
+		}
+		if strings.Contains(level, "+") && level != "+" {
+			return fmt.Errorf("filtro inválido %q", filter)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,298 @@
+package broker
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"ceiot-tf-background/modules/utils/mqtt"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// session outlives its connection when the client asked for a persistent one.
+// Every field is guarded by the broker mutex.
+type session struct {
+	clientID      string
+	clean         bool
+	conn          *connection
+	subscriptions map[string]byte
+	nextID        uint16
+	// inflight holds QoS 1 messages waiting for a PUBACK, in delivery order.
+	inflight []*packets.PublishPacket
+}
+
+func newSession(clientID string, clean bool) *session {
+	return &session{
+		clientID:      clientID,
+		clean:         clean,
+		subscriptions: map[string]byte{},
+	}
+}
+
+func (s *session) deliver(topic string, payload []byte, qos byte, retain bool) {
+	msg := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	msg.TopicName = topic
+	msg.Payload = payload
+	msg.Qos = qos
+	msg.Retain = retain
+
+	if qos == mqtt.AtMostOnce {
+		if s.conn != nil {
+			s.conn.write(msg)
+		}
+		return
+	}
+
+	msg.MessageID = s.nextPacketID()
+	if len(s.inflight) >= maxInflight {
+		s.inflight = s.inflight[1:]
+	}
+	s.inflight = append(s.inflight, msg)
+	if s.conn != nil {
+		s.conn.write(msg)
+	}
+}
+
+func (s *session) nextPacketID() uint16 {
+	for {
+		s.nextID++
+		if s.nextID == 0 {
+			continue
+		}
+		inUse := false
+		for _, msg := range s.inflight {
+			if msg.MessageID == s.nextID {
+				inUse = true
+				break
+			}
+		}
+		if !inUse {
+			return s.nextID
+		}
+	}
+}
+
+func (s *session) ack(id uint16) {
+	for i, msg := range s.inflight {
+		if msg.MessageID == id {
+			s.inflight = append(s.inflight[:i], s.inflight[i+1:]...)
+			return
+		}
+	}
+}
+
+type connection struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+	session *session
+	// will is guarded by the broker mutex.
+	will *packets.PublishPacket
+}
+
+func (c *connection) write(packet packets.ControlPacket) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if err := packet.Write(c.conn); err != nil {
+		c.conn.Close()
+	}
+}
+
+func (c *connection) close() {
+	c.conn.Close()
+}
+
+func (b *Broker) handle(netConn net.Conn) {
+	c := &connection{conn: netConn}
+	defer c.close()
+
+	netConn.SetReadDeadline(time.Now().Add(connectTimeout))
+	packet, err := packets.ReadPacket(netConn)
+	if err != nil {
+		return
+	}
+	connect, ok := packet.(*packets.ConnectPacket)
+	if !ok {
+		return
+	}
+
+	connack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+	if code := connect.Validate(); code != packets.Accepted {
+		connack.ReturnCode = code
+		c.write(connack)
+		return
+	}
+
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return
+	}
+
+	clientID := connect.ClientIdentifier
+	if clientID == "" {
+		b.anonymous++
+		clientID = fmt.Sprintf("anonymous-%d", b.anonymous)
+	}
+
+	existing := b.sessions[clientID]
+	if existing != nil && existing.conn != nil {
+		// A second connection with the same client ID takes over the session.
+		existing.conn.close()
+		existing.conn = nil
+	}
+
+	s := existing
+	sessionPresent := existing != nil && !existing.clean && !connect.CleanSession
+	if !sessionPresent {
+		s = newSession(clientID, connect.CleanSession)
+		b.sessions[clientID] = s
+	}
+	s.conn = c
+	c.session = s
+
+	if connect.WillFlag {
+		will := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		will.TopicName = connect.WillTopic
+		will.Payload = connect.WillMessage
+		will.Qos = min(connect.WillQos, mqtt.AtLeastOnce)
+		will.Retain = connect.WillRetain
+		c.will = will
+	}
+
+	connack.SessionPresent = sessionPresent
+	c.write(connack)
+	for _, msg := range s.inflight {
+		msg.Dup = true
+		c.write(msg)
+	}
+	b.mu.Unlock()
+
+	b.logf("Cliente %s conectado (sesión limpia: %t)", clientID, connect.CleanSession)
+
+	keepAlive := time.Duration(connect.Keepalive) * time.Second * 3 / 2
+	graceful := b.serve(c, keepAlive)
+	b.disconnected(c, graceful)
+}
+
+// serve reads packets until the connection ends, returning true on a DISCONNECT.
+func (b *Broker) serve(c *connection, keepAlive time.Duration) bool {
+	for {
+		deadline := time.Time{}
+		if keepAlive > 0 {
+			deadline = time.Now().Add(keepAlive)
+		}
+		c.conn.SetReadDeadline(deadline)
+
+		packet, err := packets.ReadPacket(c.conn)
+		if err != nil {
+			return false
+		}
+
+		switch p := packet.(type) {
+		case *packets.PublishPacket:
+			if p.Qos > mqtt.AtLeastOnce {
+				b.logf("Cliente %s publicó con QoS %d, no soportado", c.session.clientID, p.Qos)
+				return false
+			}
+			if err := validateTopic(p.TopicName); err != nil {
+				b.logf("Cliente %s: %v", c.session.clientID, err)
+				return false
+			}
+			b.route(p)
+			if p.Qos == mqtt.AtLeastOnce {
+				puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				puback.MessageID = p.MessageID
+				c.write(puback)
+			}
+		case *packets.PubackPacket:
+			b.mu.Lock()
+			c.session.ack(p.MessageID)
+			b.mu.Unlock()
+		case *packets.SubscribePacket:
+			b.subscribe(c, p)
+		case *packets.UnsubscribePacket:
+			b.mu.Lock()
+			for _, filter := range p.Topics {
+				delete(c.session.subscriptions, filter)
+			}
+			b.mu.Unlock()
+			unsuback := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
+			unsuback.MessageID = p.MessageID
+			c.write(unsuback)
+		case *packets.PingreqPacket:
+			c.write(packets.NewControlPacket(packets.Pingresp))
+		case *packets.DisconnectPacket:
+			return true
+		default:
+			b.logf("Cliente %s envió un paquete inesperado: %v", c.session.clientID, packet)
+			return false
+		}
+	}
+}
+
+func (b *Broker) subscribe(c *connection, subscribe *packets.SubscribePacket) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	type retainedDelivery struct {
+		msg *packets.PublishPacket
+		qos byte
+	}
+	suback := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+	suback.MessageID = subscribe.MessageID
+	deliveries := []retainedDelivery{}
+
+	for i, filter := range subscribe.Topics {
+		if err := validateFilter(filter); err != nil {
+			b.logf("Cliente %s: %v", c.session.clientID, err)
+			suback.ReturnCodes = append(suback.ReturnCodes, 0x80)
+			continue
+		}
+
+		qos := min(subscribe.Qoss[i], mqtt.AtLeastOnce)
+		c.session.subscriptions[filter] = qos
+		suback.ReturnCodes = append(suback.ReturnCodes, qos)
+		b.logf("Cliente %s suscrito a %s con QoS %d", c.session.clientID, filter, qos)
+
+		// Shared subscriptions do not receive retained messages.
+		if _, _, shared := splitShared(filter); shared {
+			continue
+		}
+		for topic, msg := range b.retained {
+			if mqtt.MatchTopic(filter, topic) {
+				deliveries = append(deliveries, retainedDelivery{msg: msg, qos: min(msg.Qos, qos)})
+			}
+		}
+	}
+
+	c.write(suback)
+	for _, delivery := range deliveries {
+		c.session.deliver(delivery.msg.TopicName, delivery.msg.Payload, delivery.qos, true)
+	}
+}
+
+func (b *Broker) disconnected(c *connection, graceful bool) {
+	b.mu.Lock()
+	s := c.session
+	will := c.will
+	if graceful {
+		will = nil
+	}
+	if s.conn == c {
+		s.conn = nil
+		if s.clean {
+			delete(b.sessions, s.clientID)
+		}
+	}
+	closed := b.closed
+	b.mu.Unlock()
+
+	if will != nil && !closed {
+		b.route(will)
+	}
+	b.logf("Cliente %s desconectado", s.clientID)
+}
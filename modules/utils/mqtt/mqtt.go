@@ -1,143 +1,353 @@
 package mqtt
 
 import (
-	"crypto/tls"
-	"crypto/x509"
+	"context"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
-	"os"
-	"path/filepath"
+	"strings"
 	"sync"
 	"time"
+)
 
-	mqtt "github.com/eclipse/paho.mqtt.golang"
+const (
+	AtMostOnce  byte = 0
+	AtLeastOnce byte = 1
+	ExactlyOnce byte = 2
 )
 
-var (
-	client         mqtt.Client
-	opts           *mqtt.ClientOptions
-	isConnected    bool
-	connectionLock sync.Mutex
+const (
+	ProtocolV311 byte = 4
+	ProtocolV5   byte = 5
 )
 
-func ConnectClient(MQTTBroker string, MQTTClientID string, MQTTSubTopics []string, handleMessage func(topic string, message []byte)) {
+var ErrNotConnected = errors.New("el cliente MQTT no está conectado")
+
+// Message is a publication. The response topic, correlation data, user
+// properties and expiry are MQTT 5 properties and are dropped on 3.1.1
+// connections.
+type Message struct {
+	Topic   string
+	QoS     byte
+	Retain  bool
+	Payload []byte
+
+	ResponseTopic   string
+	CorrelationData []byte
+	UserProperties  map[string]string
+	MessageExpiry   time.Duration
+}
+
+type Handler func(msg Message)
+
+type Subscription struct {
+	Topic   string
+	QoS     byte
+	Handler Handler
+}
+
+type ClientOptions struct {
+	Broker          string
+	ClientID        string
+	ProtocolVersion byte
+	Subscriptions   []Subscription
+	PublishTimeout  time.Duration
+	Session         SessionOptions
+	// Will is published by the broker when the connection drops without a
+	// disconnect. It defaults to the offline status when Status is set.
+	Will   *Message
+	Status *Status
+	// TLS is only used when Broker has a TLS scheme such as ssl://.
+	TLS TLSOptions
+}
 
-	if MQTTSubTopics == nil {
-		MQTTSubTopics = []string{}
+// ReasonCodeError carries an MQTT 5 failure reason code sent by the broker.
+type ReasonCodeError struct {
+	Code   byte
+	Reason string
+}
+
+func (e *ReasonCodeError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("código de razón 0x%02x", e.Code)
 	}
+	return fmt.Sprintf("código de razón 0x%02x: %s", e.Code, e.Reason)
+}
+
+// connection is implemented by the MQTT 3.1.1 and MQTT 5 backends.
+type connection interface {
+	connect()
+	publish(ctx context.Context, msg Message) error
+	disconnect(quiesce time.Duration)
+}
+
+type Client struct {
+	broker         string
+	clientID       string
+	subscriptions  []Subscription
+	publishTimeout time.Duration
+	conn           connection
+	outbox         *outbox
+	status         *Status
+	flush          chan struct{}
+	connected      bool
+	mu             sync.Mutex
+	stop           chan struct{}
+	stopOnce       sync.Once
+}
 
-	onMessageReceived := func(client mqtt.Client, message mqtt.Message) {
-		handleMessage(message.Topic(), message.Payload())
+func ParseProtocolVersion(value string) (byte, error) {
+	switch strings.TrimSpace(value) {
+	case "", "3.1.1", "4":
+		return ProtocolV311, nil
+	case "5", "5.0":
+		return ProtocolV5, nil
+	default:
+		return 0, fmt.Errorf("invalid MQTT protocol version %q", value)
 	}
+}
 
-	onConnectionLost := func(client mqtt.Client, err error) {
-		connectionLock.Lock()
-		isConnected = false
-		connectionLock.Unlock()
-		log.Println("Conexión perdida:", err)
+func NewClient(opts ClientOptions) (*Client, error) {
+	publishTimeout := opts.PublishTimeout
+	if publishTimeout <= 0 {
+		publishTimeout = 10 * time.Second
 	}
 
-	onConnect := func(client mqtt.Client) {
-		connectionLock.Lock()
-		isConnected = true
-		connectionLock.Unlock()
-		log.Printf("Conexión al broker %s con client-id %s\n", MQTTBroker, MQTTClientID)
-		for _, MQTTSubTopic := range MQTTSubTopics {
-			if token := client.Subscribe(MQTTSubTopic, 0, onMessageReceived); token.Wait() && token.Error() != nil {
-				log.Printf("Error al suscribirse a %s: %v\n", MQTTSubTopic, token.Error())
-			} else {
-				log.Printf("Suscrito al tópico %s\n", MQTTSubTopic)
-			}
+	c := &Client{
+		broker:         opts.Broker,
+		clientID:       opts.ClientID,
+		subscriptions:  opts.Subscriptions,
+		publishTimeout: publishTimeout,
+		status:         opts.Status,
+		flush:          make(chan struct{}, 1),
+		stop:           make(chan struct{}),
+	}
+
+	if dir := opts.Session.clientDir(opts.ClientID, "outbox"); dir != "" {
+		outbox, err := openOutbox(dir, opts.Session.OutboxSize)
+		if err != nil {
+			return nil, err
 		}
+		c.outbox = outbox
 	}
 
-	caFile, certFile, keyFile, err := getCertPaths()
-	if err != nil {
-		log.Fatalf("Error encontrando certificados: %v", err)
+	if opts.Will == nil && opts.Status != nil {
+		opts.Will = opts.Status.will()
 	}
 
-	caCertPool := x509.NewCertPool()
-	caCert, err := ioutil.ReadFile(caFile)
-	if err != nil {
-		log.Fatalf("Error cargando certificado CA: %v", err)
+	var certificates *tlsSource
+	if usesTLS(opts.Broker) {
+		var err error
+		certificates, err = newTLSSource(opts.TLS)
+		if err != nil {
+			return nil, err
+		}
+		go certificates.watch(c.stop)
 	}
-	caCertPool.AppendCertsFromPEM(caCert)
 
-	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
-	if err != nil {
-		log.Fatalf("Error cargando certificado y clave: %v", err)
+	switch opts.ProtocolVersion {
+	case 0, ProtocolV311:
+		conn, err := newV311Connection(c, opts, certificates)
+		if err != nil {
+			return nil, err
+		}
+		c.conn = conn
+	case ProtocolV5:
+		conn, err := newV5Connection(c, opts, certificates)
+		if err != nil {
+			return nil, err
+		}
+		c.conn = conn
+	default:
+		return nil, fmt.Errorf("versión de protocolo MQTT no soportada: %d", opts.ProtocolVersion)
 	}
 
-	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
-	if err != nil {
-		log.Fatalf("Error: %v", err)
+	if c.outbox != nil {
+		go c.flushOutbox()
 	}
 
-	tlsConfig := &tls.Config{
-		Certificates:       []tls.Certificate{cert},
-		RootCAs:            caCertPool,
-		InsecureSkipVerify: true,
-		ClientCAs:          nil,
-		ClientAuth:         tls.NoClientCert,
+	return c, nil
+}
+
+// Connect starts connecting in the background, retrying until the broker is reachable.
+func (c *Client) Connect() {
+	c.conn.connect()
+}
+
+// WaitConnected blocks until the client is connected or ctx is done.
+func (c *Client) WaitConnected(ctx context.Context) error {
+	for !c.IsConnected() {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("broker MQTT %s no disponible: %w", c.broker, ctx.Err())
+		case <-time.After(200 * time.Millisecond):
+		}
 	}
+	return nil
+}
 
-	opts = mqtt.NewClientOptions().
-		AddBroker(MQTTBroker).
-		SetClientID(MQTTClientID).
-		SetConnectionLostHandler(onConnectionLost).
-		SetOnConnectHandler(onConnect).
-		SetAutoReconnect(true).
-		SetMaxReconnectInterval(2 * time.Second).
-		SetConnectRetry(true).
-		SetConnectRetryInterval(2 * time.Second).
-		SetTLSConfig(tlsConfig)
+func (c *Client) setConnected(connected bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.connected = connected
 
-	client = mqtt.NewClient(opts)
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		log.Println("Error al conectar:", token.Error())
+	if connected {
+		c.requestFlush()
+		if c.status != nil {
+			go c.publishStatus(c.status.Online)
+		}
 	}
 }
 
-func PublishData(topic string, data string) {
-	connectionLock.Lock()
-	defer connectionLock.Unlock()
+// dispatch hands an incoming message to every subscription whose filter matches.
+func (c *Client) dispatch(msg Message) {
+	for _, subscription := range c.subscriptions {
+		if MatchTopic(subscription.Topic, msg.Topic) {
+			subscription.Handler(msg)
+		}
+	}
+}
 
-	if client == nil || !isConnected {
-		log.Println("El cliente MQTT no está conectado.")
-		return
+func (c *Client) Publish(topic string, qos byte, retain bool, payload []byte) error {
+	return c.PublishMessage(Message{Topic: topic, QoS: qos, Retain: retain, Payload: payload})
+}
+
+// PublishMessage waits for the broker acknowledgement when the QoS is above
+// AtMostOnce. While disconnected, or while older messages are still buffered,
+// the message goes to the outbox and is sent in order once connected.
+func (c *Client) PublishMessage(msg Message) error {
+	if c.outbox != nil && (!c.IsConnected() || c.outbox.len() > 0) {
+		if err := c.outbox.push(msg); err != nil {
+			return fmt.Errorf("error al publicar en el tópico %s: %w", msg.Topic, err)
+		}
+		log.Printf("Publicación en el tópico %s guardada en el buffer\n", msg.Topic)
+		c.requestFlush()
+		return nil
+	}
+	if !c.IsConnected() {
+		return ErrNotConnected
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.publishTimeout)
+	defer cancel()
+
+	if err := c.conn.publish(ctx, msg); err != nil {
+		return fmt.Errorf("error al publicar en el tópico %s: %w", msg.Topic, err)
+	}
+
+	log.Printf("Mensaje publicado en el tópico %s: %s\n", msg.Topic, msg.Payload)
+	return nil
+}
+
+func (c *Client) requestFlush() {
+	select {
+	case c.flush <- struct{}{}:
+	default:
+	}
+}
+
+func (c *Client) flushOutbox() {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.flush:
+		case <-ticker.C:
+		case <-c.stop:
+			return
+		}
+		c.drainOutbox()
 	}
+}
 
-	token := client.Publish(topic, 0, false, data)
-	token.Wait()
-	if token.Error() != nil {
-		log.Printf("Error al publicar en el tópico %s: %v\n", topic, token.Error())
-	} else {
-		log.Printf("Mensaje publicado en el tópico %s: %s\n", topic, data)
+func (c *Client) drainOutbox() {
+	for c.IsConnected() {
+		entry, sequence, ok, err := c.outbox.peek()
+		if !ok {
+			return
+		}
+		if err != nil {
+			log.Printf("Descartando publicación ilegible del buffer: %v\n", err)
+			c.removeFromOutbox(sequence)
+			continue
+		}
+		msg := entry.Message
+		if entry.expired(time.Now()) {
+			log.Printf("Descartando publicación expirada del buffer en el tópico %s\n", msg.Topic)
+			c.removeFromOutbox(sequence)
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), c.publishTimeout)
+		err = c.conn.publish(ctx, msg)
+		cancel()
+
+		var reasonCode *ReasonCodeError
+		if errors.As(err, &reasonCode) {
+			// The broker will never accept it, retrying would block everything behind it.
+			log.Printf("Publicación del buffer en el tópico %s rechazada por el broker: %v\n", msg.Topic, err)
+		} else if err != nil {
+			log.Printf("Error al enviar publicación del buffer en el tópico %s, se reintentará: %v\n", msg.Topic, err)
+			return
+		} else {
+			log.Printf("Publicación del buffer enviada en el tópico %s\n", msg.Topic)
+		}
+		c.removeFromOutbox(sequence)
 	}
 }
 
-func getCertPaths() (caPath, clientCertPath, clientKeyPath string, err error) {
-	dir, err := os.Executable()
-	if err != nil {
-		return "", "", "", err
+func (c *Client) removeFromOutbox(sequence uint64) {
+	if err := c.outbox.remove(sequence); err != nil {
+		log.Printf("Error eliminando publicación %d del buffer: %v\n", sequence, err)
 	}
+}
 
-	certsDir := filepath.Join(filepath.Dir(dir), "certs")
+func (c *Client) IsConnected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	caPath = filepath.Join(certsDir, "ca-crt.pem")
-	clientCertPath = filepath.Join(certsDir, "client-crt.pem")
-	clientKeyPath = filepath.Join(certsDir, "client-key.pem")
+	return c.connected
+}
 
-	if _, err := os.Stat(caPath); err != nil {
-		return "", "", "", fmt.Errorf("error: CA certificate file not found: %v", err)
+func (c *Client) Disconnect(quiesce time.Duration) {
+	c.stopOnce.Do(func() { close(c.stop) })
+	if c.status != nil && c.IsConnected() {
+		c.publishStatus(c.status.Offline)
 	}
-	if _, err := os.Stat(clientCertPath); err != nil {
-		return "", "", "", fmt.Errorf("error: client certificate file not found: %v", err)
+	c.conn.disconnect(quiesce)
+	c.setConnected(false)
+	log.Printf("Cliente MQTT %s desconectado\n", c.clientID)
+}
+
+// MatchTopic reports whether topic matches a subscription filter with + and #
+// wildcards. Shared subscription prefixes ($share/<group>/) are ignored.
+func MatchTopic(filter string, topic string) bool {
+	if strings.HasPrefix(filter, "$share/") {
+		parts := strings.SplitN(filter, "/", 3)
+		if len(parts) < 3 {
+			return false
+		}
+		filter = parts[2]
 	}
-	if _, err := os.Stat(clientKeyPath); err != nil {
-		return "", "", "", fmt.Errorf("error: client key file not found: %v", err)
+
+	// Wildcards never match topics reserved by the broker, such as $SYS.
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
 	}
 
-	return caPath, clientCertPath, clientKeyPath, nil
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
 }
@@ -0,0 +1,198 @@
+// Integration tests for utils/mqtt against the embedded broker, no external
+// service needed. MQTT_TEST_VERBOSE=1 keeps the client and broker logs.
+package mqtt_test
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"ceiot-tf-background/modules/utils/mqtt"
+	"ceiot-tf-background/modules/utils/mqtt/broker"
+)
+
+const timeout = 5 * time.Second
+
+func TestMain(m *testing.M) {
+	// Client logs only get in the way of the results.
+	if os.Getenv("MQTT_TEST_VERBOSE") == "" {
+		log.SetOutput(io.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+// collector gathers the messages of a subscription.
+type collector chan mqtt.Message
+
+func newCollector() collector {
+	return make(collector, 100)
+}
+
+func (c collector) handler(msg mqtt.Message) {
+	c <- msg
+}
+
+func (c collector) next(t *testing.T) mqtt.Message {
+	t.Helper()
+	select {
+	case msg := <-c:
+		return msg
+	case <-time.After(timeout):
+		t.Fatalf("no message received after %s", timeout)
+		return mqtt.Message{}
+	}
+}
+
+func (c collector) none(t *testing.T, wait time.Duration) {
+	t.Helper()
+	select {
+	case msg := <-c:
+		t.Fatalf("unexpected message on %s: %s", msg.Topic, msg.Payload)
+	case <-time.After(wait):
+	}
+}
+
+func brokerOptions() broker.Options {
+	if os.Getenv("MQTT_TEST_VERBOSE") == "" {
+		return broker.Options{}
+	}
+	return broker.Options{Logf: broker.Logger}
+}
+
+// newBroker starts a broker on a random port, closed when the test ends.
+func newBroker(t *testing.T) *broker.Broker {
+	t.Helper()
+	b := broker.New(brokerOptions())
+	if err := b.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+// connect returns a connected client, disconnected when the test ends.
+func connect(t *testing.T, opts mqtt.ClientOptions) *mqtt.Client {
+	t.Helper()
+	client, err := mqtt.NewClient(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Connect()
+	t.Cleanup(func() { client.Disconnect(0) })
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := client.WaitConnected(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// subscribed waits until the subscription matching topic is active, since
+// WaitConnected returns as soon as the connection is up.
+func subscribed(t *testing.T, b *broker.Broker, topic string, probe collector) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if err := b.Publish(topic, mqtt.AtMostOnce, false, []byte("probe")); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-probe:
+			return
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	t.Fatalf("subscription to %s not active after %s", topic, timeout)
+}
+
+func expectPayload(t *testing.T, c collector, topic string, payload string) {
+	t.Helper()
+	msg := c.next(t)
+	if msg.Topic != topic || string(msg.Payload) != payload {
+		t.Fatalf("got %s %q, want %s %q", msg.Topic, msg.Payload, topic, payload)
+	}
+}
+
+func TestQoS1Wildcard(t *testing.T) {
+	b := newBroker(t)
+	received := newCollector()
+	connect(t, mqtt.ClientOptions{
+		Broker:        b.URL(),
+		ClientID:      "subscriber",
+		Subscriptions: []mqtt.Subscription{{Topic: "devices/+/data", QoS: mqtt.AtLeastOnce, Handler: received.handler}},
+	})
+	subscribed(t, b, "devices/probe/data", received)
+
+	publisher := connect(t, mqtt.ClientOptions{Broker: b.URL(), ClientID: "publisher"})
+	if err := publisher.Publish("devices/d1/data", mqtt.AtLeastOnce, false, []byte(`{"temp":21}`)); err != nil {
+		t.Fatal(err)
+	}
+	msg := received.next(t)
+	if msg.Topic != "devices/d1/data" || msg.QoS != mqtt.AtLeastOnce || string(msg.Payload) != `{"temp":21}` {
+		t.Fatalf("got %+v", msg)
+	}
+
+	// Neither deeper nor sibling topics match a single-level wildcard.
+	publisher.Publish("devices/d1/data/raw", mqtt.AtLeastOnce, false, []byte("x"))
+	publisher.Publish("devices/d1/config", mqtt.AtLeastOnce, false, []byte("x"))
+	received.none(t, 200*time.Millisecond)
+}
+
+func TestQoS0MultiLevel(t *testing.T) {
+	b := newBroker(t)
+	received := newCollector()
+	connect(t, mqtt.ClientOptions{
+		Broker:        b.URL(),
+		ClientID:      "subscriber",
+		Subscriptions: []mqtt.Subscription{{Topic: "server/#", QoS: mqtt.AtMostOnce, Handler: received.handler}},
+	})
+	subscribed(t, b, "server/probe", received)
+
+	publisher := connect(t, mqtt.ClientOptions{Broker: b.URL(), ClientID: "publisher"})
+
+	// A QoS 1 publish is downgraded to the QoS 0 of the subscription.
+	if err := publisher.Publish("server/config/d1", mqtt.AtLeastOnce, false, []byte("cfg")); err != nil {
+		t.Fatal(err)
+	}
+	msg := received.next(t)
+	if msg.Topic != "server/config/d1" || msg.QoS != mqtt.AtMostOnce {
+		t.Fatalf("got %+v", msg)
+	}
+}
+
+func TestRetained(t *testing.T) {
+	b := newBroker(t)
+	publisher := connect(t, mqtt.ClientOptions{Broker: b.URL(), ClientID: "publisher"})
+
+	if err := publisher.Publish("server/status/x", mqtt.AtLeastOnce, true, []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	if err := publisher.Publish("server/status/x", mqtt.AtLeastOnce, true, []byte("online")); err != nil {
+		t.Fatal(err)
+	}
+
+	received := newCollector()
+	connect(t, mqtt.ClientOptions{
+		Broker:        b.URL(),
+		ClientID:      "late-subscriber",
+		Subscriptions: []mqtt.Subscription{{Topic: "server/status/+", QoS: mqtt.AtLeastOnce, Handler: received.handler}},
+	})
+
+	msg := received.next(t)
+	if !msg.Retain || string(msg.Payload) != "online" {
+		t.Fatalf("got %+v, want the last retained message", msg)
+	}
+
+	// An empty retained payload clears the topic.
+	if err := publisher.Publish("server/status/x", mqtt.AtLeastOnce, true, nil); err != nil {
+		t.Fatal(err)
+	}
+	received.next(t)
+	if _, ok := b.Retained("server/status/x"); ok {
+		t.Fatal("retained message not cleared")
+	}
+}
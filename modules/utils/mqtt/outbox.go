@@ -0,0 +1,151 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrOutboxFull = errors.New("el buffer de publicaciones MQTT está lleno")
+
+const outboxExtension = ".msg"
+
+type outboxEntry struct {
+	Message  Message
+	QueuedAt time.Time
+}
+
+// expired reports whether the message expiry ran out while it was buffered,
+// otherwise the expiry is shortened by the time already spent waiting.
+func (e *outboxEntry) expired(now time.Time) bool {
+	if e.Message.MessageExpiry <= 0 {
+		return false
+	}
+	e.Message.MessageExpiry -= now.Sub(e.QueuedAt)
+	return e.Message.MessageExpiry <= 0
+}
+
+// outbox is a bounded FIFO of publishes made while disconnected, one file per
+// message named after its sequence number so the order survives restarts.
+type outbox struct {
+	dir     string
+	maxSize int
+
+	mu      sync.Mutex
+	pending []uint64
+	next    uint64
+}
+
+func openOutbox(dir string, maxSize int) (*outbox, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("error creando el buffer de publicaciones %s: %w", dir, err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error leyendo el buffer de publicaciones %s: %w", dir, err)
+	}
+
+	o := &outbox{dir: dir, maxSize: maxSize, next: 1}
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasSuffix(name, outboxExtension+".tmp") {
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		if entry.IsDir() || !strings.HasSuffix(name, outboxExtension) {
+			continue
+		}
+		sequence, err := strconv.ParseUint(strings.TrimSuffix(name, outboxExtension), 10, 64)
+		if err != nil {
+			continue
+		}
+		o.pending = append(o.pending, sequence)
+	}
+	sort.Slice(o.pending, func(i, j int) bool { return o.pending[i] < o.pending[j] })
+	if len(o.pending) > 0 {
+		o.next = o.pending[len(o.pending)-1] + 1
+	}
+	return o, nil
+}
+
+func (o *outbox) path(sequence uint64) string {
+	return filepath.Join(o.dir, fmt.Sprintf("%020d%s", sequence, outboxExtension))
+}
+
+func (o *outbox) len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.pending)
+}
+
+func (o *outbox) push(msg Message) error {
+	data, err := json.Marshal(outboxEntry{Message: msg, QueuedAt: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.maxSize > 0 && len(o.pending) >= o.maxSize {
+		return ErrOutboxFull
+	}
+
+	sequence := o.next
+	// Write then rename, so a crash never leaves a half-written message behind.
+	tmp := o.path(sequence) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("error guardando la publicación en el buffer: %w", err)
+	}
+	if err := os.Rename(tmp, o.path(sequence)); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("error guardando la publicación en el buffer: %w", err)
+	}
+
+	o.pending = append(o.pending, sequence)
+	o.next++
+	return nil
+}
+
+// peek returns the oldest buffered message without removing it.
+func (o *outbox) peek() (outboxEntry, uint64, bool, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if len(o.pending) == 0 {
+		return outboxEntry{}, 0, false, nil
+	}
+
+	sequence := o.pending[0]
+	data, err := os.ReadFile(o.path(sequence))
+	if err != nil {
+		return outboxEntry{}, sequence, true, fmt.Errorf("error leyendo la publicación %d del buffer: %w", sequence, err)
+	}
+	var entry outboxEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return outboxEntry{}, sequence, true, fmt.Errorf("error leyendo la publicación %d del buffer: %w", sequence, err)
+	}
+	return entry, sequence, true, nil
+}
+
+func (o *outbox) remove(sequence uint64) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if len(o.pending) == 0 || o.pending[0] != sequence {
+		return nil
+	}
+	if err := os.Remove(o.path(sequence)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	o.pending = o.pending[1:]
+	return nil
+}
@@ -0,0 +1,68 @@
+package mqtt_test
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"testing"
+
+	"ceiot-tf-background/modules/utils/mqtt"
+	"ceiot-tf-background/modules/utils/mqtt/broker"
+)
+
+func TestOutbox(t *testing.T) {
+	// Reserve a port with nothing listening, the broker comes up on it later.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	publisher, err := mqtt.NewClient(mqtt.ClientOptions{
+		Broker:   "tcp://" + addr,
+		ClientID: "offline-publisher",
+		Session:  mqtt.SessionOptions{Persistent: true, StoreDir: t.TempDir(), OutboxSize: 3},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Disconnect(0)
+
+	for i := 1; i <= 3; i++ {
+		if err := publisher.Publish("server/config/d1", mqtt.AtLeastOnce, false, []byte(strconv.Itoa(i))); err != nil {
+			t.Fatalf("buffering message %d: %v", i, err)
+		}
+	}
+	if err := publisher.Publish("server/config/d1", mqtt.AtLeastOnce, false, []byte("4")); err == nil {
+		t.Fatal("publish beyond the outbox size was accepted")
+	}
+
+	b := broker.New(brokerOptions())
+	if err := b.Listen(addr); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+
+	received := newCollector()
+	connect(t, mqtt.ClientOptions{
+		Broker:        "tcp://" + addr,
+		ClientID:      "subscriber",
+		Subscriptions: []mqtt.Subscription{{Topic: "server/config/+", QoS: mqtt.AtLeastOnce, Handler: received.handler}},
+	})
+	subscribed(t, b, "server/config/probe", received)
+	// Connecting only now makes sure nothing is flushed before the subscription is in place.
+	publisher.Connect()
+
+	got := [][]byte{}
+	for len(got) < 3 {
+		msg := received.next(t)
+		if msg.Topic == "server/config/probe" {
+			continue
+		}
+		got = append(got, msg.Payload)
+	}
+	if !bytes.Equal(bytes.Join(got, []byte(",")), []byte("1,2,3")) {
+		t.Fatalf("flushed out of order: %s", bytes.Join(got, []byte(",")))
+	}
+}
@@ -0,0 +1,63 @@
+package mqtt
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"ceiot-tf-background/modules/utils/env"
+)
+
+type SessionOptions struct {
+	// Persistent keeps the broker session (clean session off), so QoS 1 and 2
+	// subscriptions keep receiving while the client is down. It relies on a
+	// stable client ID.
+	Persistent bool
+	// Expiry is how long an MQTT 5 broker keeps the session after a disconnect.
+	Expiry time.Duration
+	// StoreDir holds the in-flight message store and the offline outbox, one
+	// folder per client ID. Without it nothing is kept on disk and publishing
+	// while disconnected fails with ErrNotConnected.
+	StoreDir string
+	// OutboxSize caps how many publishes are buffered while disconnected.
+	OutboxSize int
+}
+
+// SessionFromEnv reads the session and offline buffering settings shared by every service.
+func SessionFromEnv() (SessionOptions, error) {
+	persistent, err := env.GetBool("MQTT_SESSION_PERSISTENT", true)
+	if err != nil {
+		return SessionOptions{}, err
+	}
+	expiry, err := env.GetDuration("MQTT_SESSION_EXPIRY", 24*time.Hour)
+	if err != nil {
+		return SessionOptions{}, err
+	}
+	outboxSize, err := env.GetInt("MQTT_OUTBOX_SIZE", 10000)
+	if err != nil {
+		return SessionOptions{}, err
+	}
+
+	return SessionOptions{
+		Persistent: persistent,
+		Expiry:     expiry,
+		StoreDir:   env.GetString("MQTT_STORE_DIR", defaultStoreDir()),
+		OutboxSize: outboxSize,
+	}, nil
+}
+
+// defaultStoreDir keeps the store next to the executable, like the certs folder.
+func defaultStoreDir() string {
+	executable, err := os.Executable()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(executable), "mqtt-store")
+}
+
+func (o SessionOptions) clientDir(clientID string, name string) string {
+	if o.StoreDir == "" {
+		return ""
+	}
+	return filepath.Join(o.StoreDir, clientID, name)
+}
@@ -0,0 +1,32 @@
+package mqtt_test
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"ceiot-tf-background/modules/utils/mqtt"
+)
+
+func TestPersistentSession(t *testing.T) {
+	b := newBroker(t)
+	received := newCollector()
+	opts := mqtt.ClientOptions{
+		Broker:        b.URL(),
+		ClientID:      "persistent-subscriber",
+		Session:       mqtt.SessionOptions{Persistent: true},
+		Subscriptions: []mqtt.Subscription{{Topic: "devices/+/config", QoS: mqtt.AtLeastOnce, Handler: received.handler}},
+	}
+	subscriber := connect(t, opts)
+	subscribed(t, b, "devices/probe/config", received)
+	subscriber.Disconnect(250 * time.Millisecond)
+
+	for i := 1; i <= 3; i++ {
+		b.Publish("devices/d1/config", mqtt.AtLeastOnce, false, []byte(strconv.Itoa(i)))
+	}
+
+	connect(t, opts)
+	for i := 1; i <= 3; i++ {
+		expectPayload(t, received, "devices/d1/config", strconv.Itoa(i))
+	}
+}
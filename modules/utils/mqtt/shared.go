@@ -0,0 +1,40 @@
+package mqtt
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// SharedTopic turns a filter into a shared subscription, so the broker hands
+// each message to only one of the clients subscribed with the same group.
+// An empty group leaves the filter as is.
+func SharedTopic(group string, topic string) string {
+	if group == "" {
+		return topic
+	}
+	return fmt.Sprintf("$share/%s/%s", group, topic)
+}
+
+// ReplicaClientID appends the replica identity to base so replicas do not
+// take over each other's connection. MQTT_REPLICA_ID wins over the hostname,
+// and should be set to something stable when sessions are persistent.
+func ReplicaClientID(base string) (string, error) {
+	replicaID := os.Getenv("MQTT_REPLICA_ID")
+	if replicaID == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return "", fmt.Errorf("error obteniendo el hostname para el client-id MQTT: %w", err)
+		}
+		replicaID = hostname
+	}
+
+	replicaID = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		}
+		return '-'
+	}, replicaID)
+	return base + "-" + replicaID, nil
+}
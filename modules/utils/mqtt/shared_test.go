@@ -0,0 +1,60 @@
+package mqtt_test
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"ceiot-tf-background/modules/utils/mqtt"
+)
+
+func TestSharedSubscription(t *testing.T) {
+	b := newBroker(t)
+	topic := mqtt.SharedTopic("data-reception", "devices/+/data")
+	received := map[string]collector{"replica-a": newCollector(), "replica-b": newCollector()}
+	for id, replicaReceived := range received {
+		connect(t, mqtt.ClientOptions{
+			Broker:        b.URL(),
+			ClientID:      id,
+			Subscriptions: []mqtt.Subscription{{Topic: topic, QoS: mqtt.AtLeastOnce, Handler: replicaReceived.handler}},
+		})
+	}
+
+	// Probe until both replicas got a message, the broker alternates between them.
+	deadline := time.Now().Add(timeout)
+	for !(len(received["replica-a"]) > 0 && len(received["replica-b"]) > 0) {
+		if time.Now().After(deadline) {
+			t.Fatalf("shared subscriptions not active after %s", timeout)
+		}
+		b.Publish("devices/probe/data", mqtt.AtMostOnce, false, []byte("probe"))
+		time.Sleep(50 * time.Millisecond)
+	}
+	for _, replicaReceived := range received {
+		for len(replicaReceived) > 0 {
+			<-replicaReceived
+		}
+	}
+
+	publisher := connect(t, mqtt.ClientOptions{Broker: b.URL(), ClientID: "publisher"})
+
+	const total = 10
+	for i := 0; i < total; i++ {
+		if err := publisher.Publish("devices/d"+strconv.Itoa(i)+"/data", mqtt.AtLeastOnce, false, []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	perReplica := map[string]int{}
+	sum := 0
+	for id, replicaReceived := range received {
+		perReplica[id] = len(replicaReceived)
+		sum += perReplica[id]
+	}
+	if sum != total {
+		t.Fatalf("%d message(s) delivered for %d published: %v", sum, total, perReplica)
+	}
+	if perReplica["replica-a"] == 0 || perReplica["replica-b"] == 0 {
+		t.Fatalf("messages not balanced between replicas: %v", perReplica)
+	}
+}
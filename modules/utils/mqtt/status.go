@@ -0,0 +1,56 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+)
+
+const (
+	StatusOnline  = "online"
+	StatusOffline = "offline"
+)
+
+// Status is a retained presence message. Online is published on every
+// connect, Offline on a graceful disconnect and, through the Last Will, by
+// the broker when the connection drops.
+type Status struct {
+	Topic   string
+	QoS     byte
+	Online  []byte
+	Offline []byte
+}
+
+type statusPayload struct {
+	Service  string `json:"service"`
+	ClientID string `json:"clientId"`
+	Status   string `json:"status"`
+}
+
+func ServiceStatus(topic string, service string, clientID string) *Status {
+	online, _ := json.Marshal(statusPayload{Service: service, ClientID: clientID, Status: StatusOnline})
+	offline, _ := json.Marshal(statusPayload{Service: service, ClientID: clientID, Status: StatusOffline})
+	return &Status{
+		Topic:   topic,
+		QoS:     AtLeastOnce,
+		Online:  online,
+		Offline: offline,
+	}
+}
+
+func (s *Status) will() *Message {
+	return &Message{Topic: s.Topic, QoS: s.QoS, Retain: true, Payload: s.Offline}
+}
+
+// publishStatus goes straight to the broker, buffering a presence message for later would be misleading.
+func (c *Client) publishStatus(payload []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.publishTimeout)
+	defer cancel()
+
+	msg := Message{Topic: c.status.Topic, QoS: c.status.QoS, Retain: true, Payload: payload}
+	if err := c.conn.publish(ctx, msg); err != nil {
+		log.Printf("Error al publicar el estado en el tópico %s: %v\n", c.status.Topic, err)
+		return
+	}
+	log.Printf("Estado publicado en el tópico %s: %s\n", c.status.Topic, payload)
+}
@@ -0,0 +1,56 @@
+package mqtt_test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"ceiot-tf-background/modules/utils/mqtt"
+)
+
+func TestStatusAndWill(t *testing.T) {
+	b := newBroker(t)
+	const topic = "server/status/test-service"
+	statuses := newCollector()
+	connect(t, mqtt.ClientOptions{
+		Broker:        b.URL(),
+		ClientID:      "dashboard",
+		Subscriptions: []mqtt.Subscription{{Topic: "server/status/+", QoS: mqtt.AtLeastOnce, Handler: statuses.handler}},
+	})
+	subscribed(t, b, "server/status/probe", statuses)
+
+	client := connect(t, mqtt.ClientOptions{
+		Broker:   b.URL(),
+		ClientID: "test-service",
+		Status:   mqtt.ServiceStatus(topic, "test-service", "test-service"),
+	})
+	expectStatus(t, statuses, topic, mqtt.StatusOnline)
+
+	// The broker publishes the will when the connection drops, the client then reconnects.
+	b.DropClient("test-service")
+	expectStatus(t, statuses, topic, mqtt.StatusOffline)
+	expectStatus(t, statuses, topic, mqtt.StatusOnline)
+
+	client.Disconnect(250 * time.Millisecond)
+	expectStatus(t, statuses, topic, mqtt.StatusOffline)
+
+	payload, _ := b.Retained(topic)
+	if !strings.Contains(string(payload), mqtt.StatusOffline) {
+		t.Fatalf("retained status is %s, want offline", payload)
+	}
+}
+
+func expectStatus(t *testing.T, statuses collector, topic string, want string) {
+	t.Helper()
+	msg := statuses.next(t)
+	var status struct {
+		Status string `json:"status"`
+	}
+	if err := json.Unmarshal(msg.Payload, &status); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Topic != topic || status.Status != want {
+		t.Fatalf("got %s %s, want %s %s", msg.Topic, msg.Payload, topic, want)
+	}
+}
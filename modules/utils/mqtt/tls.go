@@ -0,0 +1,271 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"ceiot-tf-background/modules/utils/env"
+)
+
+type TLSOptions struct {
+	CAFile   string
+	CertFile string
+	KeyFile  string
+	// PEM contents take precedence over the matching file and are never reloaded.
+	CAPEM   string
+	CertPEM string
+	KeyPEM  string
+
+	ServerName         string
+	InsecureSkipVerify bool
+	ReloadInterval     time.Duration
+}
+
+// TLSFromEnv reads the broker TLS settings shared by every service.
+func TLSFromEnv() (TLSOptions, error) {
+	insecureSkipVerify, err := env.GetBool("MQTT_TLS_INSECURE_SKIP_VERIFY", false)
+	if err != nil {
+		return TLSOptions{}, err
+	}
+	reloadInterval, err := env.GetDuration("MQTT_TLS_RELOAD_INTERVAL", 30*time.Second)
+	if err != nil {
+		return TLSOptions{}, err
+	}
+
+	return TLSOptions{
+		CAFile:             os.Getenv("MQTT_TLS_CA_FILE"),
+		CertFile:           os.Getenv("MQTT_TLS_CERT_FILE"),
+		KeyFile:            os.Getenv("MQTT_TLS_KEY_FILE"),
+		CAPEM:              os.Getenv("MQTT_TLS_CA_PEM"),
+		CertPEM:            os.Getenv("MQTT_TLS_CERT_PEM"),
+		KeyPEM:             os.Getenv("MQTT_TLS_KEY_PEM"),
+		ServerName:         os.Getenv("MQTT_TLS_SERVER_NAME"),
+		InsecureSkipVerify: insecureSkipVerify,
+		ReloadInterval:     reloadInterval,
+	}, nil
+}
+
+// BrokerURL builds the broker address from MQTT_PROTOCOL, where mqtt means a
+// plain tcp:// connection and ssl, tls or mqtts a TLS one.
+func BrokerURL(protocol string, host string, port string) string {
+	switch strings.ToLower(strings.TrimSpace(protocol)) {
+	case "", "mqtt", "tcp":
+		protocol = "tcp"
+	case "mqtts", "tls":
+		protocol = "ssl"
+	}
+	return fmt.Sprintf("%s://%s:%s", protocol, host, port)
+}
+
+func usesTLS(broker string) bool {
+	u, err := url.Parse(broker)
+	if err != nil {
+		return false
+	}
+	switch u.Scheme {
+	case "ssl", "tls", "mqtts", "mqtt+ssl", "tcps", "wss":
+		return true
+	}
+	return false
+}
+
+func (o TLSOptions) withDefaults() (TLSOptions, error) {
+	if o.CAFile != "" || o.CertFile != "" || o.KeyFile != "" || o.CAPEM != "" || o.CertPEM != "" || o.KeyPEM != "" {
+		return o, nil
+	}
+
+	// Nothing configured, keep using the certs folder next to the executable.
+	caFile, certFile, keyFile, err := getCertPaths()
+	if err != nil {
+		return o, fmt.Errorf("error encontrando certificados: %w", err)
+	}
+	o.CAFile, o.CertFile, o.KeyFile = caFile, certFile, keyFile
+	return o, nil
+}
+
+// tlsSource keeps the TLS configuration used for every new connection and
+// rebuilds it when the certificate files change on disk.
+type tlsSource struct {
+	opts     TLSOptions
+	mu       sync.RWMutex
+	config   *tls.Config
+	modTimes map[string]time.Time
+}
+
+func newTLSSource(opts TLSOptions) (*tlsSource, error) {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &tlsSource{opts: opts}
+	config, modTimes, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	s.config, s.modTimes = config, modTimes
+	return s, nil
+}
+
+func (s *tlsSource) current() *tls.Config {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.config
+}
+
+func (s *tlsSource) files() []string {
+	files := []string{}
+	if s.opts.CAPEM == "" && s.opts.CAFile != "" {
+		files = append(files, s.opts.CAFile)
+	}
+	if s.opts.CertPEM == "" && s.opts.CertFile != "" {
+		files = append(files, s.opts.CertFile)
+	}
+	if s.opts.KeyPEM == "" && s.opts.KeyFile != "" {
+		files = append(files, s.opts.KeyFile)
+	}
+	return files
+}
+
+func (s *tlsSource) load() (*tls.Config, map[string]time.Time, error) {
+	modTimes := map[string]time.Time{}
+	for _, file := range s.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error leyendo %s: %w", file, err)
+		}
+		modTimes[file] = info.ModTime()
+	}
+
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         s.opts.ServerName,
+		InsecureSkipVerify: s.opts.InsecureSkipVerify,
+	}
+
+	caCert, err := readPEM(s.opts.CAPEM, s.opts.CAFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error cargando certificado CA: %w", err)
+	}
+	if caCert != nil {
+		caCertPool := x509.NewCertPool()
+		if !caCertPool.AppendCertsFromPEM(caCert) {
+			return nil, nil, errors.New("error cargando certificado CA: no se encontraron certificados")
+		}
+		config.RootCAs = caCertPool
+	}
+
+	cert, err := readPEM(s.opts.CertPEM, s.opts.CertFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error cargando certificado: %w", err)
+	}
+	key, err := readPEM(s.opts.KeyPEM, s.opts.KeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error cargando clave: %w", err)
+	}
+	if (cert == nil) != (key == nil) {
+		return nil, nil, errors.New("el certificado y la clave del cliente deben configurarse juntos")
+	}
+	if cert != nil {
+		keyPair, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error cargando certificado y clave: %w", err)
+		}
+		config.Certificates = []tls.Certificate{keyPair}
+	}
+
+	return config, modTimes, nil
+}
+
+func readPEM(contents string, file string) ([]byte, error) {
+	if contents != "" {
+		return []byte(contents), nil
+	}
+	if file == "" {
+		return nil, nil
+	}
+	return os.ReadFile(file)
+}
+
+// watch polls the certificate files until stop is closed. A new configuration
+// only applies from the next connection, the current one is kept as is.
+func (s *tlsSource) watch(stop <-chan struct{}) {
+	if s.opts.ReloadInterval <= 0 || len(s.files()) == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(s.opts.ReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.reloadIfChanged()
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (s *tlsSource) reloadIfChanged() {
+	changed := false
+	for _, file := range s.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			log.Printf("Error verificando %s: %v\n", file, err)
+			return
+		}
+		if !info.ModTime().Equal(s.modTimes[file]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+
+	// Files are often replaced one at a time, a half-written pair is retried on the next tick.
+	config, modTimes, err := s.load()
+	if err != nil {
+		log.Printf("Error recargando certificados, se mantienen los anteriores: %v\n", err)
+		return
+	}
+
+	s.mu.Lock()
+	s.config, s.modTimes = config, modTimes
+	s.mu.Unlock()
+	log.Println("Certificados MQTT recargados")
+}
+
+func getCertPaths() (caPath, clientCertPath, clientKeyPath string, err error) {
+	dir, err := os.Executable()
+	if err != nil {
+		return "", "", "", err
+	}
+
+	certsDir := filepath.Join(filepath.Dir(dir), "certs")
+
+	caPath = filepath.Join(certsDir, "ca-crt.pem")
+	clientCertPath = filepath.Join(certsDir, "client-crt.pem")
+	clientKeyPath = filepath.Join(certsDir, "client-key.pem")
+
+	if _, err := os.Stat(caPath); err != nil {
+		return "", "", "", fmt.Errorf("error: CA certificate file not found: %v", err)
+	}
+	if _, err := os.Stat(clientCertPath); err != nil {
+		return "", "", "", fmt.Errorf("error: client certificate file not found: %v", err)
+	}
+	if _, err := os.Stat(clientKeyPath); err != nil {
+		return "", "", "", fmt.Errorf("error: client key file not found: %v", err)
+	}
+
+	return caPath, clientCertPath, clientKeyPath, nil
+}
@@ -0,0 +1,123 @@
+package mqtt
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// v311Connection talks MQTT 3.1.1, MQTT 5 properties are not sent.
+type v311Connection struct {
+	owner  *Client
+	client mqtt.Client
+}
+
+func newV311Connection(owner *Client, opts ClientOptions, certificates *tlsSource) (*v311Connection, error) {
+	conn := &v311Connection{owner: owner}
+
+	clientOpts := mqtt.NewClientOptions().
+		AddBroker(opts.Broker).
+		SetClientID(opts.ClientID).
+		SetProtocolVersion(uint(ProtocolV311)).
+		SetConnectionLostHandler(conn.onConnectionLost).
+		SetOnConnectHandler(conn.onConnect).
+		SetCleanSession(!opts.Session.Persistent).
+		SetAutoReconnect(true).
+		SetMaxReconnectInterval(2 * time.Second).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(2 * time.Second)
+
+	if opts.Will != nil {
+		clientOpts.SetBinaryWill(opts.Will.Topic, opts.Will.Payload, opts.Will.QoS, opts.Will.Retain)
+	}
+
+	if certificates != nil {
+		// Every connection attempt picks up the latest reloaded certificates.
+		clientOpts.SetTLSConfig(certificates.current()).
+			SetConnectionAttemptHandler(func(broker *url.URL, tlsConfig *tls.Config) *tls.Config {
+				return certificates.current()
+			})
+	}
+
+	// In-flight QoS 1 and 2 messages are kept on disk and resent after a restart.
+	if dir := opts.Session.clientDir(opts.ClientID, "session"); dir != "" {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, fmt.Errorf("error creando el almacén de sesión %s: %w", dir, err)
+		}
+		clientOpts.SetStore(mqtt.NewFileStore(dir))
+	}
+
+	conn.client = mqtt.NewClient(clientOpts)
+	// A persistent session may deliver queued messages right after connecting,
+	// before onConnect subscribes again, so the routes must already be in place.
+	// Subscribe registers shared subscriptions without the $share/<group>/
+	// prefix, the route has to use the same key or messages are handled twice.
+	for _, subscription := range owner.subscriptions {
+		route := subscription.Topic
+		if strings.HasPrefix(route, "$share/") {
+			route = strings.Join(strings.Split(route, "/")[2:], "/")
+		}
+		conn.client.AddRoute(route, conn.messageHandler(subscription.Handler))
+	}
+	return conn, nil
+}
+
+func (v *v311Connection) connect() {
+	token := v.client.Connect()
+	go func() {
+		if token.Wait() && token.Error() != nil {
+			log.Println("Error al conectar:", token.Error())
+		}
+	}()
+}
+
+func (v *v311Connection) onConnect(client mqtt.Client) {
+	v.owner.setConnected(true)
+	log.Printf("Conexión al broker %s con client-id %s\n", v.owner.broker, v.owner.clientID)
+
+	for _, subscription := range v.owner.subscriptions {
+		if token := client.Subscribe(subscription.Topic, subscription.QoS, v.messageHandler(subscription.Handler)); token.Wait() && token.Error() != nil {
+			log.Printf("Error al suscribirse a %s: %v\n", subscription.Topic, token.Error())
+		} else {
+			log.Printf("Suscrito al tópico %s con QoS %d\n", subscription.Topic, subscription.QoS)
+		}
+	}
+}
+
+func (v *v311Connection) messageHandler(handler Handler) mqtt.MessageHandler {
+	return func(client mqtt.Client, message mqtt.Message) {
+		handler(Message{
+			Topic:   message.Topic(),
+			QoS:     message.Qos(),
+			Retain:  message.Retained(),
+			Payload: message.Payload(),
+		})
+	}
+}
+
+func (v *v311Connection) onConnectionLost(client mqtt.Client, err error) {
+	v.owner.setConnected(false)
+	log.Println("Conexión perdida:", err)
+}
+
+func (v *v311Connection) publish(ctx context.Context, msg Message) error {
+	token := v.client.Publish(msg.Topic, msg.QoS, msg.Retain, msg.Payload)
+	select {
+	case <-token.Done():
+		return token.Error()
+	case <-ctx.Done():
+		return errors.New("tiempo de espera agotado")
+	}
+}
+
+func (v *v311Connection) disconnect(quiesce time.Duration) {
+	v.client.Disconnect(uint(quiesce.Milliseconds()))
+}
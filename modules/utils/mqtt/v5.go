@@ -0,0 +1,252 @@
+package mqtt
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/eclipse/paho.golang/paho/session/state"
+	"github.com/eclipse/paho.golang/paho/store/file"
+)
+
+const connectTimeout = 10 * time.Second
+
+// v5Connection talks MQTT 5 and maps the request/response properties of
+// Message onto the wire.
+type v5Connection struct {
+	owner  *Client
+	config autopaho.ClientConfig
+
+	mu      sync.Mutex
+	manager *autopaho.ConnectionManager
+	cancel  context.CancelFunc
+}
+
+func newV5Connection(owner *Client, opts ClientOptions, certificates *tlsSource) (*v5Connection, error) {
+	broker, err := url.Parse(opts.Broker)
+	if err != nil {
+		return nil, fmt.Errorf("URL de broker MQTT inválida %s: %w", opts.Broker, err)
+	}
+
+	conn := &v5Connection{owner: owner}
+	conn.config = autopaho.ClientConfig{
+		ServerUrls:                    []*url.URL{broker},
+		KeepAlive:                     30,
+		CleanStartOnInitialConnection: !opts.Session.Persistent,
+		ConnectRetryDelay:             2 * time.Second,
+		ConnectTimeout:                connectTimeout,
+		OnConnectionUp:                conn.onConnectionUp,
+		OnConnectError: func(err error) {
+			log.Println("Error al conectar:", err)
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID: opts.ClientID,
+			OnPublishReceived: []func(paho.PublishReceived) (bool, error){
+				conn.onPublishReceived,
+			},
+			OnClientError: func(err error) {
+				owner.setConnected(false)
+				log.Println("Conexión perdida:", err)
+			},
+			OnServerDisconnect: func(disconnect *paho.Disconnect) {
+				owner.setConnected(false)
+				log.Println("Conexión cerrada por el broker:", disconnectReason(disconnect))
+			},
+		},
+	}
+
+	if opts.Will != nil {
+		conn.config.WillMessage = &paho.WillMessage{
+			Topic:   opts.Will.Topic,
+			QoS:     opts.Will.QoS,
+			Retain:  opts.Will.Retain,
+			Payload: opts.Will.Payload,
+		}
+	}
+
+	if opts.Session.Persistent && opts.Session.Expiry > 0 {
+		conn.config.SessionExpiryInterval = uint32(opts.Session.Expiry / time.Second)
+	}
+
+	if dir := opts.Session.clientDir(opts.ClientID, "session"); dir != "" {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, fmt.Errorf("error creando el almacén de sesión %s: %w", dir, err)
+		}
+		clientStore, err := file.New(dir, "client-", ".pkt")
+		if err != nil {
+			return nil, fmt.Errorf("error abriendo el almacén de sesión %s: %w", dir, err)
+		}
+		serverStore, err := file.New(dir, "server-", ".pkt")
+		if err != nil {
+			return nil, fmt.Errorf("error abriendo el almacén de sesión %s: %w", dir, err)
+		}
+		// In-flight QoS 1 and 2 messages are kept on disk and resent after a restart.
+		conn.config.Session = state.New(clientStore, serverStore)
+	}
+
+	if certificates != nil {
+		// Every connection attempt picks up the latest reloaded certificates.
+		conn.config.AttemptConnection = func(ctx context.Context, config autopaho.ClientConfig, broker *url.URL) (net.Conn, error) {
+			ctx, cancel := context.WithTimeout(ctx, connectTimeout)
+			defer cancel()
+
+			dialer := tls.Dialer{Config: certificates.current()}
+			tlsConn, err := dialer.DialContext(ctx, "tcp", broker.Host)
+			if err != nil {
+				return nil, err
+			}
+			return packets.NewThreadSafeConn(tlsConn), nil
+		}
+	}
+
+	return conn, nil
+}
+
+func (v *v5Connection) connect() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.manager != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	manager, err := autopaho.NewConnection(ctx, v.config)
+	if err != nil {
+		cancel()
+		log.Println("Error al conectar:", err)
+		return
+	}
+	v.manager, v.cancel = manager, cancel
+}
+
+func (v *v5Connection) onConnectionUp(manager *autopaho.ConnectionManager, connack *paho.Connack) {
+	v.owner.setConnected(true)
+	log.Printf("Conexión al broker %s con client-id %s (MQTT 5)\n", v.owner.broker, v.owner.clientID)
+
+	for _, subscription := range v.owner.subscriptions {
+		ctx, cancel := context.WithTimeout(context.Background(), v.owner.publishTimeout)
+		suback, err := manager.Subscribe(ctx, &paho.Subscribe{
+			Subscriptions: []paho.SubscribeOptions{{Topic: subscription.Topic, QoS: subscription.QoS}},
+		})
+		cancel()
+
+		if suback != nil && len(suback.Reasons) > 0 && suback.Reasons[0] >= 0x80 {
+			reason := ""
+			if suback.Properties != nil {
+				reason = suback.Properties.ReasonString
+			}
+			err = &ReasonCodeError{Code: suback.Reasons[0], Reason: reason}
+		}
+		if err != nil {
+			log.Printf("Error al suscribirse a %s: %v\n", subscription.Topic, err)
+			continue
+		}
+		if suback == nil || len(suback.Reasons) == 0 {
+			log.Printf("Suscrito al tópico %s\n", subscription.Topic)
+			continue
+		}
+		log.Printf("Suscrito al tópico %s con QoS %d\n", subscription.Topic, suback.Reasons[0])
+	}
+}
+
+func (v *v5Connection) onPublishReceived(received paho.PublishReceived) (bool, error) {
+	publish := received.Packet
+	msg := Message{
+		Topic:   publish.Topic,
+		QoS:     publish.QoS,
+		Retain:  publish.Retain,
+		Payload: publish.Payload,
+	}
+	if properties := publish.Properties; properties != nil {
+		msg.ResponseTopic = properties.ResponseTopic
+		msg.CorrelationData = properties.CorrelationData
+		if properties.MessageExpiry != nil {
+			msg.MessageExpiry = time.Duration(*properties.MessageExpiry) * time.Second
+		}
+		if len(properties.User) > 0 {
+			msg.UserProperties = make(map[string]string, len(properties.User))
+			for _, property := range properties.User {
+				msg.UserProperties[property.Key] = property.Value
+			}
+		}
+	}
+
+	v.owner.dispatch(msg)
+	return true, nil
+}
+
+func (v *v5Connection) publish(ctx context.Context, msg Message) error {
+	v.mu.Lock()
+	manager := v.manager
+	v.mu.Unlock()
+	if manager == nil {
+		return ErrNotConnected
+	}
+
+	publish := &paho.Publish{
+		Topic:   msg.Topic,
+		QoS:     msg.QoS,
+		Retain:  msg.Retain,
+		Payload: msg.Payload,
+		Properties: &paho.PublishProperties{
+			ResponseTopic:   msg.ResponseTopic,
+			CorrelationData: msg.CorrelationData,
+		},
+	}
+	if msg.MessageExpiry > 0 {
+		// The broker counts in whole seconds, round up so a short expiry never becomes none.
+		expiry := uint32((msg.MessageExpiry + time.Second - 1) / time.Second)
+		publish.Properties.MessageExpiry = &expiry
+	}
+	for key, value := range msg.UserProperties {
+		publish.Properties.User.Add(key, value)
+	}
+
+	response, err := manager.Publish(ctx, publish)
+	if response != nil && response.ReasonCode >= 0x80 {
+		reason := ""
+		if response.Properties != nil {
+			reason = response.Properties.ReasonString
+		}
+		return &ReasonCodeError{Code: response.ReasonCode, Reason: reason}
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return errors.New("tiempo de espera agotado")
+	}
+	return err
+}
+
+func (v *v5Connection) disconnect(quiesce time.Duration) {
+	v.mu.Lock()
+	manager, cancel := v.manager, v.cancel
+	v.manager, v.cancel = nil, nil
+	v.mu.Unlock()
+	if manager == nil {
+		return
+	}
+
+	ctx, cancelDisconnect := context.WithTimeout(context.Background(), quiesce)
+	defer cancelDisconnect()
+	if err := manager.Disconnect(ctx); err != nil {
+		log.Println("Error al desconectar:", err)
+	}
+	cancel()
+}
+
+func disconnectReason(disconnect *paho.Disconnect) error {
+	reason := ""
+	if disconnect.Properties != nil {
+		reason = disconnect.Properties.ReasonString
+	}
+	return &ReasonCodeError{Code: disconnect.ReasonCode, Reason: reason}
+}
@@ -0,0 +1,228 @@
+package parameters
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+var ErrInvalidPayload = errors.New("invalid data payload format")
+
+type FieldError struct {
+	Field  string
+	Reason string
+}
+
+// ValidationError lists every problem found in a payload, it matches ErrInvalidPayload with errors.Is.
+type ValidationError struct {
+	Parameter string
+	Fields    []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	problems := make([]string, len(e.Fields))
+	for i, field := range e.Fields {
+		problems[i] = field.Field + " " + field.Reason
+	}
+	return fmt.Sprintf("invalid %s payload: %s", e.Parameter, strings.Join(problems, "; "))
+}
+
+func (e *ValidationError) Unwrap() error {
+	return ErrInvalidPayload
+}
+
+// Entry is one row of a reading. Key holds the dimension value and Values
+// the fields by name, as int64, float64, string or []string depending on
+// their kind.
+type Entry struct {
+	Key    string
+	Values map[string]any
+}
+
+// Number returns a numeric field as float64.
+func (e Entry) Number(name string) (float64, bool) {
+	switch value := e.Values[name].(type) {
+	case int64:
+		return float64(value), true
+	case float64:
+		return value, true
+	}
+	return 0, false
+}
+
+// Decode checks data against the schema of the parameter and returns its
+// entries, sorted by key.
+func (p *Parameter) Decode(data json.RawMessage) ([]Entry, error) {
+	v := &Validator{}
+	entries := p.decode(v, data)
+	if err := v.Err(p.ID); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// DecodeInto is Decode for callers that report more problems along with the
+// ones of data, such as missing payload metadata.
+func (p *Parameter) DecodeInto(v *Validator, data json.RawMessage) []Entry {
+	return p.decode(v, data)
+}
+
+func (p *Parameter) decode(v *Validator, data json.RawMessage) []Entry {
+	switch p.Shape {
+	case ShapeEntries:
+		members := v.members("Data", data)
+		entries := []Entry{}
+		for _, key := range sortedKeys(members) {
+			o := v.object("Data."+key, members[key])
+			entries = append(entries, Entry{Key: key, Values: p.fields(v, o)})
+		}
+		return entries
+	case ShapeValues:
+		members := v.members("Data", data)
+		field := p.Fields[0]
+		entries := []Entry{}
+		for _, key := range sortedKeys(members) {
+			value := v.value(field, "Data."+key, members[key])
+			entries = append(entries, Entry{Key: key, Values: map[string]any{field.Name: value}})
+		}
+		return entries
+	default:
+		o := v.object("Data", data)
+		return []Entry{{Values: p.fields(v, o)}}
+	}
+}
+
+func (p *Parameter) fields(v *Validator, o object) map[string]any {
+	values := map[string]any{}
+	// A payload that is not an object was already reported.
+	if o.fields == nil {
+		return values
+	}
+	for _, field := range p.Fields {
+		raw, name, ok := o.lookup(field)
+		path := o.path + "." + name
+		if !ok || string(raw) == "null" {
+			v.Fail(path, "is required")
+			continue
+		}
+		values[field.Name] = v.value(field, path, raw)
+	}
+	return values
+}
+
+// Validator collects field errors so a payload reports all of its problems at once.
+type Validator struct {
+	errs []FieldError
+}
+
+func (v *Validator) Fail(field string, reason string) {
+	v.errs = append(v.errs, FieldError{Field: field, Reason: reason})
+}
+
+// Err returns a ValidationError for parameter when any problem was found.
+func (v *Validator) Err(parameter string) error {
+	if len(v.errs) == 0 {
+		return nil
+	}
+	return &ValidationError{Parameter: parameter, Fields: v.errs}
+}
+
+type object struct {
+	path   string
+	fields map[string]json.RawMessage
+}
+
+// lookup returns the raw value of field and the name it was sent under,
+// preferring Name over its aliases.
+func (o object) lookup(field Field) (json.RawMessage, string, bool) {
+	for _, name := range append([]string{field.Name}, field.Aliases...) {
+		if raw, ok := o.fields[name]; ok {
+			return raw, name, true
+		}
+	}
+	return nil, field.Name, false
+}
+
+func (v *Validator) members(path string, data json.RawMessage) map[string]json.RawMessage {
+	members := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &members); err != nil || members == nil {
+		v.Fail(path, "must be an object")
+		return nil
+	}
+	return members
+}
+
+func (v *Validator) object(path string, data json.RawMessage) object {
+	return object{path: path, fields: v.members(path, data)}
+}
+
+func (v *Validator) value(field Field, path string, raw json.RawMessage) any {
+	switch field.Kind {
+	case KindCounter:
+		value, ok := v.number(path, raw)
+		if !ok {
+			return nil
+		}
+		if value != math.Trunc(value) || value > math.MaxInt64 {
+			v.Fail(path, "must be an integer")
+			return nil
+		}
+		if value < 0 {
+			v.Fail(path, "must not be negative")
+			return nil
+		}
+		return int64(value)
+	case KindPercent:
+		value, ok := v.number(path, raw)
+		if ok && (value < 0 || value > 100) {
+			v.Fail(path, "must be between 0 and 100")
+		}
+		return value
+	case KindGauge:
+		value, ok := v.number(path, raw)
+		if ok && value < 0 {
+			v.Fail(path, "must not be negative")
+		}
+		return value
+	case KindNumber:
+		value, _ := v.number(path, raw)
+		return value
+	case KindString:
+		var value string
+		if err := json.Unmarshal(raw, &value); err != nil {
+			v.Fail(path, "must be a string")
+		} else if field.NotEmpty && value == "" {
+			v.Fail(path, "must not be empty")
+		}
+		return value
+	case KindStrings:
+		var values []string
+		if err := json.Unmarshal(raw, &values); err != nil {
+			v.Fail(path, "must be a list of strings")
+		}
+		return values
+	}
+	v.Fail(path, "has an unknown kind")
+	return nil
+}
+
+func (v *Validator) number(path string, raw json.RawMessage) (float64, bool) {
+	var value float64
+	if err := json.Unmarshal(raw, &value); err != nil || string(raw) == "null" {
+		v.Fail(path, "must be a number")
+		return 0, false
+	}
+	return value, true
+}
+
+func sortedKeys(members map[string]json.RawMessage) []string {
+	keys := make([]string, 0, len(members))
+	for key := range members {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
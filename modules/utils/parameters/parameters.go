@@ -0,0 +1,304 @@
+// Package parameters describes every reading a device can report: the shape
+// of its payload, the raw table it is stored in, how it is aggregated hourly
+// and how its threshold alerts are evaluated and worded. Services are driven
+// from this registry, so a new metric only needs a new descriptor.
+package parameters
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+type Kind int
+
+const (
+	// KindCounter is a non-negative integer.
+	KindCounter Kind = iota
+	// KindPercent is a number between 0 and 100.
+	KindPercent
+	// KindGauge is a non-negative number.
+	KindGauge
+	// KindNumber is any number.
+	KindNumber
+	KindString
+	KindStrings
+)
+
+type Shape int
+
+const (
+	// ShapeObject is a single object holding every field.
+	ShapeObject Shape = iota
+	// ShapeEntries maps a dimension value, such as a disk name, to an object of fields.
+	ShapeEntries
+	// ShapeValues maps a dimension value straight to the only field.
+	ShapeValues
+)
+
+type Aggregation int
+
+const (
+	AggregateNone Aggregation = iota
+	// AggregateStats keeps AVG_, MIN_ and MAX_ columns for the field.
+	AggregateStats
+	// AggregateMax keeps the maximum under the field's own column name.
+	AggregateMax
+)
+
+type Field struct {
+	Name string
+	// Aliases are other spellings of Name still sent by older agents, read
+	// when Name itself is missing.
+	Aliases   []string
+	Column    string
+	Kind      Kind
+	NotEmpty  bool
+	Aggregate Aggregation
+}
+
+// Dimension tells apart the rows of one reading, for parameters with one row per disk, interface or sensor.
+type Dimension struct {
+	Column string
+}
+
+type Threshold struct {
+	Field string
+	// SkipKeys are dimension values that are never evaluated.
+	SkipKeys []string
+	// Message accepts {device}, {key}, {value} and {threshold}.
+	Message string
+}
+
+type Parameter struct {
+	ID          string
+	Shape       Shape
+	Table       string
+	Dimension   *Dimension
+	Fields      []Field
+	HourlyTable string
+	Threshold   *Threshold
+}
+
+var registry = map[string]*Parameter{}
+
+func register(p *Parameter) {
+	if _, exists := registry[p.ID]; exists {
+		panic(fmt.Sprintf("parameter %s registered twice", p.ID))
+	}
+	if (p.Shape == ShapeObject) != (p.Dimension == nil) {
+		panic(fmt.Sprintf("parameter %s: only entries and values have a dimension", p.ID))
+	}
+	if p.Shape == ShapeValues && len(p.Fields) != 1 {
+		panic(fmt.Sprintf("parameter %s: values hold exactly one field", p.ID))
+	}
+	registry[p.ID] = p
+}
+
+func Lookup(id string) (*Parameter, bool) {
+	p, ok := registry[id]
+	return p, ok
+}
+
+// All returns every registered parameter sorted by ID.
+func All() []*Parameter {
+	all := make([]*Parameter, 0, len(registry))
+	for _, p := range registry {
+		all = append(all, p)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].ID < all[j].ID })
+	return all
+}
+
+func (p *Parameter) Field(name string) (Field, bool) {
+	for _, field := range p.Fields {
+		if field.Name == name {
+			return field, true
+		}
+	}
+	return Field{}, false
+}
+
+// Columns lists the raw table columns in the order Row fills them.
+func (p *Parameter) Columns() []string {
+	columns := []string{"ID_DEVICE"}
+	if p.Dimension != nil {
+		columns = append(columns, p.Dimension.Column)
+	}
+	for _, field := range p.Fields {
+		columns = append(columns, field.Column)
+	}
+	return append(columns, "COLLECTED_AT_UTC")
+}
+
+// NaturalKey lists the columns that identify a reading in the raw table, a
+// device reports each parameter, dimension included, once per collection time.
+func (p *Parameter) NaturalKey() []string {
+	key := []string{"ID_DEVICE"}
+	if p.Dimension != nil {
+		key = append(key, p.Dimension.Column)
+	}
+	return append(key, "COLLECTED_AT_UTC")
+}
+
+// Row returns the values of entry in the order of Columns.
+func (p *Parameter) Row(deviceID string, collectedAt time.Time, entry Entry) []any {
+	row := []any{deviceID}
+	if p.Dimension != nil {
+		row = append(row, entry.Key)
+	}
+	for _, field := range p.Fields {
+		value := entry.Values[field.Name]
+		if field.Kind == KindStrings {
+			value = fmt.Sprintf("%v", value)
+		}
+		row = append(row, value)
+	}
+	return append(row, collectedAt)
+}
+
+// Message words a threshold alert for this parameter.
+func (p *Parameter) Message(deviceID string, key string, value float64, threshold float64) string {
+	if p.Threshold == nil {
+		return ""
+	}
+	return strings.NewReplacer(
+		"{device}", deviceID,
+		"{key}", key,
+		"{value}", fmt.Sprintf("%.2f", value),
+		"{threshold}", fmt.Sprintf("%.2f", threshold),
+	).Replace(p.Threshold.Message)
+}
+
+func init() {
+	register(&Parameter{
+		ID:    "ram",
+		Shape: ShapeObject,
+		Table: "RAM_USAGE",
+		Fields: []Field{
+			{Name: "totalRAM", Column: "TOTAL_RAM", Kind: KindCounter, Aggregate: AggregateMax},
+			{Name: "freeRAM", Column: "FREE_RAM", Kind: KindCounter},
+			{Name: "usedRAM", Column: "USED_RAM", Kind: KindCounter},
+			{Name: "usedPercentRAM", Column: "USED_PERCENT_RAM", Kind: KindPercent, Aggregate: AggregateStats},
+		},
+		HourlyTable: "RAM_USAGE_HOURLY",
+		Threshold: &Threshold{
+			Field:   "usedPercentRAM",
+			Message: "El dispositivo {device} reportó un uso de RAM de {value} %, superando el umbral definido de {threshold} %",
+		},
+	})
+
+	register(&Parameter{
+		ID:        "disk",
+		Shape:     ShapeEntries,
+		Table:     "DISK_USAGE",
+		Dimension: &Dimension{Column: "DISK_NAME"},
+		Fields: []Field{
+			{Name: "totalDisk", Column: "TOTAL_DISK", Kind: KindCounter, Aggregate: AggregateMax},
+			{Name: "freeDisk", Column: "FREE_DISK", Kind: KindCounter},
+			{Name: "usedDisk", Column: "USED_DISK", Kind: KindCounter},
+			{Name: "usedPercentDisk", Column: "USED_PERCENT_DISK", Kind: KindPercent, Aggregate: AggregateStats},
+		},
+		HourlyTable: "DISK_USAGE_HOURLY",
+		Threshold: &Threshold{
+			Field:   "usedPercentDisk",
+			Message: "El disco {key} en el dispositivo {device} reportó un uso del {value} %, superando el umbral definido de {threshold} %",
+		},
+	})
+
+	register(&Parameter{
+		ID:        "net_stats",
+		Shape:     ShapeEntries,
+		Table:     "NETWORK_STATS",
+		Dimension: &Dimension{Column: "INTERFACE_NAME"},
+		Fields: []Field{
+			{Name: "bytesSent", Column: "BYTES_SENT", Kind: KindCounter},
+			{Name: "bytesRecv", Column: "BYTES_RECV", Kind: KindCounter},
+			{Name: "packetsSent", Column: "PACKETS_SENT", Kind: KindCounter},
+			{Name: "packetsRecv", Column: "PACKETS_RECV", Kind: KindCounter},
+			// Agents report these under the psutil names.
+			{Name: "errOut", Aliases: []string{"errout"}, Column: "ERROUT", Kind: KindCounter},
+			{Name: "errIn", Aliases: []string{"errin"}, Column: "ERRIN", Kind: KindCounter},
+			{Name: "dropIn", Aliases: []string{"dropin"}, Column: "DROPIN", Kind: KindCounter},
+			{Name: "dropOut", Aliases: []string{"dropout"}, Column: "DROPOUT", Kind: KindCounter},
+		},
+	})
+
+	register(&Parameter{
+		ID:        "net_info",
+		Shape:     ShapeEntries,
+		Table:     "NETWORK_INFORMATION",
+		Dimension: &Dimension{Column: "INTERFACE_NAME"},
+		Fields: []Field{
+			{Name: "mtu", Column: "MTU", Kind: KindCounter},
+			{Name: "hardwareAddr", Column: "HARDWARE_ADDR", Kind: KindString},
+			{Name: "flags", Column: "FLAGS", Kind: KindStrings},
+			{Name: "addrs", Column: "ADDRS", Kind: KindStrings},
+		},
+	})
+
+	register(&Parameter{
+		ID:        "cpu_temp",
+		Shape:     ShapeValues,
+		Table:     "CPU_TEMPERATURE",
+		Dimension: &Dimension{Column: "SENSOR_KEY"},
+		Fields: []Field{
+			{Name: "temperature", Column: "TEMPERATURE", Kind: KindNumber, Aggregate: AggregateStats},
+		},
+		HourlyTable: "CPU_TEMPERATURE_HOURLY",
+		Threshold: &Threshold{
+			Field:    "temperature",
+			SkipKeys: []string{"cpu_thermal_crit"},
+			Message:  "El sensor {key} en el dispositivo {device} reportó {value} °C, superando el umbral definido de {threshold} °C",
+		},
+	})
+
+	register(&Parameter{
+		ID:    "uptime",
+		Shape: ShapeObject,
+		Table: "UPTIME",
+		Fields: []Field{
+			{Name: "uptime", Column: "UPTIME_MINUTES", Kind: KindCounter},
+		},
+	})
+
+	register(&Parameter{
+		ID:    "last_reboot",
+		Shape: ShapeObject,
+		Table: "LAST_REBOOT",
+		Fields: []Field{
+			{Name: "lastReboot", Column: "LAST_REBOOT", Kind: KindString, NotEmpty: true},
+		},
+	})
+
+	register(&Parameter{
+		ID:    "cpu_usage",
+		Shape: ShapeObject,
+		Table: "CPU_USAGE",
+		Fields: []Field{
+			{Name: "cpuUsage", Column: "CPU_USAGE", Kind: KindPercent, Aggregate: AggregateStats},
+		},
+		HourlyTable: "CPU_USAGE_HOURLY",
+		Threshold: &Threshold{
+			Field:   "cpuUsage",
+			Message: "El dispositivo {device} reportó un uso de CPU de {value} %, superando el umbral definido de {threshold} %",
+		},
+	})
+
+	register(&Parameter{
+		ID:    "load_average",
+		Shape: ShapeObject,
+		Table: "LOAD_AVERAGE",
+		Fields: []Field{
+			{Name: "loadAverage1m", Column: "LOAD_AVERAGE_1M", Kind: KindGauge, Aggregate: AggregateStats},
+			{Name: "loadAverage5m", Column: "LOAD_AVERAGE_5M", Kind: KindGauge, Aggregate: AggregateStats},
+			{Name: "loadAverage15m", Column: "LOAD_AVERAGE_15M", Kind: KindGauge, Aggregate: AggregateStats},
+		},
+		HourlyTable: "LOAD_AVERAGE_HOURLY",
+		Threshold: &Threshold{
+			Field:   "loadAverage5m",
+			Message: "El dispositivo {device} reportó una carga de CPU de {value} %, superando el umbral definido de {threshold} %",
+		},
+	})
+}